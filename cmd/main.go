@@ -1,39 +1,92 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-redis/redis/v8"
+	"realtime_leaderboard/internal/config"
 	"realtime_leaderboard/internal/database"
+	"realtime_leaderboard/internal/ratelimit"
 	"realtime_leaderboard/internal/server"
 	"realtime_leaderboard/internal/services"
 )
 
 func main() {
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		log.Fatal("DATABASE_URL environment variable not set")
-	}
-
-	db, err := database.NewDB(dbURL)
+	cfg, err := config.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		log.Fatal("REDIS_ADDR environment variable not set")
+	db, err := database.NewDB(cfg.DatabaseURL, cfg.Timeouts.Database)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	redisClient := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
+		Addr:         cfg.RedisAddr,
+		ReadTimeout:  cfg.Timeouts.Redis,
+		WriteTimeout: cfg.Timeouts.Redis,
 	})
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	quizService := services.NewQuizService(db, redisClient)
-	ser := server.NewServer(quizService)
+	go quizService.RunLeaderboardArchiver(ctx, 10*time.Minute)
+	go quizService.RunOutboxRelay(ctx, 5*time.Second)
+	go quizService.RunScheduler(ctx, time.Second)
+	go quizService.RunQuestionCloser(ctx, time.Second)
+	scoresFlushed := make(chan struct{})
+	go func() {
+		defer close(scoresFlushed)
+		quizService.RunScoreFlusher(ctx, time.Second)
+	}()
+
+	ser := server.NewServer(quizService,
+		server.WithRateLimiters(server.RateLimiters{
+			Answers:       ratelimit.NewLimiter(redisClient, "answers", cfg.RateLimits.Answers),
+			AnswersPerIP:  ratelimit.NewLimiter(redisClient, "answers_ip", cfg.RateLimits.AnswersPerIP),
+			Connects:      ratelimit.NewLimiter(redisClient, "connects", cfg.RateLimits.Connects),
+			ConnectsPerIP: ratelimit.NewLimiter(redisClient, "connects_ip", cfg.RateLimits.ConnectsPerIP),
+			Leaderboard:   ratelimit.NewLimiter(redisClient, "leaderboard", cfg.RateLimits.Leaderboard),
+			Joins:         ratelimit.NewLimiter(redisClient, "joins", cfg.RateLimits.Joins),
+			FailedJoins:   ratelimit.NewLimiter(redisClient, "failed_joins", cfg.RateLimits.FailedJoins),
+		}),
+		server.WithTrustProxyHeaders(cfg.TrustProxyHeaders),
+		server.WithProxyHops(cfg.ProxyHops),
+		server.WithHostKey(cfg.HostKey),
+		server.WithBroadcastInterval(cfg.BroadcastInterval),
+		server.WithWebSocketConfig(server.WebSocketConfig{
+			AllowedOrigins:     cfg.WebSocket.AllowedOrigins,
+			Subprotocols:       cfg.WebSocket.Subprotocols,
+			RequireSubprotocol: cfg.WebSocket.RequireSubprotocol,
+			EnableCompression:  cfg.WebSocket.EnableCompression,
+			CompressionLevel:   cfg.WebSocket.CompressionLevel,
+			ReadLimit:          cfg.WebSocket.ReadLimit,
+		}),
+	)
+
+	httpServer := &http.Server{Addr: ":8080", Handler: ser.Router}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Println(err)
+		}
+	}()
 
 	log.Println("Starting ser on :8080")
-	log.Fatal(http.ListenAndServe(":8080", ser.Router))
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	// Wait for the last buffered scores to reach Postgres
+	<-scoresFlushed
 }
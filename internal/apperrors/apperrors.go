@@ -0,0 +1,102 @@
+// Package apperrors defines the domain errors returned by the service and
+// database layers. Each error has a stable code that clients can match on,
+// and a kind that decides how the server reports it.
+package apperrors
+
+import "errors"
+
+// Kind classifies domain errors by what went wrong, independent of how the
+// failure is reported.
+type Kind int
+
+const (
+	Internal Kind = iota
+	Invalid
+	NotFound
+	Conflict
+	Unauthorized
+	Forbidden
+	RateLimited
+)
+
+type Error struct {
+	Kind    Kind   `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details says more about what went wrong, such as every problem found
+	// in a request.
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is matches errors with the same code, so that errors carrying details
+// still match their sentinel.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithDetails returns a copy of the error carrying details.
+func (e *Error) WithDetails(details interface{}) *Error {
+	copied := *e
+	copied.Details = details
+	return &copied
+}
+
+func New(kind Kind, code, message string) *Error {
+	return &Error{Kind: kind, Code: code, Message: message}
+}
+
+// InvalidRequest reports a malformed request.
+func InvalidRequest(message string) *Error {
+	return New(Invalid, "invalid_request", message)
+}
+
+var (
+	ErrInternal = New(Internal, "internal", "internal server error")
+
+	ErrQuizNotFound     = New(NotFound, "quiz_not_found", "quiz not found")
+	ErrQuestionNotFound = New(NotFound, "question_not_found", "question not found")
+	ErrUserNotFound     = New(NotFound, "user_not_found", "user not found")
+	ErrPINNotFound      = New(NotFound, "pin_not_found", "no running quiz has that PIN")
+	ErrSnapshotNotFound = New(NotFound, "snapshot_not_found", "no leaderboard was recorded after that question")
+
+	ErrQuestionNotInQuiz  = New(Invalid, "question_not_in_quiz", "question does not belong to quiz")
+	ErrInvalidPeriod      = New(Invalid, "invalid_period", "period should be one of daily, weekly, monthly or alltime")
+	ErrInvalidTeamName    = New(Invalid, "invalid_team_name", "invalid team name")
+	ErrInvalidUsername    = New(Invalid, "invalid_username", "username should be 3 to 32 letters, digits, dots, dashes or underscores")
+	ErrInvalidDisplayName = New(Invalid, "invalid_display_name", "invalid display name")
+	ErrInvalidAvatarURL   = New(Invalid, "invalid_avatar_url", "avatar URL should be an http or https URL")
+	ErrInvalidNickname    = New(Invalid, "invalid_nickname", "invalid nickname")
+	ErrInvalidStartTime   = New(Invalid, "invalid_start_time", "start time should be in the future")
+	ErrInvalidQuiz        = New(Invalid, "invalid_quiz", "quiz has errors")
+	ErrUnknownMessageType = New(Invalid, "unknown_message_type", "unknown message type")
+
+	ErrQuestionClosed  = New(Conflict, "question_closed", "question is closed")
+	ErrQuestionNotOpen = New(Conflict, "question_not_open", "no question has been opened yet")
+	ErrDuplicateAnswer = New(Conflict, "duplicate_answer", "question has already been answered")
+	ErrQuizStarted     = New(Conflict, "quiz_started", "quiz has already started")
+	ErrQuizFinished    = New(Conflict, "quiz_finished", "quiz has already finished")
+	ErrUsernameTaken   = New(Conflict, "username_taken", "username is already taken")
+	ErrQuizInProgress  = New(Conflict, "quiz_in_progress", "quiz can't be exported until it has finished")
+
+	ErrUnauthorized       = New(Unauthorized, "unauthorized", "authentication required")
+	ErrInvalidResumeToken = New(Unauthorized, "invalid_resume_token", "invalid or expired resume token")
+	ErrInvalidHostKey     = New(Unauthorized, "invalid_host_key", "hosting a quiz needs a valid host key")
+	ErrNotParticipant     = New(Forbidden, "not_participant", "user is not a participant of the quiz")
+
+	ErrRateLimited = New(RateLimited, "rate_limited", "too many requests")
+)
+
+// From returns the domain error in err's chain, or ErrInternal if there is
+// none.
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return ErrInternal
+}
@@ -0,0 +1,226 @@
+package config
+
+import (
+	"compress/flate"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"realtime_leaderboard/internal/ratelimit"
+)
+
+type Config struct {
+	DatabaseURL string
+	RedisAddr   string
+	// TrustProxyHeaders makes rate limiting key clients by the address in
+	// X-Forwarded-For that ProxyHops proxies in front of the server added,
+	// instead of the connection's address. Entries further left are set by
+	// the client and aren't trusted.
+	TrustProxyHeaders bool
+	ProxyHops         int
+	// HostKey is what hosts must present to connect as a quiz's host and
+	// for host actions. While it is empty, nobody can host.
+	HostKey string
+	// BroadcastInterval is the shortest time between two leaderboard
+	// broadcasts to a quiz.
+	BroadcastInterval time.Duration
+	RateLimits        RateLimits
+	WebSocket         WebSocket
+	Timeouts          Timeouts
+}
+
+// Timeouts bound each individual database query and Redis command, on top
+// of any deadline of the request they serve.
+type Timeouts struct {
+	Database time.Duration
+	Redis    time.Duration
+}
+
+type WebSocket struct {
+	// AllowedOrigins may contain "*" or wildcard subdomains such as
+	// "https://*.example.com". Empty allows same-origin connections only.
+	AllowedOrigins     []string
+	Subprotocols       []string
+	RequireSubprotocol bool
+	EnableCompression  bool
+	CompressionLevel   int
+	ReadLimit          int64
+}
+
+// RateLimits are applied per user and per client IP.
+type RateLimits struct {
+	Answers       ratelimit.Limit
+	AnswersPerIP  ratelimit.Limit
+	Connects      ratelimit.Limit
+	ConnectsPerIP ratelimit.Limit
+	Leaderboard   ratelimit.Limit
+	Joins         ratelimit.Limit
+	FailedJoins   ratelimit.Limit
+}
+
+// Load reads the configuration from environment variables, using defaults
+// for anything that isn't set.
+func Load() (*Config, error) {
+	cfg := &Config{
+		DatabaseURL: os.Getenv("DATABASE_URL"),
+		RedisAddr:   os.Getenv("REDIS_ADDR"),
+		HostKey:     os.Getenv("HOST_KEY"),
+	}
+	if cfg.DatabaseURL == "" {
+		return nil, fmt.Errorf("DATABASE_URL environment variable not set")
+	}
+	if cfg.RedisAddr == "" {
+		return nil, fmt.Errorf("REDIS_ADDR environment variable not set")
+	}
+
+	var err error
+	if cfg.TrustProxyHeaders, err = envBool("TRUST_PROXY_HEADERS", false); err != nil {
+		return nil, err
+	}
+	if cfg.ProxyHops, err = envInt("PROXY_HOPS", 1); err != nil {
+		return nil, err
+	}
+	if cfg.ProxyHops < 1 {
+		return nil, fmt.Errorf("PROXY_HOPS must be at least 1")
+	}
+	// Players behind one address, such as a classroom's, share its limits
+	if cfg.RateLimits.Answers, err = envLimit("ANSWER", ratelimit.Limit{Rate: 2, Burst: 5}); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimits.AnswersPerIP, err = envLimit("ANSWER_IP", ratelimit.Limit{Rate: 50, Burst: 200}); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimits.Connects, err = envLimit("CONNECT", ratelimit.Limit{Rate: 0.2, Burst: 5}); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimits.ConnectsPerIP, err = envLimit("CONNECT_IP", ratelimit.Limit{Rate: 5, Burst: 200}); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimits.Leaderboard, err = envLimit("LEADERBOARD", ratelimit.Limit{Rate: 5, Burst: 20}); err != nil {
+		return nil, err
+	}
+	// A whole class may join from one address, but unknown PINs are limited
+	// tightly since each one is a guess
+	if cfg.RateLimits.Joins, err = envLimit("JOIN", ratelimit.Limit{Rate: 2, Burst: 100}); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimits.FailedJoins, err = envLimit("JOIN_FAILURE", ratelimit.Limit{Rate: 0.1, Burst: 5}); err != nil {
+		return nil, err
+	}
+
+	cfg.WebSocket.AllowedOrigins = envList("ALLOWED_ORIGINS")
+	cfg.WebSocket.Subprotocols = envList("WS_SUBPROTOCOLS")
+	if len(cfg.WebSocket.Subprotocols) == 0 {
+		cfg.WebSocket.Subprotocols = []string{"quiz.v1.json", "quiz.v1.msgpack"}
+	}
+	if cfg.WebSocket.RequireSubprotocol, err = envBool("WS_REQUIRE_SUBPROTOCOL", false); err != nil {
+		return nil, err
+	}
+	if cfg.WebSocket.EnableCompression, err = envBool("WS_ENABLE_COMPRESSION", false); err != nil {
+		return nil, err
+	}
+	if cfg.WebSocket.CompressionLevel, err = envInt("WS_COMPRESSION_LEVEL", flate.BestSpeed); err != nil {
+		return nil, err
+	}
+	if cfg.WebSocket.CompressionLevel < flate.HuffmanOnly || cfg.WebSocket.CompressionLevel > flate.BestCompression {
+		return nil, fmt.Errorf("WS_COMPRESSION_LEVEL must be between %d and %d", flate.HuffmanOnly, flate.BestCompression)
+	}
+	readLimit, err := envInt("WS_READ_LIMIT", 4096)
+	if err != nil {
+		return nil, err
+	}
+	cfg.WebSocket.ReadLimit = int64(readLimit)
+
+	if cfg.Timeouts.Database, err = envDuration("DB_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Timeouts.Redis, err = envDuration("REDIS_TIMEOUT", time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.BroadcastInterval, err = envDuration("LEADERBOARD_BROADCAST_INTERVAL", 250*time.Millisecond); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// envList reads a comma separated list, skipping empty items.
+func envList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envLimit reads <PREFIX>_RATE_LIMIT (tokens per second, 0 to disable) and
+// <PREFIX>_RATE_BURST.
+func envLimit(prefix string, def ratelimit.Limit) (ratelimit.Limit, error) {
+	rate, err := envFloat(prefix+"_RATE_LIMIT", def.Rate)
+	if err != nil {
+		return ratelimit.Limit{}, err
+	}
+	burst, err := envInt(prefix+"_RATE_BURST", def.Burst)
+	if err != nil {
+		return ratelimit.Limit{}, err
+	}
+	if rate < 0 || burst < 1 {
+		return ratelimit.Limit{}, fmt.Errorf("%s rate limit must be non-negative with a burst of at least 1", prefix)
+	}
+	return ratelimit.Limit{Rate: rate, Burst: burst}, nil
+}
+
+func envInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func envFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return f, nil
+}
+
+func envBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+// envDuration reads a duration such as "500ms" or "2s".
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s must not be negative", key)
+	}
+	return d, nil
+}
@@ -3,37 +3,113 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"realtime_leaderboard/internal/apperrors"
 	"realtime_leaderboard/internal/models"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// uniqueViolation is the Postgres error code for a unique constraint
+// violation.
+const uniqueViolation = "23505"
+
 type DB struct {
 	*sql.DB
+	// Timeout bounds every query, including the whole of a transaction.
+	// Zero means queries only stop when their context is done.
+	Timeout time.Duration
 }
 
-func NewDB(connStr string) (*DB, error) {
+func NewDB(connStr string, timeout time.Duration) (*DB, error) {
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
 	}
-	if err := db.Ping(); err != nil {
+	d := &DB{DB: db, Timeout: timeout}
+	ctx, cancel := d.withTimeout(context.Background())
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
 		return nil, err
 	}
-	return &DB{db}, nil
+	return d, nil
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx, so that queries can
+// run on their own or as part of a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, db.Timeout)
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation
 }
 
 func (db *DB) GetQuestion(ctx context.Context, questionID string) (*models.Question, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 	q := &models.Question{}
-	err := db.QueryRowContext(ctx, "SELECT id, quiz_id, question_text, options, correct_answer FROM questions WHERE id = $1", questionID).
-		Scan(&q.ID, &q.QuizID, &q.QuestionText, &q.Options, &q.CorrectAnswer)
+	err := db.QueryRowContext(ctx, `
+		SELECT id, quiz_id, question_type, question_text, COALESCE(correct_answer, ''),
+		       correct_answers, tolerance, partial_credit, points, time_limit_seconds
+		FROM questions WHERE id = $1
+	`, questionID).
+		Scan(&q.ID, &q.QuizID, &q.Type, &q.QuestionText, &q.CorrectAnswer,
+			&q.CorrectAnswers, &q.Tolerance, &q.PartialCredit, &q.Points, &q.TimeLimitSeconds)
+	if err == sql.ErrNoRows {
+		return nil, apperrors.ErrQuestionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q.Options, err = db.GetQuestionOptions(ctx, questionID)
 	if err != nil {
 		return nil, err
 	}
 	return q, nil
 }
 
+func (db *DB) GetQuestionOptions(ctx context.Context, questionID string) ([]models.QuestionOption, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, question_id, position, option_text, is_correct, correct_position
+		FROM question_options
+		WHERE question_id = $1
+		ORDER BY position
+	`, questionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var options []models.QuestionOption
+	for rows.Next() {
+		var o models.QuestionOption
+		if err := rows.Scan(&o.ID, &o.QuestionID, &o.Position, &o.Text, &o.IsCorrect, &o.CorrectPosition); err != nil {
+			return nil, err
+		}
+		options = append(options, o)
+	}
+	return options, rows.Err()
+}
+
 func (db *DB) UpdateUserScore(ctx context.Context, quizID, userID string, increment int) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 	_, err := db.ExecContext(ctx, `
         INSERT INTO user_scores (quiz_id, user_id, score)
         VALUES ($1, $2, $3)
@@ -44,17 +120,19 @@ func (db *DB) UpdateUserScore(ctx context.Context, quizID, userID string, increm
 }
 
 func (db *DB) GetLeaderboard(ctx context.Context, quizID string, page, pageSize int) ([]models.LeaderboardEntry, int, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
 	offset := (page - 1) * pageSize
 
 	var totalCount int
-	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM user_scores WHERE quiz_id = $1", quizID).Scan(&totalCount)
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM quiz_scores WHERE quiz_id = $1", quizID).Scan(&totalCount)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	rows, err := db.QueryContext(ctx, `
-		SELECT u.id, u.username, us.score
-		FROM user_scores us
+		SELECT u.id, COALESCE(NULLIF(u.display_name, ''), u.username), us.score
+		FROM quiz_scores us
 		JOIN users u ON us.user_id = u.id
 		WHERE us.quiz_id = $1
 		ORDER BY us.score DESC
@@ -76,3 +154,286 @@ func (db *DB) GetLeaderboard(ctx context.Context, quizID string, page, pageSize
 
 	return leaderboard, totalCount, nil
 }
+
+func insertAnswer(ctx context.Context, q querier, a *models.AnswerRecord) error {
+	answer := pq.StringArray(a.Answer)
+	if answer == nil {
+		answer = pq.StringArray{}
+	}
+	return q.QueryRowContext(ctx, `
+		INSERT INTO answers (quiz_id, question_id, user_id, answer, is_correct, points, response_time_ms, scored)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $6 = 0)
+		RETURNING id, answered_at
+	`, a.QuizID, a.QuestionID, a.UserID, answer, a.Correct, a.Points, a.ResponseTimeMs).
+		Scan(&a.ID, &a.AnsweredAt)
+}
+
+// RecordAnswer stores a graded answer and queues an answer_recorded outbox
+// event in one transaction. Each user may answer a question only once. The
+// answer's points count towards quiz_scores straight away and are added to
+// user_scores by FlushScores.
+func (db *DB) RecordAnswer(ctx context.Context, a *models.AnswerRecord) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertAnswer(ctx, tx, a); err != nil {
+		if isUniqueViolation(err) {
+			return apperrors.ErrDuplicateAnswer
+		}
+		return err
+	}
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO outbox (event_type, quiz_id, payload)
+		VALUES ($1, $2, $3)
+	`, models.OutboxEventAnswerRecorded, a.QuizID, payload)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) GetUserScore(ctx context.Context, quizID, userID string) (int, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	var score int
+	err := db.QueryRowContext(ctx, "SELECT score FROM quiz_scores WHERE quiz_id = $1 AND user_id = $2", quizID, userID).
+		Scan(&score)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return score, err
+}
+
+func (db *DB) GetUserQuizAnswers(ctx context.Context, quizID, userID string) ([]models.AnswerRecord, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.id, a.quiz_id, a.question_id, q.question_text, a.user_id, a.answer,
+		       a.is_correct, a.points, a.response_time_ms, a.answered_at
+		FROM answers a
+		JOIN questions q ON a.question_id = q.id
+		WHERE a.quiz_id = $1 AND a.user_id = $2
+		ORDER BY a.answered_at, a.id
+	`, quizID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var answers []models.AnswerRecord
+	for rows.Next() {
+		var a models.AnswerRecord
+		if err := rows.Scan(&a.ID, &a.QuizID, &a.QuestionID, &a.QuestionText, &a.UserID, (*pq.StringArray)(&a.Answer),
+			&a.Correct, &a.Points, &a.ResponseTimeMs, &a.AnsweredAt); err != nil {
+			return nil, err
+		}
+		answers = append(answers, a)
+	}
+	return answers, rows.Err()
+}
+
+func (db *DB) GetUserAnswerHistory(ctx context.Context, userID string, page, pageSize int) ([]models.AnswerRecord, int, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	offset := (page - 1) * pageSize
+
+	var totalCount int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM answers WHERE user_id = $1", userID).Scan(&totalCount)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.id, a.quiz_id, COALESCE(z.title, ''), a.question_id, q.question_text, a.user_id, a.answer,
+		       a.is_correct, a.points, a.response_time_ms, a.answered_at
+		FROM answers a
+		JOIN questions q ON a.question_id = q.id
+		JOIN quizzes z ON a.quiz_id = z.id
+		WHERE a.user_id = $1
+		ORDER BY a.answered_at DESC, a.id DESC
+		LIMIT $2 OFFSET $3
+	`, userID, pageSize, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var history []models.AnswerRecord
+	for rows.Next() {
+		var a models.AnswerRecord
+		if err := rows.Scan(&a.ID, &a.QuizID, &a.QuizTitle, &a.QuestionID, &a.QuestionText, &a.UserID, (*pq.StringArray)(&a.Answer),
+			&a.Correct, &a.Points, &a.ResponseTimeMs, &a.AnsweredAt); err != nil {
+			return nil, 0, err
+		}
+		history = append(history, a)
+	}
+	return history, totalCount, rows.Err()
+}
+
+func (db *DB) GetUsernames(ctx context.Context, userIDs []string) (map[string]string, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT id, COALESCE(NULLIF(display_name, ''), username) FROM users WHERE id = ANY($1)", pq.StringArray(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usernames := make(map[string]string, len(userIDs))
+	for rows.Next() {
+		var id, username string
+		if err := rows.Scan(&id, &username); err != nil {
+			return nil, err
+		}
+		usernames[id] = username
+	}
+	return usernames, rows.Err()
+}
+
+// ArchiveLeaderboard stores the final standings of a finished leaderboard
+// period. Archiving the same period twice keeps the first copy.
+func (db *DB) ArchiveLeaderboard(ctx context.Context, period, bucket string, entries []models.LeaderboardEntry) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	userIDs := make(pq.StringArray, len(entries))
+	scores := make(pq.Int64Array, len(entries))
+	ranks := make(pq.Int64Array, len(entries))
+	for i, e := range entries {
+		userIDs[i] = e.UserID
+		scores[i] = int64(e.Score)
+		ranks[i] = int64(i + 1)
+		if i > 0 && e.Score == entries[i-1].Score {
+			ranks[i] = ranks[i-1]
+		}
+	}
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO leaderboard_archives (period, bucket, user_id, score, rank)
+		SELECT $1, $2, t.user_id, t.score, t.rank
+		FROM unnest($3::text[], $4::int[], $5::int[]) AS t(user_id, score, rank)
+		ON CONFLICT (period, bucket, user_id) DO NOTHING
+	`, period, bucket, userIDs, scores, ranks)
+	return err
+}
+
+func (db *DB) GetArchivedLeaderboard(ctx context.Context, period, bucket string, page, pageSize int) ([]models.LeaderboardEntry, int, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	offset := (page - 1) * pageSize
+
+	var totalCount int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM leaderboard_archives WHERE period = $1 AND bucket = $2", period, bucket).
+		Scan(&totalCount)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, COALESCE(NULLIF(u.display_name, ''), u.username), la.score
+		FROM leaderboard_archives la
+		JOIN users u ON la.user_id = u.id
+		WHERE la.period = $1 AND la.bucket = $2
+		ORDER BY la.rank, u.id
+		LIMIT $3 OFFSET $4
+	`, period, bucket, pageSize, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var leaderboard []models.LeaderboardEntry
+	for rows.Next() {
+		var e models.LeaderboardEntry
+		if err := rows.Scan(&e.UserID, &e.Username, &e.Score); err != nil {
+			return nil, 0, err
+		}
+		leaderboard = append(leaderboard, e)
+	}
+	return leaderboard, totalCount, rows.Err()
+}
+
+// JoinTeam adds the user to the quiz's team with the given name, creating
+// the team if needed and moving the user out of any other team in the quiz.
+func (db *DB) JoinTeam(ctx context.Context, quizID, userID, teamID, teamName string) (*models.Team, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	team := &models.Team{QuizID: quizID, Name: teamName}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO teams (id, quiz_id, name)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (quiz_id, name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id
+	`, teamID, quizID, teamName).Scan(&team.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO team_members (quiz_id, user_id, team_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (quiz_id, user_id)
+		DO UPDATE SET team_id = EXCLUDED.team_id, joined_at = CURRENT_TIMESTAMP
+	`, quizID, userID, team.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return team, tx.Commit()
+}
+
+// GetTeamLeaderboard ranks the quiz's teams using the quiz's team scoring
+// mode. Members without a score count as zero.
+func (db *DB) GetTeamLeaderboard(ctx context.Context, quizID string) ([]models.TeamLeaderboardEntry, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, `
+		WITH member_scores AS (
+			SELECT tm.team_id, COALESCE(us.score, 0) AS score,
+			       ROW_NUMBER() OVER (PARTITION BY tm.team_id ORDER BY COALESCE(us.score, 0) DESC) AS place
+			FROM team_members tm
+			LEFT JOIN quiz_scores us ON us.quiz_id = tm.quiz_id AND us.user_id = tm.user_id
+			WHERE tm.quiz_id = $1
+		)
+		SELECT t.id, t.name, COUNT(ms.team_id),
+		       CASE q.team_scoring
+		           WHEN 'average' THEN COALESCE(ROUND(AVG(ms.score)), 0)
+		           WHEN 'best_n' THEN COALESCE(SUM(ms.score) FILTER (WHERE ms.place <= q.team_best_n), 0)
+		           ELSE COALESCE(SUM(ms.score), 0)
+		       END AS team_score
+		FROM teams t
+		JOIN quizzes q ON t.quiz_id = q.id
+		LEFT JOIN member_scores ms ON ms.team_id = t.id
+		WHERE t.quiz_id = $1
+		GROUP BY t.id, t.name, q.team_scoring, q.team_best_n
+		ORDER BY team_score DESC, t.name
+	`, quizID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var leaderboard []models.TeamLeaderboardEntry
+	for rows.Next() {
+		var e models.TeamLeaderboardEntry
+		if err := rows.Scan(&e.TeamID, &e.Name, &e.Members, &e.Score); err != nil {
+			return nil, err
+		}
+		leaderboard = append(leaderboard, e)
+	}
+	return leaderboard, rows.Err()
+}
@@ -2,15 +2,20 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"github.com/lib/pq"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNewDB(t *testing.T) {
-	db, err := NewDB("invalid://connection")
+	db, err := NewDB("invalid://connection", time.Second)
 	assert.Error(t, err, "should fail with invalid connection string")
 	assert.Nil(t, db, "db should be nil on error")
 }
@@ -20,19 +25,27 @@ func TestGetQuestion(t *testing.T) {
 	assert.NoError(t, err)
 	defer db.Close()
 
-	d := &DB{db}
+	d := &DB{DB: db}
 	ctx := context.Background()
 	questionID := "q1"
 
-	// Mock the options column as a PostgreSQL array string
-	rows := sqlmock.NewRows([]string{"id", "quiz_id", "question_text", "options", "correct_answer"}).
-		AddRow("q1", "quiz1", "What cleans best?", "{Water,Soap}", "Soap")
+	// Mock the correct_answers column as a PostgreSQL array string
+	rows := sqlmock.NewRows([]string{"id", "quiz_id", "question_type", "question_text", "correct_answer",
+		"correct_answers", "tolerance", "partial_credit", "points", "time_limit_seconds"}).
+		AddRow("q1", "quiz1", "single_choice", "What cleans best?", "", "{}", 0.0, false, 1, 20)
 
 	// Escape $1 in the query regex to match PostgreSQL placeholder
-	mock.ExpectQuery(`SELECT id, quiz_id, question_text, options, correct_answer FROM questions WHERE id = \$1`).
+	mock.ExpectQuery(`SELECT id, quiz_id, question_type, question_text, COALESCE\(correct_answer, ''\),\s+correct_answers, tolerance, partial_credit, points, time_limit_seconds\s+FROM questions WHERE id = \$1`).
 		WithArgs(questionID).
 		WillReturnRows(rows)
 
+	optionRows := sqlmock.NewRows([]string{"id", "question_id", "position", "option_text", "is_correct", "correct_position"}).
+		AddRow("q1-1", "q1", 1, "Water", false, nil).
+		AddRow("q1-2", "q1", 2, "Soap", true, nil)
+	mock.ExpectQuery(`SELECT id, question_id, position, option_text, is_correct, correct_position\s+FROM question_options`).
+		WithArgs(questionID).
+		WillReturnRows(optionRows)
+
 	q, err := d.GetQuestion(ctx, questionID)
 	assert.NoError(t, err, "should not return an error")
 	assert.NotNil(t, q, "question should not be nil")
@@ -40,8 +53,14 @@ func TestGetQuestion(t *testing.T) {
 		assert.Equal(t, "q1", q.ID, "question ID should match")
 		assert.Equal(t, "quiz1", q.QuizID, "quiz ID should match")
 		assert.Equal(t, "What cleans best?", q.QuestionText, "question text should match")
-		assert.Equal(t, pq.StringArray{"Water", "Soap"}, q.Options, "options should match")
-		assert.Equal(t, "Soap", q.CorrectAnswer, "correct answer should match")
+		assert.Equal(t, []models.QuestionOption{
+			{ID: "q1-1", QuestionID: "q1", Position: 1, Text: "Water"},
+			{ID: "q1-2", QuestionID: "q1", Position: 2, Text: "Soap", IsCorrect: true},
+		}, q.Options, "options should match")
+		assert.Equal(t, pq.StringArray{}, q.CorrectAnswers, "correct answers should match")
+		assert.Equal(t, models.QuestionTypeSingleChoice, q.Type, "question type should match")
+		assert.Equal(t, 1, q.Points, "points should match")
+		assert.Equal(t, 20, q.TimeLimitSeconds, "time limit should match")
 	}
 
 	assert.NoError(t, mock.ExpectationsWereMet(), "all mock expectations should be met")
@@ -52,7 +71,7 @@ func TestUpdateUserScore(t *testing.T) {
 	assert.NoError(t, err)
 	defer db.Close()
 
-	d := &DB{db}
+	d := &DB{DB: db}
 	ctx := context.Background()
 
 	mock.ExpectExec(`INSERT INTO user_scores`).
@@ -64,19 +83,35 @@ func TestUpdateUserScore(t *testing.T) {
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+func TestUpdateUserScore_Timeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db, Timeout: 10 * time.Millisecond}
+
+	mock.ExpectExec(`INSERT INTO user_scores`).
+		WithArgs("quiz1", "user1", 1).
+		WillDelayFor(time.Second).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err = d.UpdateUserScore(context.Background(), "quiz1", "user1", 1)
+	assert.Error(t, err, "slow queries should be cancelled")
+}
+
 func TestGetLeaderboard(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
-	d := &DB{db}
+	d := &DB{DB: db}
 	ctx := context.Background()
 	quizID := "quiz1"
 	page := 1
 	pageSize := 2
 
 	// Mock total count query
-	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM user_scores WHERE quiz_id = \$1`).
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM quiz_scores WHERE quiz_id = \$1`).
 		WithArgs(quizID).
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(4))
 
@@ -84,7 +119,7 @@ func TestGetLeaderboard(t *testing.T) {
 	rows := sqlmock.NewRows([]string{"id", "username", "score"}).
 		AddRow("user1", "Alice", 10).
 		AddRow("user2", "Bob", 5)
-	mock.ExpectQuery(`SELECT u\.id, u\.username, us\.score FROM user_scores us`).
+	mock.ExpectQuery(`SELECT u\.id, COALESCE\(NULLIF\(u\.display_name, ''\), u\.username\), us\.score FROM quiz_scores us`).
 		WithArgs(quizID, pageSize, (page-1)*pageSize).
 		WillReturnRows(rows)
 
@@ -97,3 +132,380 @@ func TestGetLeaderboard(t *testing.T) {
 	assert.Equal(t, 10, leaderboard[0].Score)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
+
+func TestRecordAnswer_RollsBackOnFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO answers`).
+		WithArgs("quiz1", "q1", "user1", pq.StringArray{"q1-2"}, true, 1, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "answered_at"}).AddRow(7, time.Now()))
+	mock.ExpectExec(`INSERT INTO outbox`).
+		WithArgs(models.OutboxEventAnswerRecorded, "quiz1", sqlmock.AnyArg()).
+		WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	err = d.RecordAnswer(context.Background(), &models.AnswerRecord{
+		QuizID:     "quiz1",
+		QuestionID: "q1",
+		UserID:     "user1",
+		Answer:     models.Answer{"q1-2"},
+		Correct:    true,
+		Points:     1,
+	})
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRecordAnswer_Duplicate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO answers`).
+		WithArgs("quiz1", "q1", "user1", pq.StringArray{"q1-2"}, true, 1, nil).
+		WillReturnError(&pq.Error{Code: uniqueViolation})
+	mock.ExpectRollback()
+
+	err = d.RecordAnswer(context.Background(), &models.AnswerRecord{
+		QuizID:     "quiz1",
+		QuestionID: "q1",
+		UserID:     "user1",
+		Answer:     models.Answer{"q1-2"},
+		Correct:    true,
+		Points:     1,
+	})
+	assert.ErrorIs(t, err, apperrors.ErrDuplicateAnswer)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db}
+	columns := []string{"id", "username", "display_name", "avatar_url", "is_guest", "created_at"}
+	avatarURL := "https://example.com/a.png"
+
+	mock.ExpectQuery(`UPDATE users\s+SET display_name = COALESCE\(\$2, display_name\)`).
+		WithArgs("user1", nil, &avatarURL).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("user1", "alice", "Alice", avatarURL, false, time.Now()))
+	user, err := d.UpdateUser(context.Background(), "user1", nil, &avatarURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "Alice", user.DisplayName)
+	assert.Equal(t, avatarURL, user.AvatarURL)
+
+	mock.ExpectQuery(`UPDATE users`).
+		WithArgs("ghost", nil, nil).
+		WillReturnRows(sqlmock.NewRows(columns))
+	_, err = d.UpdateUser(context.Background(), "ghost", nil, nil)
+	assert.ErrorIs(t, err, apperrors.ErrUserNotFound)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAdvanceSchedules(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db}
+	now := time.Now()
+	startsAt := now.Add(time.Minute)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, schedule_status, starts_at, question_index\s+FROM quizzes\s+WHERE next_transition_at <= \$1`).
+		WithArgs(now, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "schedule_status", "starts_at", "question_index"}).
+			AddRow("quiz1", "scheduled", startsAt, -1).
+			AddRow("quiz2", "running", startsAt, 0).
+			AddRow("quiz3", "question_closed", startsAt, 0).
+			AddRow("quiz4", "question_closed", startsAt, 1))
+	// quiz1's lobby opens until the start
+	mock.ExpectExec(`UPDATE quizzes SET schedule_status`).
+		WithArgs("quiz1", models.ScheduleStatusLobby, -1, &startsAt, models.QuizStatusLobby).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO outbox`).
+		WithArgs(models.OutboxEventQuizTransition, "quiz1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// quiz2's first question closes, and the next opens after the gap
+	mock.ExpectQuery(`SELECT id FROM questions`).
+		WithArgs("quiz2", 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("q1"))
+	mock.ExpectQuery(`UPDATE quizzes SET questions_closed = questions_closed \+ 1`).
+		WithArgs("quiz2").
+		WillReturnRows(sqlmock.NewRows([]string{"questions_closed"}).AddRow(1))
+	mock.ExpectExec(`INSERT INTO leaderboard_snapshots`).
+		WithArgs("quiz2", 1, "q1", now).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	opensAt := now.Add(5 * time.Second)
+	mock.ExpectExec(`UPDATE quizzes SET schedule_status`).
+		WithArgs("quiz2", models.ScheduleStatusQuestionClosed, 0, &opensAt, models.QuizStatusStarted).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO outbox`).
+		WithArgs(models.OutboxEventQuizTransition, "quiz2", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	// quiz3 opens its timed second question until its time and the grace
+	// period are up
+	mock.ExpectQuery(`SELECT id, time_limit_seconds FROM questions`).
+		WithArgs("quiz3", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "time_limit_seconds"}).AddRow("q2", 10))
+	closesAt := now.Add(10*time.Second + 500*time.Millisecond)
+	mock.ExpectExec(`UPDATE quizzes SET schedule_status`).
+		WithArgs("quiz3", models.ScheduleStatusRunning, 1, &closesAt, models.QuizStatusStarted).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO outbox`).
+		WithArgs(models.OutboxEventQuizTransition, "quiz3", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(3, 1))
+	// quiz4 has run out of questions
+	mock.ExpectQuery(`SELECT id, time_limit_seconds FROM questions`).
+		WithArgs("quiz4", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "time_limit_seconds"}))
+	mock.ExpectExec(`UPDATE quizzes SET schedule_status`).
+		WithArgs("quiz4", models.ScheduleStatusFinished, 2, nil, models.QuizStatusFinished).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO outbox`).
+		WithArgs(models.OutboxEventQuizTransition, "quiz4", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(4, 1))
+	mock.ExpectCommit()
+
+	transitions, err := d.AdvanceSchedules(context.Background(), now, 100, 30*time.Second, 500*time.Millisecond, 5*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.QuizTransition{
+		{QuizID: "quiz1", Status: models.ScheduleStatusLobby, StartsAt: startsAt, At: now},
+		{QuizID: "quiz2", Status: models.ScheduleStatusQuestionClosed, StartsAt: startsAt, QuestionID: "q1", At: now},
+		{QuizID: "quiz3", Status: models.ScheduleStatusRunning, StartsAt: startsAt, QuestionID: "q2", At: now},
+		{QuizID: "quiz4", Status: models.ScheduleStatusFinished, StartsAt: startsAt, At: now},
+	}, transitions)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetQuizQuestions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db}
+
+	mock.ExpectQuery(`SELECT id, quiz_id, question_type.+FROM questions\s+WHERE quiz_id = \$1\s+ORDER BY position, id`).
+		WithArgs("quiz1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "quiz_id", "question_type", "question_text", "correct_answer",
+			"correct_answers", "tolerance", "partial_credit", "points", "time_limit_seconds"}).
+			AddRow("q2", "quiz1", "single_choice", "What cleans best?", "", "{}", 0.0, false, 1, 0).
+			AddRow("q1", "quiz1", "numeric", "How many?", "3", "{}", 0.5, false, 1, 10))
+	mock.ExpectQuery(`SELECT id, question_id, position, option_text, is_correct, correct_position\s+FROM question_options\s+WHERE question_id = ANY\(\$1\)`).
+		WithArgs(pq.StringArray{"q2", "q1"}).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "question_id", "position", "option_text", "is_correct", "correct_position"}).
+			AddRow("q2-1", "q2", 1, "Water", false, nil).
+			AddRow("q2-2", "q2", 2, "Soap", true, nil))
+
+	questions, err := d.GetQuizQuestions(context.Background(), "quiz1")
+	assert.NoError(t, err)
+	assert.Len(t, questions, 2)
+	assert.Equal(t, "q2", questions[0].ID)
+	assert.Len(t, questions[0].Options, 2)
+	assert.True(t, questions[0].Options[1].IsCorrect)
+	assert.Empty(t, questions[1].Options)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStreamQuizResults(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db}
+
+	mock.ExpectQuery(`WITH scores AS \(.+\)\s+SELECT RANK\(\) OVER \(ORDER BY score DESC\)`).
+		WithArgs("quiz1").
+		WillReturnRows(sqlmock.NewRows([]string{"rank", "user_id", "username", "score",
+			"correct_count", "avg_response_time_ms", "question_points"}).
+			AddRow(1, "user1", "alice", 3, 2, 1500, []byte(`{"q1": 1, "q2": 2}`)).
+			AddRow(2, "user2", "bob", 0, 0, nil, []byte(`{}`)).
+			AddRow(3, "user3", "carol", 0, 0, nil, []byte(`{}`)))
+
+	// Streaming stops at the first error
+	var rows []models.ResultRow
+	stop := errors.New("stop")
+	err = d.StreamQuizResults(context.Background(), "quiz1", func(row *models.ResultRow) error {
+		rows = append(rows, *row)
+		if len(rows) == 2 {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, 1500, *rows[0].AvgResponseTimeMs)
+	assert.Equal(t, map[string]int{"q1": 1, "q2": 2}, rows[0].QuestionPoints)
+	assert.Nil(t, rows[1].AvgResponseTimeMs)
+	assert.Empty(t, rows[1].QuestionPoints)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLeaderboardSnapshots(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db}
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE quizzes SET questions_closed = questions_closed \+ 1`).
+		WithArgs("quiz9").
+		WillReturnRows(sqlmock.NewRows([]string{"questions_closed"}))
+	mock.ExpectRollback()
+	assert.ErrorIs(t, d.SnapshotLeaderboard(context.Background(), "quiz9", "q1", now), apperrors.ErrQuizNotFound)
+
+	mock.ExpectQuery(`SELECT question_id, taken_at, COUNT\(\*\)\s+FROM leaderboard_snapshots`).
+		WithArgs("quiz1", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"question_id", "taken_at", "count"}).AddRow("q2", now, 3))
+	mock.ExpectQuery(`SELECT u.id, COALESCE\(NULLIF\(u.display_name, ''\), u.username\), ls.score, ls.rank\s+FROM leaderboard_snapshots ls`).
+		WithArgs("quiz1", 2, 2, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "score", "rank"}).
+			AddRow("user3", "carol", 1, 2))
+	mock.ExpectQuery(`SELECT question_id, taken_at, COUNT\(\*\)\s+FROM leaderboard_snapshots`).
+		WithArgs("quiz1", 3).
+		WillReturnRows(sqlmock.NewRows([]string{"question_id", "taken_at", "count"}))
+
+	snapshot, totalCount, err := d.GetLeaderboardSnapshot(context.Background(), "quiz1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, &models.LeaderboardSnapshot{QuizID: "quiz1", QuestionNumber: 2, QuestionID: "q2", TakenAt: now}, snapshot)
+	assert.Equal(t, 3, totalCount)
+	entries, err := d.GetSnapshotEntries(context.Background(), "quiz1", 2, 2, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.LeaderboardEntry{{UserID: "user3", Username: "carol", Score: 1, Rank: 2}}, entries)
+	_, _, err = d.GetLeaderboardSnapshot(context.Background(), "quiz1", 3)
+	assert.ErrorIs(t, err, apperrors.ErrSnapshotNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClaimOutbox(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db}
+
+	// Claimed events aren't necessarily returned in order
+	mock.ExpectQuery(`UPDATE outbox SET claimed_until = NOW\(\) \+ \$2 \* INTERVAL '1 millisecond'`).
+		WithArgs(100, int64(60000)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_type", "quiz_id", "payload", "created_at"}).
+			AddRow(8, models.OutboxEventAnswerRecorded, "quiz1", []byte(`{}`), time.Now()).
+			AddRow(7, models.OutboxEventQuizTransition, "quiz1", []byte(`{}`), time.Now()))
+
+	events, err := d.ClaimOutbox(context.Background(), 100, time.Minute)
+	if assert.NoError(t, err) && assert.Len(t, events, 2) {
+		assert.Equal(t, int64(7), events[0].ID)
+		assert.Equal(t, int64(8), events[1].ID)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestFlushScores(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db}
+
+	mock.ExpectQuery(`WITH flushed AS \(\s+UPDATE answers SET scored = TRUE`).
+		WithArgs(100).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+	flushed, err := d.FlushScores(context.Background(), 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, flushed)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetQuizScores(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT quiz_id, user_id, score\s+FROM quiz_scores`).
+		WithArgs("quiz1").
+		WillReturnRows(sqlmock.NewRows([]string{"quiz_id", "user_id", "score"}).
+			AddRow("quiz1", "user1", 3).
+			AddRow("quiz1", "user2", 1))
+	mock.ExpectQuery(`SELECT id, event_type, quiz_id, payload, created_at\s+FROM outbox`).
+		WithArgs("quiz1", models.OutboxEventAnswerRecorded).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_type", "quiz_id", "payload", "created_at"}).
+			AddRow(7, models.OutboxEventAnswerRecorded, "quiz1", []byte(`{"user_id":"user1","points":1}`), time.Time{}))
+	mock.ExpectCommit()
+
+	scores, pending, err := d.GetQuizScores(context.Background(), "quiz1")
+	assert.NoError(t, err)
+	assert.Equal(t, []models.UserScore{
+		{QuizID: "quiz1", UserID: "user1", Score: 3},
+		{QuizID: "quiz1", UserID: "user2", Score: 1},
+	}, scores)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, int64(7), pending[0].ID)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetUserAnswerHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db}
+	ctx := context.Background()
+	answeredAt := time.Now()
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM answers WHERE user_id = \$1`).
+		WithArgs("user1").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(`SELECT a\.id, a\.quiz_id, COALESCE\(z\.title, ''\), a\.question_id`).
+		WithArgs("user1", 2, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "quiz_id", "title", "question_id", "question_text", "user_id",
+			"answer", "is_correct", "points", "response_time_ms", "answered_at"}).
+			AddRow(1, "quiz1", "Cleaning", "q1", "What cleans best?", "user1", "{q1-2}", true, 1, 900, answeredAt))
+
+	history, totalCount, err := d.GetUserAnswerHistory(ctx, "user1", 2, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, totalCount)
+	assert.Len(t, history, 1)
+	assert.Equal(t, "Cleaning", history[0].QuizTitle)
+	assert.Equal(t, models.Answer{"q1-2"}, history[0].Answer)
+	assert.Equal(t, 900, *history[0].ResponseTimeMs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetTeamLeaderboard(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	d := &DB{DB: db}
+	ctx := context.Background()
+
+	mock.ExpectQuery(`WITH member_scores AS`).
+		WithArgs("quiz1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "count", "team_score"}).
+			AddRow("team1", "Red", 3, 12).
+			AddRow("team2", "Blue", 2, 7))
+
+	leaderboard, err := d.GetTeamLeaderboard(ctx, "quiz1")
+	assert.NoError(t, err)
+	assert.Equal(t, []models.TeamLeaderboardEntry{
+		{TeamID: "team1", Name: "Red", Members: 3, Score: 12},
+		{TeamID: "team2", Name: "Blue", Members: 2, Score: 7},
+	}, leaderboard)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	"realtime_leaderboard/internal/models"
+)
+
+// ClaimOutbox claims up to limit of the oldest unclaimed outbox events for
+// ttl and returns them in order. The claim commits on its own, so events
+// are handled outside any transaction, and concurrent callers claim
+// different events. Events not deleted by the time their claim runs out
+// are claimed again, so handlers must tolerate duplicates.
+func (db *DB) ClaimOutbox(ctx context.Context, limit int, ttl time.Duration) ([]models.OutboxEvent, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, `
+		UPDATE outbox SET claimed_until = NOW() + $2 * INTERVAL '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE claimed_until IS NULL OR claimed_until < NOW()
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, event_type, quiz_id, payload, created_at
+	`, limit, ttl.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.OutboxEvent
+	for rows.Next() {
+		var e models.OutboxEvent
+		if err := rows.Scan(&e.ID, &e.Type, &e.QuizID, &e.Payload, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+// DeleteOutboxEvents removes handled events from the outbox.
+func (db *DB) DeleteOutboxEvents(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	_, err := db.ExecContext(ctx, "DELETE FROM outbox WHERE id = ANY($1)", pq.Int64Array(ids))
+	return err
+}
+
+// ReleaseOutboxEvents gives up the claim on events that weren't handled,
+// so they can be claimed again straight away.
+func (db *DB) ReleaseOutboxEvents(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	_, err := db.ExecContext(ctx, "UPDATE outbox SET claimed_until = NULL WHERE id = ANY($1)", pq.Int64Array(ids))
+	return err
+}
@@ -0,0 +1,42 @@
+package database
+
+import "context"
+
+// AddParticipant registers the user as a participant of the quiz. It
+// reports whether the quiz and the user exist; nothing is written unless
+// both do. Registering twice is not an error.
+func (db *DB) AddParticipant(ctx context.Context, quizID, userID string) (bool, bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	var quizExists, userExists bool
+	err := db.QueryRowContext(ctx, `
+		WITH found AS (
+			SELECT EXISTS (SELECT 1 FROM quizzes WHERE id = $1) AS quiz_exists,
+			       EXISTS (SELECT 1 FROM users WHERE id = $2) AS user_exists
+		), inserted AS (
+			INSERT INTO quiz_participants (quiz_id, user_id)
+			SELECT $1, $2 FROM found WHERE quiz_exists AND user_exists
+			ON CONFLICT DO NOTHING
+		)
+		SELECT quiz_exists, user_exists FROM found
+	`, quizID, userID).Scan(&quizExists, &userExists)
+	return quizExists, userExists, err
+}
+
+func (db *DB) QuizExists(ctx context.Context, quizID string) (bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	var ok bool
+	err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM quizzes WHERE id = $1)", quizID).Scan(&ok)
+	return ok, err
+}
+
+func (db *DB) IsParticipant(ctx context.Context, quizID, userID string) (bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	var ok bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM quiz_participants WHERE quiz_id = $1 AND user_id = $2)
+	`, quizID, userID).Scan(&ok)
+	return ok, err
+}
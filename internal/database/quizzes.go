@@ -0,0 +1,184 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+
+	"github.com/lib/pq"
+)
+
+// CreateQuiz inserts the quiz with its questions and their options, filling
+// in the quiz's creation time. Questions are asked in the order given.
+func (db *DB) CreateQuiz(ctx context.Context, quiz *models.Quiz, questions []models.Question) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO quizzes (id, title, team_scoring, team_best_n)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at
+	`, quiz.ID, quiz.Title, quiz.TeamScoring, quiz.TeamBestN).Scan(&quiz.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	for i, q := range questions {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO questions (id, quiz_id, question_type, question_text, correct_answer,
+			                       correct_answers, tolerance, partial_credit, points, time_limit_seconds, position)
+			VALUES ($1, $2, $3, $4, NULLIF($5, ''), COALESCE($6::TEXT[], '{}'), $7, $8, $9, $10, $11)
+		`, q.ID, quiz.ID, q.Type, q.QuestionText, q.CorrectAnswer,
+			q.CorrectAnswers, q.Tolerance, q.PartialCredit, q.Points, q.TimeLimitSeconds, i)
+		if err != nil {
+			return err
+		}
+		for _, o := range q.Options {
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO question_options (id, question_id, position, option_text, is_correct, correct_position)
+				VALUES ($1, $2, $3, $4, $5, $6)
+			`, o.ID, q.ID, o.Position, o.Text, o.IsCorrect, o.CorrectPosition)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *DB) GetQuiz(ctx context.Context, quizID string) (*models.Quiz, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	quiz := &models.Quiz{}
+	err := db.QueryRowContext(ctx, `
+		SELECT id, COALESCE(title, ''), team_scoring, team_best_n, created_at FROM quizzes WHERE id = $1
+	`, quizID).Scan(&quiz.ID, &quiz.Title, &quiz.TeamScoring, &quiz.TeamBestN, &quiz.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, apperrors.ErrQuizNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return quiz, nil
+}
+
+// GetQuizStatus returns how far the quiz has got.
+func (db *DB) GetQuizStatus(ctx context.Context, quizID string) (models.QuizStatus, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	var status models.QuizStatus
+	err := db.QueryRowContext(ctx, "SELECT status FROM quizzes WHERE id = $1", quizID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", apperrors.ErrQuizNotFound
+	}
+	return status, err
+}
+
+// StartQuiz moves the quiz on from its lobby as a host opens a question.
+// Quizzes that have finished can't be played again.
+func (db *DB) StartQuiz(ctx context.Context, quizID string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	var id string
+	err := db.QueryRowContext(ctx, `
+		UPDATE quizzes SET status = $2
+		WHERE id = $1 AND status <> $3
+		RETURNING id
+	`, quizID, models.QuizStatusStarted, models.QuizStatusFinished).Scan(&id)
+	if err == sql.ErrNoRows {
+		exists, err := db.QuizExists(ctx, quizID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return apperrors.ErrQuizNotFound
+		}
+		return apperrors.ErrQuizFinished
+	}
+	return err
+}
+
+// FinishQuiz marks the quiz finished if questionID is its last question,
+// reporting whether it was.
+func (db *DB) FinishQuiz(ctx context.Context, quizID, questionID string) (bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	var id string
+	err := db.QueryRowContext(ctx, `
+		UPDATE quizzes SET status = $3
+		WHERE id = $1 AND NOT EXISTS (
+			SELECT 1 FROM questions q JOIN questions closed ON closed.id = $2
+			WHERE q.quiz_id = $1 AND (q.position, q.id) > (closed.position, closed.id)
+		)
+		RETURNING id
+	`, quizID, questionID, models.QuizStatusFinished).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetQuizQuestions returns the quiz's questions with their options, in the
+// order they are asked.
+func (db *DB) GetQuizQuestions(ctx context.Context, quizID string) ([]models.Question, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, quiz_id, question_type, question_text, COALESCE(correct_answer, ''),
+		       correct_answers, tolerance, partial_credit, points, time_limit_seconds
+		FROM questions
+		WHERE quiz_id = $1
+		ORDER BY position, id
+	`, quizID)
+	if err != nil {
+		return nil, err
+	}
+	var questions []models.Question
+	index := make(map[string]int)
+	for rows.Next() {
+		var q models.Question
+		err := rows.Scan(&q.ID, &q.QuizID, &q.Type, &q.QuestionText, &q.CorrectAnswer,
+			&q.CorrectAnswers, &q.Tolerance, &q.PartialCredit, &q.Points, &q.TimeLimitSeconds)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[q.ID] = len(questions)
+		questions = append(questions, q)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(questions) == 0 {
+		return questions, err
+	}
+
+	questionIDs := make([]string, len(questions))
+	for i, q := range questions {
+		questionIDs[i] = q.ID
+	}
+	rows, err = db.QueryContext(ctx, `
+		SELECT id, question_id, position, option_text, is_correct, correct_position
+		FROM question_options
+		WHERE question_id = ANY($1)
+		ORDER BY question_id, position
+	`, pq.StringArray(questionIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o models.QuestionOption
+		if err := rows.Scan(&o.ID, &o.QuestionID, &o.Position, &o.Text, &o.IsCorrect, &o.CorrectPosition); err != nil {
+			return nil, err
+		}
+		q := &questions[index[o.QuestionID]]
+		q.Options = append(q.Options, o)
+	}
+	return questions, rows.Err()
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+
+	"realtime_leaderboard/internal/models"
+)
+
+// StreamQuizResults calls fn with the standing of each of the quiz's
+// participants, best first, as the rows arrive, so that large quizzes are
+// never held in memory. Participants with the same score share a rank and
+// are ordered by their average response time. The query isn't bound by
+// Timeout, since it lasts as long as fn takes to pass the rows on; it stops
+// when ctx is done or fn returns an error.
+func (db *DB) StreamQuizResults(ctx context.Context, quizID string, fn func(*models.ResultRow) error) error {
+	rows, err := db.QueryContext(ctx, `
+		WITH scores AS (
+			SELECT user_id, score FROM quiz_scores WHERE quiz_id = $1
+		), standings AS (
+			SELECT p.user_id, COALESCE(NULLIF(u.display_name, ''), u.username) AS username, COALESCE(s.score, 0) AS score,
+			       COUNT(a.id) FILTER (WHERE a.is_correct) AS correct_count,
+			       ROUND(AVG(a.response_time_ms))::INTEGER AS avg_response_time_ms,
+			       COALESCE(jsonb_object_agg(a.question_id, a.points) FILTER (WHERE a.id IS NOT NULL), '{}') AS question_points
+			FROM quiz_participants p
+			JOIN users u ON u.id = p.user_id
+			LEFT JOIN scores s ON s.user_id = p.user_id
+			LEFT JOIN answers a ON a.quiz_id = p.quiz_id AND a.user_id = p.user_id
+			WHERE p.quiz_id = $1
+			GROUP BY p.user_id, u.display_name, u.username, s.score
+		)
+		SELECT RANK() OVER (ORDER BY score DESC), user_id, username, score,
+		       correct_count, avg_response_time_ms, question_points
+		FROM standings
+		ORDER BY score DESC, avg_response_time_ms NULLS LAST, username
+	`, quizID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row models.ResultRow
+		var questionPoints []byte
+		err := rows.Scan(&row.Rank, &row.UserID, &row.Username, &row.Score,
+			&row.CorrectCount, &row.AvgResponseTimeMs, &questionPoints)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(questionPoints, &row.QuestionPoints); err != nil {
+			return err
+		}
+		if err := fn(&row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
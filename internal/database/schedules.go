@@ -0,0 +1,209 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+// ScheduleQuiz sets when the quiz starts and when its lobby opens. Quizzes
+// can be rescheduled until they start, which closes an open lobby until the
+// new lobby time.
+func (db *DB) ScheduleQuiz(ctx context.Context, quizID string, startsAt, lobbyOpensAt time.Time) (*models.QuizSchedule, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	schedule := &models.QuizSchedule{QuizID: quizID}
+	err := db.QueryRowContext(ctx, `
+		UPDATE quizzes
+		SET starts_at = $2, schedule_status = $3, question_index = -1, next_transition_at = $4
+		WHERE id = $1 AND status = $6 AND (schedule_status IS NULL OR schedule_status IN ($3, $5))
+		RETURNING starts_at, schedule_status, next_transition_at
+	`, quizID, startsAt, models.ScheduleStatusScheduled, lobbyOpensAt, models.ScheduleStatusLobby, models.QuizStatusLobby).
+		Scan(&schedule.StartsAt, &schedule.Status, &schedule.NextTransitionAt)
+	if err == sql.ErrNoRows {
+		exists, err := db.QuizExists(ctx, quizID)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, apperrors.ErrQuizNotFound
+		}
+		return nil, apperrors.ErrQuizStarted
+	}
+	if err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// GetQuizSchedule returns the quiz's schedule, or nil when it is run by a
+// host.
+func (db *DB) GetQuizSchedule(ctx context.Context, quizID string) (*models.QuizSchedule, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	var startsAt sql.NullTime
+	var status sql.NullString
+	schedule := &models.QuizSchedule{QuizID: quizID}
+	err := db.QueryRowContext(ctx, `
+		SELECT starts_at, schedule_status, next_transition_at FROM quizzes WHERE id = $1
+	`, quizID).Scan(&startsAt, &status, &schedule.NextTransitionAt)
+	if err == sql.ErrNoRows {
+		return nil, apperrors.ErrQuizNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !status.Valid {
+		return nil, nil
+	}
+	schedule.StartsAt = startsAt.Time
+	schedule.Status = models.ScheduleStatus(status.String)
+	return schedule, nil
+}
+
+// quizStatuses is how far a scheduled quiz has got in each of the statuses
+// the scheduler moves it to.
+var quizStatuses = map[models.ScheduleStatus]models.QuizStatus{
+	models.ScheduleStatusLobby:          models.QuizStatusLobby,
+	models.ScheduleStatusRunning:        models.QuizStatusStarted,
+	models.ScheduleStatusQuestionClosed: models.QuizStatusStarted,
+	models.ScheduleStatusFinished:       models.QuizStatusFinished,
+}
+
+// dueQuiz is a scheduled quiz whose next transition is due.
+type dueQuiz struct {
+	id            string
+	status        models.ScheduleStatus
+	startsAt      time.Time
+	questionIndex int
+}
+
+// AdvanceSchedules moves on up to limit quizzes whose next transition is
+// due at now. Scheduled quizzes open their lobby, and quizzes in the lobby
+// or between questions open their next question, or finish when there are
+// no more. A question stays open for its time limit, or untimed when it has
+// none, plus grace, then closes and the leaderboard is snapshotted. The
+// next question opens gap later. Every
+// transition is written to the outbox with the quiz's update, and the
+// transitions made are returned. Due quizzes are locked while being moved
+// on, so concurrent callers work on different quizzes.
+func (db *DB) AdvanceSchedules(ctx context.Context, now time.Time, limit int, untimed, grace, gap time.Duration) ([]models.QuizTransition, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, schedule_status, starts_at, question_index
+		FROM quizzes
+		WHERE next_transition_at <= $1
+		ORDER BY next_transition_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	var due []dueQuiz
+	for rows.Next() {
+		var q dueQuiz
+		if err := rows.Scan(&q.id, &q.status, &q.startsAt, &q.questionIndex); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, q)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	transitions := make([]models.QuizTransition, 0, len(due))
+	for _, q := range due {
+		t := models.QuizTransition{QuizID: q.id, StartsAt: q.startsAt, At: now}
+		var next *time.Time
+		switch q.status {
+		case models.ScheduleStatusScheduled:
+			t.Status = models.ScheduleStatusLobby
+			next = &q.startsAt
+		case models.ScheduleStatusRunning:
+			t.Status = models.ScheduleStatusQuestionClosed
+			t.QuestionID, err = snapshotClosedQuestion(ctx, tx, q, now)
+			if err != nil {
+				return nil, err
+			}
+			opensAt := now.Add(gap)
+			next = &opensAt
+		default:
+			q.questionIndex++
+			var timeLimitSeconds int
+			err := tx.QueryRowContext(ctx, `
+				SELECT id, time_limit_seconds FROM questions
+				WHERE quiz_id = $1
+				ORDER BY position, id
+				OFFSET $2 LIMIT 1
+			`, q.id, q.questionIndex).Scan(&t.QuestionID, &timeLimitSeconds)
+			switch {
+			case err == sql.ErrNoRows:
+				t.Status = models.ScheduleStatusFinished
+			case err != nil:
+				return nil, err
+			default:
+				t.Status = models.ScheduleStatusRunning
+				open := untimed
+				if timeLimitSeconds > 0 {
+					open = time.Duration(timeLimitSeconds) * time.Second
+				}
+				closesAt := now.Add(open + grace)
+				next = &closesAt
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			UPDATE quizzes SET schedule_status = $2, question_index = $3, next_transition_at = $4, status = $5
+			WHERE id = $1
+		`, q.id, t.Status, q.questionIndex, next, quizStatuses[t.Status])
+		if err != nil {
+			return nil, err
+		}
+		payload, err := json.Marshal(t)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO outbox (event_type, quiz_id, payload)
+			VALUES ($1, $2, $3)
+		`, models.OutboxEventQuizTransition, q.id, payload)
+		if err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, t)
+	}
+	return transitions, tx.Commit()
+}
+
+// snapshotClosedQuestion snapshots the leaderboard as the running quiz's
+// open question closes, returning the question.
+func snapshotClosedQuestion(ctx context.Context, tx *sql.Tx, q dueQuiz, now time.Time) (string, error) {
+	var questionID string
+	err := tx.QueryRowContext(ctx, `
+		SELECT id FROM questions
+		WHERE quiz_id = $1
+		ORDER BY position, id
+		OFFSET $2 LIMIT 1
+	`, q.id, q.questionIndex).Scan(&questionID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return questionID, snapshotLeaderboard(ctx, tx, q.id, questionID, now)
+}
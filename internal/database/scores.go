@@ -0,0 +1,100 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"realtime_leaderboard/internal/models"
+)
+
+// FlushScores adds the points of up to limit unscored answers to
+// user_scores, with one upsert per user, and marks the answers scored in
+// the same statement. Concurrent callers flush different answers. It
+// returns how many answers were flushed.
+func (db *DB) FlushScores(ctx context.Context, limit int) (int, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	var flushed int
+	err := db.QueryRowContext(ctx, `
+		WITH flushed AS (
+			UPDATE answers SET scored = TRUE
+			WHERE id IN (
+				SELECT id FROM answers
+				WHERE NOT scored
+				ORDER BY id
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING quiz_id, user_id, points
+		), upserted AS (
+			INSERT INTO user_scores (quiz_id, user_id, score)
+			SELECT quiz_id, user_id, SUM(points)
+			FROM flushed
+			GROUP BY quiz_id, user_id
+			ORDER BY quiz_id, user_id
+			ON CONFLICT (quiz_id, user_id)
+			DO UPDATE SET score = user_scores.score + EXCLUDED.score
+		)
+		SELECT COUNT(*) FROM flushed
+	`, limit).Scan(&flushed)
+	return flushed, err
+}
+
+// GetQuizScores returns the current score of every user who has scored in
+// the quiz, including points that haven't been flushed yet, along with the
+// quiz's answers still in the outbox as of the same moment.
+func (db *DB) GetQuizScores(ctx context.Context, quizID string) ([]models.UserScore, []models.OutboxEvent, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT quiz_id, user_id, score
+		FROM quiz_scores
+		WHERE quiz_id = $1
+		ORDER BY user_id
+	`, quizID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var scores []models.UserScore
+	for rows.Next() {
+		var s models.UserScore
+		if err := rows.Scan(&s.QuizID, &s.UserID, &s.Score); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		scores = append(scores, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT id, event_type, quiz_id, payload, created_at
+		FROM outbox
+		WHERE quiz_id = $1 AND event_type = $2
+		ORDER BY id
+	`, quizID, models.OutboxEventAnswerRecorded)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var pending []models.OutboxEvent
+	for rows.Next() {
+		var e models.OutboxEvent
+		if err := rows.Scan(&e.ID, &e.Type, &e.QuizID, &e.Payload, &e.CreatedAt); err != nil {
+			return nil, nil, err
+		}
+		pending = append(pending, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return scores, pending, tx.Commit()
+}
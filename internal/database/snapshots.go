@@ -0,0 +1,108 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+// SnapshotLeaderboard records the standings of the quiz's participants as
+// the question closes at, numbered after the quiz's earlier snapshots.
+func (db *DB) SnapshotLeaderboard(ctx context.Context, quizID, questionID string, at time.Time) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := snapshotLeaderboard(ctx, tx, quizID, questionID, at); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// snapshotLeaderboard takes the snapshot within q's transaction. Counting
+// the snapshot locks the quiz, so that snapshots of concurrently closed
+// questions get different numbers. Scores include the points still waiting
+// to be flushed.
+func snapshotLeaderboard(ctx context.Context, q querier, quizID, questionID string, at time.Time) error {
+	var questionNumber int
+	err := q.QueryRowContext(ctx, `
+		UPDATE quizzes SET questions_closed = questions_closed + 1
+		WHERE id = $1
+		RETURNING questions_closed
+	`, quizID).Scan(&questionNumber)
+	if err == sql.ErrNoRows {
+		return apperrors.ErrQuizNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, `
+		INSERT INTO leaderboard_snapshots (quiz_id, question_number, question_id, user_id, score, rank, taken_at)
+		SELECT p.quiz_id, $2, $3, p.user_id, COALESCE(s.score, 0),
+		       RANK() OVER (ORDER BY COALESCE(s.score, 0) DESC), $4
+		FROM quiz_participants p
+		LEFT JOIN quiz_scores s ON s.quiz_id = p.quiz_id AND s.user_id = p.user_id
+		WHERE p.quiz_id = $1
+	`, quizID, questionNumber, questionID, at)
+	return err
+}
+
+// GetLeaderboardSnapshot describes the quiz's questionNumber'th snapshot
+// and returns how many participants it ranks. Snapshots that don't exist,
+// or ranked nobody, return ErrSnapshotNotFound.
+func (db *DB) GetLeaderboardSnapshot(ctx context.Context, quizID string, questionNumber int) (*models.LeaderboardSnapshot, int, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	snapshot := &models.LeaderboardSnapshot{QuizID: quizID, QuestionNumber: questionNumber}
+	var totalCount int
+	err := db.QueryRowContext(ctx, `
+		SELECT question_id, taken_at, COUNT(*)
+		FROM leaderboard_snapshots
+		WHERE quiz_id = $1 AND question_number = $2
+		GROUP BY question_id, taken_at
+	`, quizID, questionNumber).Scan(&snapshot.QuestionID, &snapshot.TakenAt, &totalCount)
+	if err == sql.ErrNoRows {
+		return nil, 0, apperrors.ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return snapshot, totalCount, nil
+}
+
+// GetSnapshotEntries returns a page of the standings in the quiz's
+// questionNumber'th snapshot, with their ranks.
+func (db *DB) GetSnapshotEntries(ctx context.Context, quizID string, questionNumber, page, pageSize int) ([]models.LeaderboardEntry, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, COALESCE(NULLIF(u.display_name, ''), u.username), ls.score, ls.rank
+		FROM leaderboard_snapshots ls
+		JOIN users u ON ls.user_id = u.id
+		WHERE ls.quiz_id = $1 AND ls.question_number = $2
+		ORDER BY ls.rank, u.id
+		LIMIT $3 OFFSET $4
+	`, quizID, questionNumber, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var leaderboard []models.LeaderboardEntry
+	for rows.Next() {
+		var e models.LeaderboardEntry
+		if err := rows.Scan(&e.UserID, &e.Username, &e.Score, &e.Rank); err != nil {
+			return nil, err
+		}
+		leaderboard = append(leaderboard, e)
+	}
+	return leaderboard, rows.Err()
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+const userColumns = "id, username, display_name, avatar_url, is_guest, created_at"
+
+func scanUser(row *sql.Row) (*models.User, error) {
+	u := &models.User{}
+	err := row.Scan(&u.ID, &u.Username, &u.DisplayName, &u.AvatarURL, &u.Guest, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, apperrors.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// CreateUser inserts the user and fills in its creation time. Usernames
+// already in use give ErrUsernameTaken.
+func (db *DB) CreateUser(ctx context.Context, u *models.User) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return createUser(ctx, db, u)
+}
+
+func createUser(ctx context.Context, q querier, u *models.User) error {
+	err := q.QueryRowContext(ctx, `
+		INSERT INTO users (id, username, display_name, avatar_url, is_guest)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at
+	`, u.ID, u.Username, u.DisplayName, u.AvatarURL, u.Guest).Scan(&u.CreatedAt)
+	if isUniqueViolation(err) {
+		return apperrors.ErrUsernameTaken
+	}
+	return err
+}
+
+func (db *DB) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return scanUser(db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1", userID))
+}
+
+// UpdateUser sets the user's display name and avatar URL, leaving those
+// that are nil unchanged, and returns the updated user.
+func (db *DB) UpdateUser(ctx context.Context, userID string, displayName, avatarURL *string) (*models.User, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return scanUser(db.QueryRowContext(ctx, `
+		UPDATE users
+		SET display_name = COALESCE($2, display_name),
+		    avatar_url = COALESCE($3, avatar_url)
+		WHERE id = $1
+		RETURNING `+userColumns,
+		userID, displayName, avatarURL))
+}
+
+// CreateGuest inserts the guest user and registers them as a participant
+// of the quiz, reporting false without creating anything when the quiz
+// doesn't exist.
+func (db *DB) CreateGuest(ctx context.Context, u *models.User, quizID string) (bool, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var quizExists bool
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM quizzes WHERE id = $1)", quizID).Scan(&quizExists)
+	if err != nil || !quizExists {
+		return false, err
+	}
+	if err := createUser(ctx, tx, u); err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO quiz_participants (quiz_id, user_id)
+		VALUES ($1, $2)
+	`, quizID, u.ID)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
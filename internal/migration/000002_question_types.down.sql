@@ -0,0 +1,8 @@
+ALTER TABLE questions DROP CONSTRAINT IF EXISTS questions_question_type_check;
+
+ALTER TABLE questions
+    DROP COLUMN IF EXISTS points,
+    DROP COLUMN IF EXISTS partial_credit,
+    DROP COLUMN IF EXISTS tolerance,
+    DROP COLUMN IF EXISTS correct_answers,
+    DROP COLUMN IF EXISTS question_type;
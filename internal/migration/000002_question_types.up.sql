@@ -0,0 +1,11 @@
+ALTER TABLE questions
+    ADD COLUMN IF NOT EXISTS question_type VARCHAR(20) NOT NULL DEFAULT 'single_choice',
+    ADD COLUMN IF NOT EXISTS correct_answers TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS tolerance DOUBLE PRECISION NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS partial_credit BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS points INTEGER NOT NULL DEFAULT 1;
+
+ALTER TABLE questions
+    ADD CONSTRAINT questions_question_type_check CHECK (
+        question_type IN ('single_choice', 'multiple_select', 'true_false', 'numeric', 'free_text', 'ordering')
+    );
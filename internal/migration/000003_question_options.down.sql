@@ -0,0 +1,19 @@
+ALTER TABLE questions ADD COLUMN IF NOT EXISTS options TEXT[];
+
+UPDATE questions q
+SET options         = o.options,
+    correct_answer  = CASE WHEN q.question_type = 'single_choice' THEN o.correct[1] ELSE q.correct_answer END,
+    correct_answers = CASE q.question_type
+                          WHEN 'multiple_select' THEN o.correct
+                          WHEN 'ordering' THEN o.ordered
+                          ELSE q.correct_answers
+                      END
+FROM (SELECT question_id,
+             array_agg(option_text ORDER BY position)                              AS options,
+             array_remove(array_agg(CASE WHEN is_correct THEN option_text END ORDER BY position), NULL) AS correct,
+             array_agg(option_text ORDER BY correct_position)                      AS ordered
+      FROM question_options
+      GROUP BY question_id) o
+WHERE o.question_id = q.id;
+
+DROP TABLE IF EXISTS question_options;
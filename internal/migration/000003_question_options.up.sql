@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS question_options (
+                                id VARCHAR(50) PRIMARY KEY,
+                                question_id VARCHAR(50) NOT NULL REFERENCES questions(id) ON DELETE CASCADE,
+                                position INTEGER NOT NULL,
+                                option_text TEXT NOT NULL,
+                                is_correct BOOLEAN NOT NULL DEFAULT FALSE,
+                                correct_position INTEGER,
+                                UNIQUE (question_id, position)
+);
+
+-- Move the inline option text into records. Existing options get stable IDs
+-- derived from the question ID and their 1-based position.
+INSERT INTO question_options (id, question_id, position, option_text, is_correct, correct_position)
+SELECT q.id || '-' || o.position,
+       q.id,
+       o.position,
+       o.option_text,
+       CASE q.question_type
+           WHEN 'multiple_select' THEN o.option_text = ANY (q.correct_answers)
+           WHEN 'ordering' THEN FALSE
+           ELSE o.option_text = q.correct_answer
+       END,
+       CASE q.question_type
+           WHEN 'ordering' THEN array_position(q.correct_answers, o.option_text)
+       END
+FROM questions q
+         CROSS JOIN LATERAL unnest(q.options) WITH ORDINALITY AS o(option_text, position)
+WHERE q.question_type IN ('single_choice', 'multiple_select', 'ordering')
+ON CONFLICT (id) DO NOTHING;
+
+-- Choice questions are now graded from their option records.
+UPDATE questions
+SET correct_answer  = NULL,
+    correct_answers = '{}'
+WHERE question_type IN ('single_choice', 'multiple_select', 'ordering');
+
+ALTER TABLE questions DROP COLUMN IF EXISTS options;
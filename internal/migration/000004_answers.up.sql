@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS answers (
+                         id BIGSERIAL PRIMARY KEY,
+                         quiz_id VARCHAR(50) NOT NULL REFERENCES quizzes(id),
+                         question_id VARCHAR(50) NOT NULL REFERENCES questions(id),
+                         user_id VARCHAR(50) NOT NULL REFERENCES users(id),
+                         answer TEXT[] NOT NULL DEFAULT '{}',
+                         is_correct BOOLEAN NOT NULL DEFAULT FALSE,
+                         points INTEGER NOT NULL DEFAULT 0,
+                         response_time_ms INTEGER,
+                         answered_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS answers_quiz_id_user_id_idx ON answers (quiz_id, user_id);
+CREATE INDEX IF NOT EXISTS answers_user_id_answered_at_idx ON answers (user_id, answered_at DESC);
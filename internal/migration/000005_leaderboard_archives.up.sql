@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS leaderboard_archives (
+                                      period VARCHAR(10) NOT NULL,
+                                      bucket VARCHAR(20) NOT NULL,
+                                      user_id VARCHAR(50) NOT NULL REFERENCES users(id),
+                                      score INTEGER NOT NULL,
+                                      rank INTEGER NOT NULL,
+                                      archived_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                                      PRIMARY KEY (period, bucket, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS leaderboard_archives_rank_idx ON leaderboard_archives (period, bucket, rank);
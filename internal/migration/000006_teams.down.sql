@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS team_members;
+DROP TABLE IF EXISTS teams;
+
+ALTER TABLE quizzes DROP CONSTRAINT IF EXISTS quizzes_team_scoring_check;
+
+ALTER TABLE quizzes
+    DROP COLUMN IF EXISTS team_best_n,
+    DROP COLUMN IF EXISTS team_scoring;
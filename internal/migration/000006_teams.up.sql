@@ -0,0 +1,25 @@
+ALTER TABLE quizzes
+    ADD COLUMN IF NOT EXISTS team_scoring VARCHAR(10) NOT NULL DEFAULT 'sum',
+    ADD COLUMN IF NOT EXISTS team_best_n INTEGER NOT NULL DEFAULT 3;
+
+ALTER TABLE quizzes
+    ADD CONSTRAINT quizzes_team_scoring_check CHECK (team_scoring IN ('sum', 'average', 'best_n'));
+
+CREATE TABLE IF NOT EXISTS teams (
+                       id VARCHAR(50) PRIMARY KEY,
+                       quiz_id VARCHAR(50) NOT NULL REFERENCES quizzes(id),
+                       name VARCHAR(100) NOT NULL,
+                       created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                       UNIQUE (quiz_id, name)
+);
+
+-- A user belongs to at most one team per quiz.
+CREATE TABLE IF NOT EXISTS team_members (
+                              quiz_id VARCHAR(50) NOT NULL REFERENCES quizzes(id),
+                              user_id VARCHAR(50) NOT NULL REFERENCES users(id),
+                              team_id VARCHAR(50) NOT NULL REFERENCES teams(id) ON DELETE CASCADE,
+                              joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+                              PRIMARY KEY (quiz_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS team_members_team_id_idx ON team_members (team_id);
@@ -0,0 +1 @@
+ALTER TABLE questions DROP COLUMN IF EXISTS time_limit_seconds;
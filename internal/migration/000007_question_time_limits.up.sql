@@ -0,0 +1,2 @@
+-- 0 leaves the question open until the next one is opened.
+ALTER TABLE questions ADD COLUMN IF NOT EXISTS time_limit_seconds INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,9 @@
+-- Side effects of committed writes, such as cache updates and broadcasts,
+-- waiting to be carried out. Rows are deleted once handled.
+CREATE TABLE IF NOT EXISTS outbox (
+                        id BIGSERIAL PRIMARY KEY,
+                        event_type VARCHAR(50) NOT NULL,
+                        quiz_id VARCHAR(50) NOT NULL,
+                        payload JSONB NOT NULL,
+                        created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
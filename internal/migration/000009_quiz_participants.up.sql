@@ -0,0 +1,12 @@
+-- Users registered to play a quiz. Only participants may answer.
+CREATE TABLE IF NOT EXISTS quiz_participants (
+                                   quiz_id VARCHAR(50) NOT NULL REFERENCES quizzes(id),
+                                   user_id VARCHAR(50) NOT NULL REFERENCES users(id),
+                                   joined_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+                                   PRIMARY KEY (quiz_id, user_id)
+);
+
+-- Everyone who has already scored in a quiz took part in it.
+INSERT INTO quiz_participants (quiz_id, user_id)
+SELECT quiz_id, user_id FROM user_scores
+ON CONFLICT DO NOTHING;
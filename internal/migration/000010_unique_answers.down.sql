@@ -0,0 +1 @@
+DROP INDEX IF EXISTS answers_quiz_id_question_id_user_id_key;
@@ -0,0 +1,23 @@
+-- Each user answers a question once. Repeat answers recorded before this
+-- constraint existed are dropped, keeping the first, and the points they
+-- added are taken back off the users' scores.
+WITH repeats AS (
+    DELETE FROM answers a
+        USING answers b
+    WHERE a.quiz_id = b.quiz_id
+      AND a.question_id = b.question_id
+      AND a.user_id = b.user_id
+      AND a.id > b.id
+    RETURNING a.quiz_id, a.user_id, a.points
+), repeat_points AS (
+    SELECT quiz_id, user_id, SUM(points) AS points
+    FROM repeats
+    GROUP BY quiz_id, user_id
+)
+UPDATE user_scores us
+SET score = us.score - rp.points
+FROM repeat_points rp
+WHERE us.quiz_id = rp.quiz_id
+  AND us.user_id = rp.user_id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS answers_quiz_id_question_id_user_id_key ON answers (quiz_id, question_id, user_id);
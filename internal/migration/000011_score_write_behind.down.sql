@@ -0,0 +1,14 @@
+DROP VIEW IF EXISTS quiz_scores;
+DROP INDEX IF EXISTS answers_unscored_idx;
+
+-- Add the points that haven't been flushed yet before forgetting which
+-- answers they belong to.
+INSERT INTO user_scores (quiz_id, user_id, score)
+SELECT quiz_id, user_id, SUM(points)
+FROM answers
+WHERE NOT scored
+GROUP BY quiz_id, user_id
+ON CONFLICT (quiz_id, user_id)
+DO UPDATE SET score = user_scores.score + EXCLUDED.score;
+
+ALTER TABLE answers DROP COLUMN IF EXISTS scored;
@@ -0,0 +1,16 @@
+-- Answers are added to user_scores in batches, so each answer records
+-- whether its points have been added yet. Existing answers already have.
+ALTER TABLE answers ADD COLUMN IF NOT EXISTS scored BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE answers ALTER COLUMN scored SET DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS answers_unscored_idx ON answers (quiz_id, user_id) WHERE NOT scored;
+
+-- quiz_scores is user_scores plus the points still waiting to be added.
+CREATE OR REPLACE VIEW quiz_scores AS
+SELECT quiz_id, user_id, SUM(score)::INTEGER AS score
+FROM (
+    SELECT quiz_id, user_id, score FROM user_scores
+    UNION ALL
+    SELECT quiz_id, user_id, points FROM answers WHERE NOT scored
+) s
+GROUP BY quiz_id, user_id;
@@ -0,0 +1,5 @@
+ALTER TABLE users
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS is_guest,
+    DROP COLUMN IF EXISTS avatar_url,
+    DROP COLUMN IF EXISTS display_name;
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS quizzes_next_transition_idx;
+
+ALTER TABLE quizzes
+    DROP COLUMN IF EXISTS next_transition_at,
+    DROP COLUMN IF EXISTS question_index,
+    DROP COLUMN IF EXISTS schedule_status,
+    DROP COLUMN IF EXISTS starts_at;
+
+ALTER TABLE questions DROP COLUMN IF EXISTS position;
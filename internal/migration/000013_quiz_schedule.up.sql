@@ -0,0 +1,15 @@
+-- The order questions are asked in when a scheduled quiz runs itself.
+ALTER TABLE questions ADD COLUMN IF NOT EXISTS position INTEGER NOT NULL DEFAULT 0;
+
+-- Scheduled quizzes open their lobby ahead of starts_at and then advance
+-- through their questions without a host. schedule_status is NULL for
+-- quizzes run by a host, and next_transition_at is when the scheduler next
+-- moves the quiz on.
+ALTER TABLE quizzes
+    ADD COLUMN IF NOT EXISTS starts_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS schedule_status VARCHAR(20),
+    ADD COLUMN IF NOT EXISTS question_index INTEGER NOT NULL DEFAULT -1,
+    ADD COLUMN IF NOT EXISTS next_transition_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS quizzes_next_transition_idx ON quizzes (next_transition_at)
+    WHERE next_transition_at IS NOT NULL;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS leaderboard_snapshots;
+
+ALTER TABLE quizzes DROP COLUMN IF EXISTS questions_closed;
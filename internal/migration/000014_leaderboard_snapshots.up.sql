@@ -0,0 +1,17 @@
+-- A quiz's standings each time one of its questions closes. Snapshots are
+-- numbered in the order the questions closed, and questions_closed counts
+-- the quiz's snapshots so far.
+ALTER TABLE quizzes ADD COLUMN IF NOT EXISTS questions_closed INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS leaderboard_snapshots (
+    quiz_id VARCHAR(50) NOT NULL REFERENCES quizzes(id),
+    question_number INTEGER NOT NULL,
+    question_id VARCHAR(50) NOT NULL REFERENCES questions(id),
+    user_id VARCHAR(50) NOT NULL REFERENCES users(id),
+    score INTEGER NOT NULL,
+    rank INTEGER NOT NULL,
+    taken_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (quiz_id, question_number, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS leaderboard_snapshots_rank_idx ON leaderboard_snapshots (quiz_id, question_number, rank);
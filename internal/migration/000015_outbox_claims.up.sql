@@ -0,0 +1,5 @@
+-- Outbox events are claimed for a while and handled outside the transaction
+-- that claimed them. Events still here when their claim runs out, because
+-- handling them failed or the server handling them stopped, are claimed
+-- again.
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMPTZ;
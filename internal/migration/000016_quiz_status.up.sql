@@ -0,0 +1,14 @@
+-- How far a quiz has got, whether a host or the scheduler runs it: lobby
+-- until its first question opens, started, and finished once its last
+-- question closes.
+ALTER TABLE quizzes ADD COLUMN IF NOT EXISTS status VARCHAR(20) NOT NULL DEFAULT 'lobby';
+
+-- Scheduled quizzes say how far they have got. Quizzes run by a host that
+-- have been answered can't be told apart from ones still being played, so
+-- they count as finished.
+UPDATE quizzes SET status = CASE
+    WHEN schedule_status = 'running' THEN 'started'
+    WHEN schedule_status = 'finished' THEN 'finished'
+    WHEN schedule_status IS NULL AND EXISTS (SELECT 1 FROM answers a WHERE a.quiz_id = quizzes.id) THEN 'finished'
+    ELSE 'lobby'
+END;
@@ -2,40 +2,110 @@ package models
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/lib/pq"
 )
 
 type Quiz struct {
-	ID        string    `json:"id"`
-	Title     string    `json:"title"`
-	CreatedAt time.Time `json:"created_at"`
+	ID          string      `json:"id"`
+	Title       string      `json:"title"`
+	TeamScoring TeamScoring `json:"team_scoring"`
+	TeamBestN   int         `json:"team_best_n"`
+	CreatedAt   time.Time   `json:"created_at"`
 }
 
+// QuizStatus is how far a quiz has got, whether a host or the scheduler
+// runs it. Quizzes are in the lobby until their first question opens, and
+// finish once their last question closes.
+type QuizStatus string
+
+const (
+	QuizStatusLobby    QuizStatus = "lobby"
+	QuizStatusStarted  QuizStatus = "started"
+	QuizStatusFinished QuizStatus = "finished"
+)
+
+// ScheduleStatus is where a scheduled quiz is in its run. Quizzes run by a
+// host have none.
+type ScheduleStatus string
+
+const (
+	ScheduleStatusScheduled      ScheduleStatus = "scheduled"
+	ScheduleStatusLobby          ScheduleStatus = "lobby"
+	ScheduleStatusRunning        ScheduleStatus = "running"
+	ScheduleStatusQuestionClosed ScheduleStatus = "question_closed"
+	ScheduleStatusFinished       ScheduleStatus = "finished"
+)
+
+// QuizSchedule is when a scheduled quiz starts and how far it has got.
+type QuizSchedule struct {
+	QuizID   string         `json:"quiz_id"`
+	StartsAt time.Time      `json:"starts_at"`
+	Status   ScheduleStatus `json:"status"`
+	// NextTransitionAt is when the scheduler next moves the quiz on, unset
+	// once it has finished.
+	NextTransitionAt *time.Time `json:"next_transition_at,omitempty"`
+}
+
+// TeamScoring selects how member scores are combined into a team score.
+type TeamScoring string
+
+const (
+	TeamScoringSum     TeamScoring = "sum"
+	TeamScoringAverage TeamScoring = "average"
+	// TeamScoringBestN sums the scores of the quiz's TeamBestN highest
+	// scoring members.
+	TeamScoringBestN TeamScoring = "best_n"
+)
+
+// QuestionType selects the validator used to grade answers to a question.
+type QuestionType string
+
+const (
+	QuestionTypeSingleChoice   QuestionType = "single_choice"
+	QuestionTypeMultipleSelect QuestionType = "multiple_select"
+	QuestionTypeTrueFalse      QuestionType = "true_false"
+	QuestionTypeNumeric        QuestionType = "numeric"
+	QuestionTypeFreeText       QuestionType = "free_text"
+	QuestionTypeOrdering       QuestionType = "ordering"
+)
+
 type Question struct {
-	ID            string         `json:"id"`
-	QuizID        string         `json:"quiz_id"`
-	QuestionText  string         `json:"question_text"`
-	Options       pq.StringArray `json:"options" db:"options"`
-	CorrectAnswer string         `json:"correct_answer"`
+	ID            string           `json:"id"`
+	QuizID        string           `json:"quiz_id"`
+	Type          QuestionType     `json:"type"`
+	QuestionText  string           `json:"question_text"`
+	Options       []QuestionOption `json:"options"`
+	CorrectAnswer string           `json:"correct_answer"`
+	// CorrectAnswers holds the accepted alternatives for free-text
+	// questions. Choice questions are graded from their options instead.
+	CorrectAnswers pq.StringArray `json:"correct_answers" db:"correct_answers"`
+	Tolerance      float64        `json:"tolerance"`
+	PartialCredit  bool           `json:"partial_credit"`
+	Points         int            `json:"points"`
+	// TimeLimitSeconds is how long the question accepts answers once
+	// opened. 0 means it stays open until the next question.
+	TimeLimitSeconds int `json:"time_limit_seconds"`
 }
 
 func (q *Question) MarshalJSON() ([]byte, error) {
 	type Alias Question
 	return json.Marshal(&struct {
-		Options []string `json:"options"`
+		CorrectAnswers []string `json:"correct_answers"`
 		*Alias
 	}{
-		Options: []string(q.Options),
-		Alias:   (*Alias)(q),
+		CorrectAnswers: []string(q.CorrectAnswers),
+		Alias:          (*Alias)(q),
 	})
 }
 
 func (q *Question) UnmarshalJSON(data []byte) error {
 	type Alias Question
 	aux := &struct {
-		Options []string `json:"options"`
+		CorrectAnswers []string `json:"correct_answers"`
 		*Alias
 	}{
 		Alias: (*Alias)(q),
@@ -43,13 +113,97 @@ func (q *Question) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &aux); err != nil {
 		return err
 	}
-	q.Options = pq.StringArray(aux.Options)
+	q.CorrectAnswers = pq.StringArray(aux.CorrectAnswers)
+	return nil
+}
+
+// View returns the question as shown to players, without the answer.
+func (q *Question) View() QuestionView {
+	options := make([]OptionView, len(q.Options))
+	for i, o := range q.Options {
+		options[i] = OptionView{ID: o.ID, Text: o.Text}
+	}
+	return QuestionView{
+		ID:               q.ID,
+		QuizID:           q.QuizID,
+		Type:             q.Type,
+		QuestionText:     q.QuestionText,
+		Options:          options,
+		Points:           q.Points,
+		TimeLimitSeconds: q.TimeLimitSeconds,
+	}
+}
+
+type QuestionView struct {
+	ID               string       `json:"id"`
+	QuizID           string       `json:"quiz_id"`
+	Type             QuestionType `json:"type"`
+	QuestionText     string       `json:"question_text"`
+	Options          []OptionView `json:"options"`
+	Points           int          `json:"points"`
+	TimeLimitSeconds int          `json:"time_limit_seconds"`
+}
+
+type OptionView struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// QuestionOption is one selectable option of a choice question. Clients
+// answer with option IDs so that the wording can change without affecting
+// grading.
+type QuestionOption struct {
+	ID         string `json:"id"`
+	QuestionID string `json:"question_id"`
+	Position   int    `json:"position"`
+	Text       string `json:"text"`
+	IsCorrect  bool   `json:"is_correct"`
+	// CorrectPosition is the option's place in the correct sequence of an
+	// ordering question.
+	CorrectPosition *int `json:"correct_position,omitempty"`
+}
+
+// Answer is a submitted answer. Choice questions send option IDs, as a
+// plain string for single choice or an array for multiple select and
+// ordering; other types send a JSON string, number or boolean.
+type Answer []string
+
+func (a *Answer) UnmarshalJSON(data []byte) error {
+	var values []json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		values = []json.RawMessage{data}
+	}
+	answer := make(Answer, 0, len(values))
+	for _, raw := range values {
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return err
+		}
+		switch v := v.(type) {
+		case string:
+			answer = append(answer, v)
+		case float64:
+			answer = append(answer, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			answer = append(answer, strconv.FormatBool(v))
+		case nil:
+		default:
+			return fmt.Errorf("unsupported answer value %s", raw)
+		}
+	}
+	*a = answer
 	return nil
 }
 
 type User struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
+	ID          string `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+	// Guest users were created for a player who joined a quiz with just
+	// a nickname.
+	Guest     bool      `json:"guest"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type UserScore struct {
@@ -58,8 +212,93 @@ type UserScore struct {
 	Score  int    `json:"score"`
 }
 
+// AnswerRecord is a single graded answer submitted by a user.
+type AnswerRecord struct {
+	ID           int64  `json:"id"`
+	QuizID       string `json:"quiz_id"`
+	QuizTitle    string `json:"quiz_title,omitempty"`
+	QuestionID   string `json:"question_id"`
+	QuestionText string `json:"question_text,omitempty"`
+	UserID       string `json:"user_id"`
+	Answer       Answer `json:"answer"`
+	Correct      bool   `json:"correct"`
+	Points       int    `json:"points"`
+	// ResponseTimeMs is measured from when the question was opened and is
+	// nil when the question was answered without being opened.
+	ResponseTimeMs *int      `json:"response_time_ms"`
+	AnsweredAt     time.Time `json:"answered_at"`
+}
+
+// OutboxEventAnswerRecorded is the outbox event of a committed answer. Its
+// payload is the AnswerRecord.
+const OutboxEventAnswerRecorded = "answer_recorded"
+
+// OutboxEventQuizTransition is the outbox event of the scheduler moving a
+// quiz on. Its payload is the QuizTransition.
+const OutboxEventQuizTransition = "quiz_transition"
+
+// QuizTransition is a scheduled quiz opening its lobby, moving on to its
+// next question or finishing.
+type QuizTransition struct {
+	QuizID   string         `json:"quiz_id"`
+	Status   ScheduleStatus `json:"status"`
+	StartsAt time.Time      `json:"starts_at"`
+	// QuestionID is the question opened by a transition to running, or
+	// closed by a transition to question_closed.
+	QuestionID string    `json:"question_id,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+// OutboxEvent is a side effect of a committed write that is still to be
+// carried out.
+type OutboxEvent struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	QuizID    string          `json:"quiz_id"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// ResultRow is a participant's standing in a quiz, with how they did on
+// each question.
+type ResultRow struct {
+	Rank              int
+	UserID            string
+	Username          string
+	Score             int
+	CorrectCount      int
+	AvgResponseTimeMs *int
+	// QuestionPoints holds the points scored on each question answered,
+	// by question ID.
+	QuestionPoints map[string]int
+}
+
 type LeaderboardEntry struct {
 	UserID   string `json:"user_id"`
 	Username string `json:"username"`
 	Score    int    `json:"score"`
+	// Rank is only set where ties share a rank, as in snapshots.
+	Rank int `json:"rank,omitempty"`
+}
+
+// LeaderboardSnapshot describes the standings recorded when a quiz's
+// QuestionNumber'th question to close did so.
+type LeaderboardSnapshot struct {
+	QuizID         string    `json:"quiz_id"`
+	QuestionNumber int       `json:"question_number"`
+	QuestionID     string    `json:"question_id"`
+	TakenAt        time.Time `json:"taken_at"`
+}
+
+type Team struct {
+	ID     string `json:"id"`
+	QuizID string `json:"quiz_id"`
+	Name   string `json:"name"`
+}
+
+type TeamLeaderboardEntry struct {
+	TeamID  string `json:"team_id"`
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+	Score   int    `json:"score"`
 }
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Limit configures a token bucket: Burst tokens at most, refilled at Rate
+// tokens per second. A zero Rate disables limiting.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+type Result struct {
+	Allowed    bool
+	RetryAfter time.Duration
+}
+
+// tokenBucket takes ARGV[3] tokens, one or none, from the bucket in KEYS[1]
+// if a token is available. It uses the Redis clock so that every server
+// instance shares the same view of time.
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated_at")
+local tokens = tonumber(bucket[1]) or burst
+local updated_at = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + (now - updated_at) / 1000 * rate)
+
+local allowed = 0
+local retry_after = 0
+if tokens >= 1 then
+	tokens = tokens - cost
+	allowed = 1
+else
+	retry_after = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "updated_at", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000))
+return {allowed, retry_after}
+`)
+
+// Limiter is a token bucket rate limiter whose buckets live in Redis, so
+// limits hold across server instances.
+type Limiter struct {
+	redis  *redis.Client
+	prefix string
+	limit  Limit
+}
+
+func NewLimiter(client *redis.Client, prefix string, limit Limit) *Limiter {
+	return &Limiter{redis: client, prefix: prefix, limit: limit}
+}
+
+// Allow takes a token from the bucket identified by key.
+func (l *Limiter) Allow(ctx context.Context, key string) (Result, error) {
+	return l.take(ctx, key, 1)
+}
+
+// Check reports whether the bucket identified by key has a token, without
+// taking it. Together with Allow it limits only some outcomes, such as
+// failures, while refusing every attempt once they run out.
+func (l *Limiter) Check(ctx context.Context, key string) (Result, error) {
+	return l.take(ctx, key, 0)
+}
+
+func (l *Limiter) take(ctx context.Context, key string, cost int) (Result, error) {
+	if l.limit.Rate <= 0 {
+		return Result{Allowed: true}, nil
+	}
+
+	bucketKey := fmt.Sprintf("ratelimit:%s:%s", l.prefix, key)
+	values, err := tokenBucket.Run(ctx, l.redis, []string{bucketKey}, l.limit.Rate, l.limit.Burst, cost).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(values) != 2 {
+		return Result{}, fmt.Errorf("unexpected rate limit result %v", values)
+	}
+	return Result{
+		Allowed:    values[0] == 1,
+		RetryAfter: time.Duration(values[1]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllow(t *testing.T) {
+	redisClient, redisMock := redismock.NewClientMock()
+	limiter := NewLimiter(redisClient, "answers", Limit{Rate: 2, Burst: 5})
+	ctx := context.Background()
+
+	redisMock.ExpectEvalSha(tokenBucket.Hash(), []string{"ratelimit:answers:user:user1"}, 2.0, 5, 1).
+		SetVal([]interface{}{int64(1), int64(0)})
+	result, err := limiter.Allow(ctx, "user:user1")
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Allowed: true}, result)
+
+	redisMock.ExpectEvalSha(tokenBucket.Hash(), []string{"ratelimit:answers:user:user1"}, 2.0, 5, 1).
+		SetVal([]interface{}{int64(0), int64(350)})
+	result, err = limiter.Allow(ctx, "user:user1")
+	assert.NoError(t, err)
+	assert.Equal(t, Result{RetryAfter: 350 * time.Millisecond}, result)
+
+	// Checking doesn't take a token
+	redisMock.ExpectEvalSha(tokenBucket.Hash(), []string{"ratelimit:answers:user:user1"}, 2.0, 5, 0).
+		SetVal([]interface{}{int64(1), int64(0)})
+	result, err = limiter.Check(ctx, "user:user1")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestAllow_Disabled(t *testing.T) {
+	redisClient, redisMock := redismock.NewClientMock()
+	limiter := NewLimiter(redisClient, "answers", Limit{})
+
+	result, err := limiter.Allow(context.Background(), "user:user1")
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultBroadcastInterval is how often a quiz's leaderboards may be
+// broadcast unless WithBroadcastInterval says otherwise.
+const defaultBroadcastInterval = 250 * time.Millisecond
+
+// WithBroadcastInterval sets the shortest time between two leaderboard
+// broadcasts to a quiz. Answers arriving in between are covered by the
+// next broadcast.
+func WithBroadcastInterval(interval time.Duration) Option {
+	return func(s *Server) {
+		s.broadcaster.interval = interval
+	}
+}
+
+// broadcaster coalesces leaderboard updates per quiz. The first update to a
+// quiz goes out straight away; updates requested while one is in flight,
+// or within interval of the last one, are merged into a single update that
+// goes out once the interval has passed. Every update reads the latest
+// leaderboards, so nothing marked dirty is missed.
+type broadcaster struct {
+	interval time.Duration
+	send     func(ctx context.Context, quizID string)
+
+	mu sync.Mutex
+	// dirty holds the quizzes with a running broadcast loop, mapped to
+	// whether they have changed since their last broadcast.
+	dirty map[string]bool
+}
+
+func newBroadcaster(interval time.Duration, send func(ctx context.Context, quizID string)) *broadcaster {
+	return &broadcaster{interval: interval, send: send, dirty: make(map[string]bool)}
+}
+
+// markDirty schedules a broadcast of the quiz's leaderboards.
+func (b *broadcaster) markDirty(quizID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, running := b.dirty[quizID]
+	b.dirty[quizID] = true
+	if !running {
+		go b.run(quizID)
+	}
+}
+
+// run broadcasts the quiz's leaderboards until an interval passes without
+// them changing.
+func (b *broadcaster) run(quizID string) {
+	for {
+		b.mu.Lock()
+		if !b.dirty[quizID] {
+			delete(b.dirty, quizID)
+			b.mu.Unlock()
+			return
+		}
+		b.dirty[quizID] = false
+		b.mu.Unlock()
+
+		b.send(context.Background(), quizID)
+		time.Sleep(b.interval)
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+// Subprotocols a client may negotiate to pick how /ws messages are
+// encoded. Clients that don't negotiate one get JSON.
+const (
+	SubprotocolJSON    = "quiz.v1.json"
+	SubprotocolMsgpack = "quiz.v1.msgpack"
+)
+
+// messageCodec encodes the messages exchanged over /ws. Messages are built
+// as JSON, which is also how the event log keeps them, and each codec
+// converts them to and from its own encoding, so that every encoding
+// carries the same message types and fields.
+type messageCodec interface {
+	// Encode converts a JSON message to this encoding.
+	Encode(data []byte) ([]byte, error)
+	// Decode converts a message in this encoding to JSON.
+	Decode(data []byte) ([]byte, error)
+	// MessageType is the WebSocket message type messages are sent as.
+	MessageType() int
+}
+
+// codecFor returns the codec of a negotiated subprotocol.
+func codecFor(subprotocol string) messageCodec {
+	if subprotocol == SubprotocolMsgpack {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(data []byte) ([]byte, error) { return data, nil }
+func (jsonCodec) Decode(data []byte) ([]byte, error) { return data, nil }
+func (jsonCodec) MessageType() int                   { return websocket.TextMessage }
+
+// msgpackHandle is safe for concurrent use once configured.
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{WriteExt: true}
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	h.RawToString = true
+	return h
+}()
+
+// msgpackCodec encodes messages as MessagePack maps with the same keys as
+// the JSON messages.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var out []byte
+	err := codec.NewEncoderBytes(&out, msgpackHandle).Encode(withNumbers(v))
+	return out, err
+}
+
+func (msgpackCodec) Decode(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := codec.NewDecoderBytes(data, msgpackHandle).Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func (msgpackCodec) MessageType() int { return websocket.BinaryMessage }
+
+// withNumbers replaces the json.Numbers in a decoded JSON value with
+// integers where possible and floats otherwise, so that they aren't
+// encoded as strings.
+func withNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = withNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = withNumbers(item)
+		}
+	}
+	return v
+}
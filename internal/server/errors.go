@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"realtime_leaderboard/internal/apperrors"
+)
+
+// errorResponse is the body of every HTTP error response.
+type errorResponse struct {
+	Error        *apperrors.Error `json:"error"`
+	RetryAfterMs int64            `json:"retry_after_ms,omitempty"`
+}
+
+var statusCodes = map[apperrors.Kind]int{
+	apperrors.Invalid:      http.StatusBadRequest,
+	apperrors.NotFound:     http.StatusNotFound,
+	apperrors.Conflict:     http.StatusConflict,
+	apperrors.Unauthorized: http.StatusUnauthorized,
+	apperrors.Forbidden:    http.StatusForbidden,
+	apperrors.RateLimited:  http.StatusTooManyRequests,
+}
+
+func httpStatus(kind apperrors.Kind) int {
+	if status, ok := statusCodes[kind]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// writeError reports err to an HTTP client. Errors that aren't domain
+// errors are logged and reported as internal errors.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	appErr := apperrors.From(err)
+	if appErr.Kind == apperrors.Internal {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	}
+	writeErrorResponse(w, httpStatus(appErr.Kind), errorResponse{Error: appErr})
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, resp errorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error encoding error response: %v", err)
+	}
+}
+
+// sendError reports err to a WebSocket client, the same way as writeError.
+func (s *Server) sendError(conn *websocket.Conn, err error) {
+	appErr := apperrors.From(err)
+	if appErr.Kind == apperrors.Internal {
+		log.Println(err)
+	}
+	msg := errorMessage{header: header{Type: messageTypeError}, Code: appErr.Code, Message: appErr.Message}
+	if err := s.send(conn, msg); err != nil {
+		log.Println(err)
+	}
+}
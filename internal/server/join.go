@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"realtime_leaderboard/internal/apperrors"
+)
+
+// joinRequest is the body of POST /join. Players with an account give
+// their user ID, anyone else a nickname.
+type joinRequest struct {
+	PIN      string `json:"pin"`
+	UserID   string `json:"user_id"`
+	Nickname string `json:"nickname"`
+}
+
+type pinResponse struct {
+	QuizID string `json:"quiz_id"`
+	PIN    string `json:"pin"`
+}
+
+// handleJoin resolves a join PIN to its quiz and registers the player,
+// returning the resume token to connect to the WebSocket with.
+// Clients that have tried too many unknown PINs are turned away before
+// the PIN is looked up, so that they can't learn whether it exists.
+func (s *Server) handleJoin(w http.ResponseWriter, r *http.Request) {
+	key := s.ipKey(r)
+	if result := allow(r.Context(), s.rateLimiters.Joins, key); !result.Allowed {
+		writeTooManyRequests(w, result)
+		return
+	}
+	if result := check(r.Context(), s.rateLimiters.FailedJoins, key); !result.Allowed {
+		writeTooManyRequests(w, result)
+		return
+	}
+	var req joinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PIN == "" || req.UserID == "" && req.Nickname == "" {
+		writeError(w, r, apperrors.InvalidRequest("missing pin, or user_id or nickname"))
+		return
+	}
+
+	session, err := s.quizService.JoinByPIN(r.Context(), req.PIN, req.UserID, req.Nickname)
+	if errors.Is(err, apperrors.ErrPINNotFound) {
+		allow(r.Context(), s.rateLimiters.FailedJoins, key)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, session)
+}
+
+func (s *Server) handleGetJoinPIN(w http.ResponseWriter, r *http.Request) {
+	quizID := mux.Vars(r)["id"]
+	pin, err := s.quizService.JoinPIN(r.Context(), quizID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, pinResponse{QuizID: quizID, PIN: pin})
+}
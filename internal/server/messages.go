@@ -0,0 +1,150 @@
+package server
+
+import (
+	"realtime_leaderboard/internal/models"
+	"realtime_leaderboard/internal/services"
+)
+
+// Message types sent over /ws. Clients that send a message without a type
+// are treated as submitting an answer.
+const (
+	messageTypeAnswer          = "answer"
+	messageTypeJoinTeam        = "join_team"
+	messageTypeWelcome         = "welcome"
+	messageTypeTeamJoined      = "team_joined"
+	messageTypeLeaderboard     = "leaderboard"
+	messageTypeTeamLeaderboard = "team_leaderboard"
+	messageTypeRankChanged     = "rank_changed"
+	messageTypeQuestionOpened  = "question_opened"
+	messageTypeQuestionClosed  = "question_closed"
+	messageTypeQuizCountdown   = "quiz_countdown"
+	messageTypeQuizFinished    = "quiz_finished"
+	messageTypePlayerJoined    = "player_joined"
+	messageTypePlayerLeft      = "player_left"
+	messageTypePlayerCount     = "player_count"
+	messageTypeError           = "error"
+)
+
+// header starts every message sent to clients. Broadcast events carry the
+// quiz's event sequence number so that reconnecting clients can tell the
+// server what they have already seen.
+type header struct {
+	Type string `json:"type"`
+	Seq  int64  `json:"seq,omitempty"`
+}
+
+func (h *header) setSeq(seq int64) {
+	h.Seq = seq
+}
+
+// event is a message that is broadcast and kept in the quiz's event log.
+type event interface {
+	setSeq(seq int64)
+}
+
+type clientMessage struct {
+	Type       string        `json:"type"`
+	QuestionID string        `json:"question_id"`
+	Answer     models.Answer `json:"answer"`
+	TeamName   string        `json:"team_name"`
+}
+
+// welcomeMessage is the first message on every connection. It carries the
+// current leaderboard, the resume token to reconnect with and, when
+// resuming, what the client missed.
+type welcomeMessage struct {
+	header
+	// UserID tells players who joined with a nickname the ID of the guest
+	// user created for them.
+	UserID      string `json:"user_id"`
+	ResumeToken string `json:"resume_token"`
+	// PIN is the quiz's join PIN, sent to hosts to show players.
+	PIN string `json:"pin,omitempty"`
+	// Countdown is set while a scheduled quiz's lobby is open.
+	Countdown *services.Countdown `json:"countdown,omitempty"`
+	// LastSeq is the sequence number of the latest event at connect time.
+	LastSeq     int64                 `json:"last_seq"`
+	PlayerCount int                   `json:"player_count"`
+	Resume      *services.ResumeState `json:"resume,omitempty"`
+	*services.PaginatedLeaderboard
+}
+
+type leaderboardMessage struct {
+	header
+	*services.PaginatedLeaderboard
+}
+
+// rankChangedMessage tells a player how their rank moved since the last
+// leaderboard update. It is sent to each player separately and isn't kept
+// in the event log.
+type rankChangedMessage struct {
+	header
+	Rank int `json:"rank"`
+	// PreviousRank is 0 when the player wasn't ranked before.
+	PreviousRank int `json:"previous_rank"`
+	// PlacesMoved is positive when the player moved up.
+	PlacesMoved int `json:"places_moved"`
+	// EnteredTop is the size of the top group when the player has just
+	// entered it.
+	EnteredTop int `json:"entered_top,omitempty"`
+	// OvertakenBy names the first few players who overtook this one.
+	OvertakenBy []overtaker `json:"overtaken_by,omitempty"`
+}
+
+type overtaker struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+}
+
+type teamLeaderboardMessage struct {
+	header
+	*services.TeamLeaderboard
+}
+
+type questionOpenedMessage struct {
+	header
+	*services.ActiveQuestion
+}
+
+// questionClosedMessage tells clients the host, or the scheduler, has
+// stopped taking answers to the question.
+type questionClosedMessage struct {
+	header
+	QuestionID string `json:"question_id"`
+}
+
+// quizCountdownMessage tells lobby clients when a scheduled quiz starts.
+type quizCountdownMessage struct {
+	header
+	*services.Countdown
+}
+
+type quizFinishedMessage struct {
+	header
+}
+
+// presenceMessage tells hosts that a player came online or went offline.
+type presenceMessage struct {
+	header
+	UserID string `json:"user_id"`
+	Count  int    `json:"count"`
+}
+
+type playerCountMessage struct {
+	header
+	Count int `json:"count"`
+}
+
+type teamJoinedMessage struct {
+	header
+	Team *models.Team `json:"team"`
+}
+
+// errorMessage reports a failed request. Code is the stable code of the
+// domain error, as in HTTP error responses.
+type errorMessage struct {
+	header
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+}
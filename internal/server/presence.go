@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"realtime_leaderboard/internal/services"
+)
+
+// presenceHeartbeat is how often connected players refresh their presence,
+// comfortably within services.PresenceTTL.
+const presenceHeartbeat = services.PresenceTTL / 3
+
+func (s *Server) handleGetPresence(w http.ResponseWriter, r *http.Request) {
+	presence, err := s.quizService.GetPresence(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, presence)
+}
+
+// trackPresence marks a player online and, if this is their first
+// connection, tells the hosts and updates everyone's player count. The
+// joining connection itself learns the count from its welcome message.
+func (s *Server) trackPresence(ctx context.Context, conn *websocket.Conn, quizID, userID string) {
+	joined, err := s.quizService.JoinPresence(ctx, quizID, userID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if joined {
+		s.announcePresence(ctx, conn, quizID, userID, messageTypePlayerJoined)
+	}
+}
+
+func (s *Server) untrackPresence(ctx context.Context, conn *websocket.Conn, quizID, userID string) {
+	left, err := s.quizService.LeavePresence(ctx, quizID, userID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if left {
+		s.announcePresence(ctx, conn, quizID, userID, messageTypePlayerLeft)
+	}
+}
+
+// announcePresence notifies every connection except skip, the one that
+// joined or left.
+func (s *Server) announcePresence(ctx context.Context, skip *websocket.Conn, quizID, userID, messageType string) {
+	presence, err := s.quizService.GetPresence(ctx, quizID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	s.notify(quizID, presenceMessage{header: header{Type: messageType}, UserID: userID, Count: presence.Count},
+		func(conn *websocket.Conn, c *client) bool { return conn != skip && c.host })
+	s.notify(quizID, playerCountMessage{header: header{Type: messageTypePlayerCount}, Count: presence.Count},
+		func(conn *websocket.Conn, c *client) bool { return conn != skip })
+}
+
+// heartbeat keeps the player's presence fresh until ctx is done.
+func (s *Server) heartbeat(ctx context.Context, quizID, userID string) {
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.quizService.HeartbeatPresence(ctx, quizID, userID); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+	"realtime_leaderboard/internal/services"
+)
+
+// maxImportBytes bounds the size of an imported quiz.
+const maxImportBytes = 1 << 20
+
+// handleImportQuiz creates a quiz from a JSON document, or from a CSV sheet
+// of its questions when the body is text/csv. The quiz's title and team
+// scoring are then given as query parameters.
+func (s *Server) handleImportQuiz(w http.ResponseWriter, r *http.Request) {
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+	var doc *services.QuizDocument
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/csv" {
+		quiz := models.Quiz{
+			Title:       r.URL.Query().Get("title"),
+			TeamScoring: models.TeamScoring(r.URL.Query().Get("team_scoring")),
+		}
+		if v := r.URL.Query().Get("team_best_n"); v != "" {
+			if quiz.TeamBestN, err = strconv.Atoi(v); err != nil {
+				writeError(w, r, apperrors.InvalidRequest("invalid team_best_n"))
+				return
+			}
+		}
+		doc, err = s.quizService.ImportQuizCSV(r.Context(), quiz, body)
+	} else {
+		doc = &services.QuizDocument{}
+		if err := json.NewDecoder(body).Decode(doc); err != nil {
+			writeError(w, r, apperrors.InvalidRequest("invalid quiz document"))
+			return
+		}
+		doc, err = s.quizService.ImportQuiz(r.Context(), doc)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/quizzes/"+doc.Quiz.ID+"/export")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, doc)
+}
+
+// handleExportQuiz returns the quiz as a JSON document, or its questions as
+// a CSV sheet with format=csv.
+func (s *Server) handleExportQuiz(w http.ResponseWriter, r *http.Request) {
+	quizID := mux.Vars(r)["id"]
+	doc, err := s.quizService.ExportQuiz(r.Context(), quizID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, doc)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", quizID+".csv"))
+		if err := services.WriteQuizCSV(w, doc.Questions); err != nil {
+			log.Printf("Error writing quiz CSV: %v", err)
+		}
+	default:
+		writeError(w, r, apperrors.InvalidRequest("format should be json or csv"))
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/gorilla/websocket"
+	"realtime_leaderboard/internal/models"
+)
+
+const (
+	// topRanks is the size of the top group players are told they have
+	// entered.
+	topRanks = 10
+	// maxOvertakers is how many of the players who overtook someone since
+	// the last update are named.
+	maxOvertakers = 3
+)
+
+// standings are a quiz's ranks as of a leaderboard broadcast, of the
+// players on the broadcast page and of those connected here.
+type standings struct {
+	ranks map[string]int
+	// lastPageRank is the rank of the last player on the page. Players
+	// without a rank were ranked there or below, if at all.
+	lastPageRank int
+}
+
+// rankLeaderboard ranks the leaderboard's players, who are in score order,
+// giving players with the same score the same rank.
+func rankLeaderboard(leaderboard []models.LeaderboardEntry) map[string]int {
+	ranks := make(map[string]int, len(leaderboard))
+	for i, e := range leaderboard {
+		rank := i + 1
+		if i > 0 && e.Score == leaderboard[i-1].Score {
+			rank = ranks[leaderboard[i-1].UserID]
+		}
+		ranks[e.UserID] = rank
+	}
+	return ranks
+}
+
+// rankChange describes how the user's rank moved between the previous
+// and current ranks, or returns nil if it didn't. Players on the
+// leaderboard page now ahead who were level or behind overtook the user.
+// Those without a previous rank were only behind if the user was then
+// ranked within the page.
+func rankChange(userID string, previous standings, current map[string]int, leaderboard []models.LeaderboardEntry) *rankChangedMessage {
+	rank, ok := current[userID]
+	if !ok {
+		return nil
+	}
+	previousRank, wasRanked := previous.ranks[userID]
+	if wasRanked && previousRank == rank {
+		return nil
+	}
+
+	msg := &rankChangedMessage{header: header{Type: messageTypeRankChanged}, Rank: rank, PreviousRank: previousRank}
+	if wasRanked {
+		msg.PlacesMoved = previousRank - rank
+	}
+	if rank <= topRanks && (!wasRanked || previousRank > topRanks) {
+		msg.EnteredTop = topRanks
+	}
+	if !wasRanked {
+		return msg
+	}
+	for _, e := range leaderboard {
+		if current[e.UserID] >= rank || len(msg.OvertakenBy) == maxOvertakers {
+			break
+		}
+		before, ok := previous.ranks[e.UserID]
+		if ok && before >= previousRank || !ok && previousRank <= previous.lastPageRank {
+			msg.OvertakenBy = append(msg.OvertakenBy, overtaker{UserID: e.UserID, Username: e.Username})
+		}
+	}
+	return msg
+}
+
+// notifyRankChanges tells each of the quiz's players connected here how
+// their rank moved since the quiz's last leaderboard broadcast. Players
+// beyond the broadcast page of the leaderboard get their ranks from the
+// quiz's scores. The ranks are kept for as long as the quiz has clients,
+// so the first broadcast after that only records them.
+func (s *Server) notifyRankChanges(ctx context.Context, quizID string, leaderboard []models.LeaderboardEntry) {
+	ranks := rankLeaderboard(leaderboard)
+	current := standings{ranks: ranks}
+	if len(leaderboard) > 0 {
+		current.lastPageRank = ranks[leaderboard[len(leaderboard)-1].UserID]
+	}
+
+	s.mutex.Lock()
+	var unranked []string
+	seen := make(map[string]bool)
+	for _, c := range s.clients[quizID] {
+		if _, ok := ranks[c.userID]; !ok && !c.host && !seen[c.userID] {
+			seen[c.userID] = true
+			unranked = append(unranked, c.userID)
+		}
+	}
+	s.mutex.Unlock()
+	if len(unranked) > 0 {
+		playerRanks, err := s.quizService.GetRanks(ctx, quizID, unranked)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		for userID, rank := range playerRanks {
+			ranks[userID] = rank
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.clients[quizID]) == 0 {
+		delete(s.ranks, quizID)
+		return
+	}
+	previous, ok := s.ranks[quizID]
+	s.ranks[quizID] = current
+	if !ok {
+		return
+	}
+
+	// Players connected more than once get the same message on each
+	// connection.
+	changes := make(map[string][]byte)
+	for conn, c := range s.clients[quizID] {
+		if c.host {
+			continue
+		}
+		data, ok := changes[c.userID]
+		if !ok {
+			if msg := rankChange(c.userID, previous, ranks, leaderboard); msg != nil {
+				var err error
+				if data, err = json.Marshal(msg); err != nil {
+					log.Println(err)
+				}
+			}
+			changes[c.userID] = data
+		}
+		if data == nil {
+			continue
+		}
+		if err := writeMessage(conn, data); err != nil {
+			log.Println(err)
+			delete(s.clients[quizID], conn)
+			conn.Close()
+		}
+	}
+}
+
+// forgetRanks drops the quiz's ranks once its last client has gone.
+// The caller must hold s.mutex.
+func (s *Server) forgetRanks(quizID string) {
+	if len(s.clients[quizID]) == 0 {
+		delete(s.ranks, quizID)
+	}
+}
+
+// writeMessage writes a JSON message to a single client in its codec. The
+// caller must hold s.mutex.
+func writeMessage(conn *websocket.Conn, data []byte) error {
+	codec := codecFor(conn.Subprotocol())
+	encoded, err := codec.Encode(data)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(codec.MessageType(), encoded)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/ratelimit"
+)
+
+// RateLimiter decides whether the client identified by key may proceed.
+// Allow counts the attempt against the client, while Check only looks.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string) (ratelimit.Result, error)
+	Check(ctx context.Context, key string) (ratelimit.Result, error)
+}
+
+// RateLimiters limit answer submission, WebSocket connects, leaderboard
+// requests and joining by PIN. Answers and connects are limited per user,
+// and separately per IP by AnswersPerIP and ConnectsPerIP, whose limits
+// allow for a room full of players sharing an address. FailedJoins counts
+// only joins with an unknown PIN, so that PINs can't be guessed while
+// players can still join from one address. A nil limiter doesn't limit.
+type RateLimiters struct {
+	Answers       RateLimiter
+	AnswersPerIP  RateLimiter
+	Connects      RateLimiter
+	ConnectsPerIP RateLimiter
+	Leaderboard   RateLimiter
+	Joins         RateLimiter
+	FailedJoins   RateLimiter
+}
+
+// allow checks every key against the limiter and returns the first
+// rejection. Limiter errors are logged and let the request through so that
+// a Redis outage doesn't take the game down with it.
+func allow(ctx context.Context, limiter RateLimiter, keys ...string) ratelimit.Result {
+	if limiter == nil {
+		return ratelimit.Result{Allowed: true}
+	}
+	return firstRejection(ctx, limiter.Allow, keys)
+}
+
+// check is allow without counting the attempt.
+func check(ctx context.Context, limiter RateLimiter, keys ...string) ratelimit.Result {
+	if limiter == nil {
+		return ratelimit.Result{Allowed: true}
+	}
+	return firstRejection(ctx, limiter.Check, keys)
+}
+
+func firstRejection(ctx context.Context, limit func(ctx context.Context, key string) (ratelimit.Result, error), keys []string) ratelimit.Result {
+	for _, key := range keys {
+		result, err := limit(ctx, key)
+		if err != nil {
+			log.Printf("Error checking rate limit: %v", err)
+			continue
+		}
+		if !result.Allowed {
+			return result
+		}
+	}
+	return ratelimit.Result{Allowed: true}
+}
+
+// allowClient limits the client by IP with perIP and, when known, by user
+// with perUser.
+func (s *Server) allowClient(ctx context.Context, r *http.Request, userID string, perIP, perUser RateLimiter) ratelimit.Result {
+	if result := allow(ctx, perIP, s.ipKey(r)); !result.Allowed || userID == "" {
+		return result
+	}
+	return allow(ctx, perUser, "user:"+userID)
+}
+
+// ipKey identifies a client by IP.
+func (s *Server) ipKey(r *http.Request) string {
+	return "ip:" + s.clientIP(r)
+}
+
+// clientIP returns the client's address. Behind proxies, it is the one in
+// X-Forwarded-For the furthest trusted proxy added, counting from the
+// right, since the client can put anything before it.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.trustProxyHeaders {
+		forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		if i := len(forwarded) - s.proxyHops; s.proxyHops > 0 && i >= 0 {
+			if ip := strings.TrimSpace(forwarded[i]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeTooManyRequests(w http.ResponseWriter, result ratelimit.Result) {
+	seconds := int(math.Ceil(result.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeErrorResponse(w, http.StatusTooManyRequests, errorResponse{
+		Error:        apperrors.ErrRateLimited,
+		RetryAfterMs: result.RetryAfter.Milliseconds(),
+	})
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"realtime_leaderboard/internal/apperrors"
+)
+
+func (s *Server) handleOpenQuestion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	active, err := s.quizService.OpenQuestion(r.Context(), vars["id"], vars["questionID"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s.broadcast(r.Context(), vars["id"], &questionOpenedMessage{header: header{Type: messageTypeQuestionOpened}, ActiveQuestion: active})
+	writeJSON(w, active)
+}
+
+func (s *Server) handleCloseQuestion(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.quizService.CloseQuestion(r.Context(), vars["id"], vars["questionID"]); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s.broadcast(r.Context(), vars["id"], &questionClosedMessage{header: header{Type: messageTypeQuestionClosed}, QuestionID: vars["questionID"]})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// participantRequest is the body of POST /quizzes/{id}/participants.
+type participantRequest struct {
+	UserID string `json:"user_id"`
+}
+
+func (s *Server) handleRegisterParticipant(w http.ResponseWriter, r *http.Request) {
+	var req participantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+		writeError(w, r, apperrors.InvalidRequest("missing user_id"))
+		return
+	}
+
+	if err := s.quizService.RegisterParticipant(r.Context(), mux.Vars(r)["id"], req.UserID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleGetUserResults(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	results, err := s.quizService.GetUserResults(r.Context(), vars["id"], vars["userID"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, results)
+}
+
+func (s *Server) handleGetUserHistory(w http.ResponseWriter, r *http.Request) {
+	page, pageSize := parsePagination(r)
+	history, err := s.quizService.GetUserHistory(r.Context(), mux.Vars(r)["userID"], page, pageSize)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, history)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
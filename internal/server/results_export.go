@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"realtime_leaderboard/internal/models"
+)
+
+// handleExportResults streams the quiz's standings as CSV or JSON. Once
+// part of the response has reached the client, errors can no longer be
+// reported, so a failure aborts the response instead, which clients see as
+// a broken download rather than a complete one.
+func (s *Server) handleExportResults(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	quizID := vars["id"]
+	var results resultsWriter
+	if vars["format"] == "csv" {
+		results = &csvResultsWriter{w: w, quizID: quizID}
+	} else {
+		results = &jsonResultsWriter{w: w, quizID: quizID}
+	}
+
+	err := s.quizService.ExportResults(r.Context(), quizID, results)
+	if err == nil {
+		err = results.Close()
+	}
+	if err != nil {
+		if !results.Started() {
+			w.Header().Del("Content-Disposition")
+			writeError(w, r, err)
+			return
+		}
+		log.Printf("Error exporting results of quiz %s: %v", quizID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// resultsWriter is a services.ResultsWriter writing an HTTP response.
+type resultsWriter interface {
+	WriteHeader(questions []models.Question) error
+	WriteRow(row *models.ResultRow) error
+	// Close finishes the response.
+	Close() error
+	// Started reports whether any of the response has reached the client,
+	// rather than only being buffered.
+	Started() bool
+}
+
+// sentWriter notes whether anything has been written through it.
+type sentWriter struct {
+	w    io.Writer
+	sent bool
+}
+
+func (s *sentWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		s.sent = true
+	}
+	return s.w.Write(p)
+}
+
+// csvSafe quotes a user-chosen cell that spreadsheets would otherwise take
+// for a formula.
+func csvSafe(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// csvResultsWriter writes a row per participant, with a column per question
+// holding the points they scored on it, left empty when unanswered.
+type csvResultsWriter struct {
+	w         http.ResponseWriter
+	quizID    string
+	out       *sentWriter
+	csv       *csv.Writer
+	questions []models.Question
+}
+
+func (c *csvResultsWriter) WriteHeader(questions []models.Question) error {
+	c.w.Header().Set("Content-Type", "text/csv")
+	c.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", c.quizID+"-results.csv"))
+	c.out = &sentWriter{w: c.w}
+	c.csv = csv.NewWriter(c.out)
+	c.questions = questions
+
+	header := []string{"rank", "username", "score", "correct_count", "avg_response_time_ms"}
+	for i := range questions {
+		header = append(header, fmt.Sprintf("q%d", i+1))
+	}
+	return c.csv.Write(header)
+}
+
+func (c *csvResultsWriter) WriteRow(row *models.ResultRow) error {
+	record := []string{
+		strconv.Itoa(row.Rank),
+		csvSafe(row.Username),
+		strconv.Itoa(row.Score),
+		strconv.Itoa(row.CorrectCount),
+		"",
+	}
+	if row.AvgResponseTimeMs != nil {
+		record[4] = strconv.Itoa(*row.AvgResponseTimeMs)
+	}
+	for _, q := range c.questions {
+		if points, ok := row.QuestionPoints[q.ID]; ok {
+			record = append(record, strconv.Itoa(points))
+		} else {
+			record = append(record, "")
+		}
+	}
+	return c.csv.Write(record)
+}
+
+func (c *csvResultsWriter) Close() error {
+	c.csv.Flush()
+	return c.csv.Error()
+}
+
+func (c *csvResultsWriter) Started() bool {
+	return c.out != nil && c.out.sent
+}
+
+type resultsQuestion struct {
+	ID           string `json:"id"`
+	QuestionText string `json:"question_text"`
+}
+
+// resultsEntry is a participant's standing in the JSON results.
+// QuestionPoints lines up with the questions, null where unanswered.
+type resultsEntry struct {
+	Rank              int    `json:"rank"`
+	UserID            string `json:"user_id"`
+	Username          string `json:"username"`
+	Score             int    `json:"score"`
+	CorrectCount      int    `json:"correct_count"`
+	AvgResponseTimeMs *int   `json:"avg_response_time_ms"`
+	QuestionPoints    []*int `json:"question_points"`
+}
+
+// jsonResultsWriter writes an object with the quiz's questions and a
+// results array, one entry at a time.
+type jsonResultsWriter struct {
+	w         http.ResponseWriter
+	quizID    string
+	out       *sentWriter
+	buf       *bufio.Writer
+	questions []models.Question
+	rows      int
+}
+
+func (j *jsonResultsWriter) WriteHeader(questions []models.Question) error {
+	j.w.Header().Set("Content-Type", "application/json")
+	j.out = &sentWriter{w: j.w}
+	j.buf = bufio.NewWriter(j.out)
+	j.questions = questions
+
+	header := struct {
+		QuizID    string            `json:"quiz_id"`
+		Questions []resultsQuestion `json:"questions"`
+	}{QuizID: j.quizID, Questions: make([]resultsQuestion, len(questions))}
+	for i, q := range questions {
+		header.Questions[i] = resultsQuestion{ID: q.ID, QuestionText: q.QuestionText}
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	// Leave the object open for the results
+	j.buf.Write(data[:len(data)-1])
+	_, err = j.buf.WriteString(`,"results":[`)
+	return err
+}
+
+func (j *jsonResultsWriter) WriteRow(row *models.ResultRow) error {
+	entry := resultsEntry{
+		Rank:              row.Rank,
+		UserID:            row.UserID,
+		Username:          row.Username,
+		Score:             row.Score,
+		CorrectCount:      row.CorrectCount,
+		AvgResponseTimeMs: row.AvgResponseTimeMs,
+		QuestionPoints:    make([]*int, len(j.questions)),
+	}
+	for i, q := range j.questions {
+		if points, ok := row.QuestionPoints[q.ID]; ok {
+			entry.QuestionPoints[i] = &points
+		}
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if j.rows > 0 {
+		j.buf.WriteByte(',')
+	}
+	j.rows++
+	_, err = j.buf.Write(data)
+	return err
+}
+
+func (j *jsonResultsWriter) Close() error {
+	if _, err := j.buf.WriteString("]}\n"); err != nil {
+		return err
+	}
+	return j.buf.Flush()
+}
+
+func (j *jsonResultsWriter) Started() bool {
+	return j.out != nil && j.out.sent
+}
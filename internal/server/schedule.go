@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+	"realtime_leaderboard/internal/services"
+)
+
+// scheduleRequest is the body of PUT /quizzes/{id}/schedule. The lobby
+// opens services.DefaultLobbyLead before the start unless LobbyMinutes is
+// given.
+type scheduleRequest struct {
+	StartsAt     time.Time `json:"starts_at"`
+	LobbyMinutes *int      `json:"lobby_minutes"`
+}
+
+func (s *Server) handleScheduleQuiz(w http.ResponseWriter, r *http.Request) {
+	var req scheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.StartsAt.IsZero() {
+		writeError(w, r, apperrors.InvalidRequest("missing or invalid starts_at"))
+		return
+	}
+	lobbyLead := services.DefaultLobbyLead
+	if req.LobbyMinutes != nil {
+		lobbyLead = time.Duration(*req.LobbyMinutes) * time.Minute
+	}
+
+	schedule, err := s.quizService.ScheduleQuiz(r.Context(), mux.Vars(r)["id"], req.StartsAt, lobbyLead)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, schedule)
+}
+
+// handleQuizTransition tells a scheduled quiz's clients that its lobby
+// opened, with the countdown to the start, that it moved on to its next
+// question, that the question closed or that it finished.
+func (s *Server) handleQuizTransition(ctx context.Context, t *models.QuizTransition) {
+	switch t.Status {
+	case models.ScheduleStatusLobby:
+		s.broadcast(ctx, t.QuizID, &quizCountdownMessage{
+			header:    header{Type: messageTypeQuizCountdown},
+			Countdown: services.NewCountdown(t.StartsAt, time.Now()),
+		})
+	case models.ScheduleStatusRunning:
+		active, err := s.quizService.GetActiveQuestion(ctx, t.QuizID)
+		if err != nil || active == nil {
+			log.Printf("Error loading question opened by the scheduler: %v", err)
+			return
+		}
+		s.broadcast(ctx, t.QuizID, &questionOpenedMessage{header: header{Type: messageTypeQuestionOpened}, ActiveQuestion: active})
+	case models.ScheduleStatusQuestionClosed:
+		s.broadcast(ctx, t.QuizID, &questionClosedMessage{header: header{Type: messageTypeQuestionClosed}, QuestionID: t.QuestionID})
+	case models.ScheduleStatusFinished:
+		s.broadcast(ctx, t.QuizID, &quizFinishedMessage{header: header{Type: messageTypeQuizFinished}})
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -9,141 +10,554 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
 	"realtime_leaderboard/internal/services"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
+const (
+	defaultPage     = 1
+	defaultPageSize = 10
+	maxPageSize     = 100
+)
 
 type Server struct {
-	Router      *mux.Router
-	quizService services.QuizServiceInterface
-	clients     map[string]map[*websocket.Conn]bool // quizID -> clients
-	mutex       sync.Mutex
+	Router            *mux.Router
+	quizService       services.QuizServiceInterface
+	clients           map[string]map[*websocket.Conn]*client // quizID -> clients
+	streams           map[string]map[chan []byte]bool        // quizID -> Server-Sent Event streams
+	ranks             map[string]standings                   // quizID -> ranks at the last broadcast
+	mutex             sync.Mutex
+	eventLocks        sync.Map // quizID -> *sync.Mutex ordering the quiz's broadcasts
+	rateLimiters      RateLimiters
+	trustProxyHeaders bool
+	proxyHops         int
+	hostKey           string
+	wsConfig          WebSocketConfig
+	upgrader          *websocket.Upgrader
+	broadcaster       *broadcaster
+}
+
+// client is a connection's identity within its quiz.
+type client struct {
+	userID string
+	// host connections run the quiz and aren't counted as players.
+	host bool
+}
+
+type Option func(*Server)
+
+func WithRateLimiters(limiters RateLimiters) Option {
+	return func(s *Server) {
+		s.rateLimiters = limiters
+	}
+}
+
+// WithTrustProxyHeaders identifies clients by X-Forwarded-For. Only enable
+// it behind a proxy that sets the header.
+func WithTrustProxyHeaders(trust bool) Option {
+	return func(s *Server) {
+		s.trustProxyHeaders = trust
+	}
 }
 
-func NewServer(quizService services.QuizServiceInterface) *Server {
+// WithProxyHops sets how many proxies in front of the server append to
+// X-Forwarded-For, one by default. The client is the address the furthest
+// of them added.
+func WithProxyHops(hops int) Option {
+	return func(s *Server) {
+		s.proxyHops = hops
+	}
+}
+
+// WithHostKey sets the key hosts must present, as host_key to connect to a
+// quiz as its host and in the X-Host-Key header for host actions such as
+// opening questions. Without one, nobody can host.
+func WithHostKey(key string) Option {
+	return func(s *Server) {
+		s.hostKey = key
+	}
+}
+
+func NewServer(quizService services.QuizServiceInterface, opts ...Option) *Server {
 	s := &Server{
 		Router:      mux.NewRouter(),
 		quizService: quizService,
-		clients:     make(map[string]map[*websocket.Conn]bool),
+		clients:     make(map[string]map[*websocket.Conn]*client),
+		streams:     make(map[string]map[chan []byte]bool),
+		ranks:       make(map[string]standings),
+		wsConfig:    DefaultWebSocketConfig(),
+		proxyHops:   1,
 	}
+	s.broadcaster = newBroadcaster(defaultBroadcastInterval, s.broadcastLeaderboards)
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.upgrader = s.newUpgrader()
+	quizService.OnAnswerRecorded(s.handleAnswerRecorded)
+	quizService.OnQuizTransition(s.handleQuizTransition)
 	s.Router.HandleFunc("/ws", s.handleWebSocket)
 	s.Router.HandleFunc("/leaderboard", s.handleGetLeaderboard).Methods("GET")
+	s.Router.HandleFunc("/leaderboard/global", s.handleGetGlobalLeaderboard).Methods("GET")
+	s.Router.HandleFunc("/leaderboard/stream", s.handleLeaderboardStream).Methods("GET")
+	s.Router.HandleFunc("/answers", s.handleSubmitAnswer).Methods("POST")
+	s.Router.HandleFunc("/join", s.handleJoin).Methods("POST")
+	s.Router.HandleFunc("/quizzes/import", s.requireHostKey(s.handleImportQuiz)).Methods("POST")
+	s.Router.HandleFunc("/quizzes/{id}/export", s.handleExportQuiz).Methods("GET")
+	s.Router.HandleFunc("/quizzes/{id}/participants", s.handleRegisterParticipant).Methods("POST")
+	s.Router.HandleFunc("/quizzes/{id}/pin", s.requireHostKey(s.handleGetJoinPIN)).Methods("POST")
+	s.Router.HandleFunc("/quizzes/{id}/schedule", s.requireHostKey(s.handleScheduleQuiz)).Methods("PUT")
+	s.Router.HandleFunc("/quizzes/{id}/leaderboard", s.handleGetQuizLeaderboard).Methods("GET")
+	s.Router.HandleFunc("/quizzes/{id}/questions/{questionID}/open", s.requireHostKey(s.handleOpenQuestion)).Methods("POST")
+	s.Router.HandleFunc("/quizzes/{id}/questions/{questionID}/close", s.requireHostKey(s.handleCloseQuestion)).Methods("POST")
+	s.Router.HandleFunc("/quizzes/{id}/results.{format:csv|json}", s.handleExportResults).Methods("GET")
+	s.Router.HandleFunc("/quizzes/{id}/users/{userID}/results", s.handleGetUserResults).Methods("GET")
+	s.Router.HandleFunc("/quizzes/{id}/teams/leaderboard", s.handleGetTeamLeaderboard).Methods("GET")
+	s.Router.HandleFunc("/quizzes/{id}/presence", s.handleGetPresence).Methods("GET")
+	s.Router.HandleFunc("/users", s.handleRegisterUser).Methods("POST")
+	s.Router.HandleFunc("/users/{userID}", s.handleGetUser).Methods("GET")
+	s.Router.HandleFunc("/users/{userID}", s.handleUpdateUser).Methods("PATCH")
+	s.Router.HandleFunc("/users/{userID}/history", s.handleGetUserHistory).Methods("GET")
 	return s
 }
 
+// requireHostKey only lets requests for host actions through to next when
+// they present the host key in the X-Host-Key header.
+func (s *Server) requireHostKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.isHostKey(r.Header.Get("X-Host-Key")) {
+			writeError(w, r, apperrors.ErrInvalidHostKey)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// parsePagination reads the page and page_size query parameters, falling
+// back to the defaults when they are missing or out of range.
+func parsePagination(r *http.Request) (int, int) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = defaultPage
+	}
+	pageSize, err := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		pageSize = defaultPageSize
+	}
+	return page, pageSize
+}
+
 func (s *Server) handleGetLeaderboard(w http.ResponseWriter, r *http.Request) {
 	quizID := r.URL.Query().Get("quiz_id")
 	if quizID == "" {
-		http.Error(w, "Missing quiz_id", http.StatusBadRequest)
+		writeError(w, r, apperrors.InvalidRequest("missing quiz_id"))
+		return
+	}
+	if result := allow(r.Context(), s.rateLimiters.Leaderboard, s.ipKey(r)); !result.Allowed {
+		writeTooManyRequests(w, result)
 		return
 	}
 
-	// Parse pagination parameters
-	pageStr := r.URL.Query().Get("page")
-	pageSizeStr := r.URL.Query().Get("page_size")
-	page, err := strconv.Atoi(pageStr)
+	page, pageSize := parsePagination(r)
+	leaderboard, err := s.quizService.GetLeaderboard(r.Context(), quizID, page, pageSize)
 	if err != nil {
-		log.Printf("Invalid page number: %v", err)
-		http.Error(w, "Invalid page", http.StatusBadRequest)
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, leaderboard)
+}
+
+// handleGetQuizLeaderboard returns the quiz's current leaderboard or, with
+// after_question=N, the standings as they were when its Nth question
+// closed.
+func (s *Server) handleGetQuizLeaderboard(w http.ResponseWriter, r *http.Request) {
+	afterQuestion := r.URL.Query().Get("after_question")
+	questionNumber, err := strconv.Atoi(afterQuestion)
+	if afterQuestion != "" && (err != nil || questionNumber < 1) {
+		writeError(w, r, apperrors.InvalidRequest("after_question should be a question number from 1"))
 		return
 	}
-	if page < 1 {
-		http.Error(w, "Page should be greater than 0", http.StatusBadRequest)
+	if result := allow(r.Context(), s.rateLimiters.Leaderboard, s.ipKey(r)); !result.Allowed {
+		writeTooManyRequests(w, result)
 		return
 	}
-	pageSize, err := strconv.Atoi(pageSizeStr)
+
+	quizID := mux.Vars(r)["id"]
+	page, pageSize := parsePagination(r)
+	var leaderboard interface{}
+	if afterQuestion == "" {
+		leaderboard, err = s.quizService.GetLeaderboard(r.Context(), quizID, page, pageSize)
+	} else {
+		leaderboard, err = s.quizService.GetLeaderboardSnapshot(r.Context(), quizID, questionNumber, page, pageSize)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, leaderboard)
+}
+
+func (s *Server) handleGetGlobalLeaderboard(w http.ResponseWriter, r *http.Request) {
+	period, err := services.ParsePeriod(r.URL.Query().Get("period"))
 	if err != nil {
-		log.Printf("Invalid page size number: %v", err)
-		http.Error(w, "Invalid page size", http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
-	if pageSize < 1 || pageSize > 100 {
-		http.Error(w, "Page size should be between 1 and 100", http.StatusBadRequest)
+	if result := allow(r.Context(), s.rateLimiters.Leaderboard, s.ipKey(r)); !result.Allowed {
+		writeTooManyRequests(w, result)
 		return
 	}
 
-	leaderboard, err := s.quizService.GetLeaderboard(quizID, page, pageSize)
+	page, pageSize := parsePagination(r)
+	leaderboard, err := s.quizService.GetGlobalLeaderboard(r.Context(), period, r.URL.Query().Get("bucket"), page, pageSize)
 	if err != nil {
-		log.Printf("Error fetching leaderboard: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
+	writeJSON(w, leaderboard)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(leaderboard); err != nil {
-		log.Printf("Error encoding leaderboard: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+func (s *Server) handleGetTeamLeaderboard(w http.ResponseWriter, r *http.Request) {
+	leaderboard, err := s.quizService.GetTeamLeaderboard(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
+	writeJSON(w, leaderboard)
 }
 
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	quizID := r.URL.Query().Get("quiz_id")
 	userID := r.URL.Query().Get("user_id")
-	if quizID == "" || userID == "" {
-		http.Error(w, "Missing quiz_id or user_id", http.StatusBadRequest)
+	// Hosts are sent the join PIN and who comes and goes, so they must
+	// prove they are one
+	host := r.URL.Query().Get("role") == "host"
+	if host && !s.isHostKey(r.URL.Query().Get("host_key")) {
+		writeError(w, r, apperrors.ErrInvalidHostKey)
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Reconnecting clients identify themselves with their resume token
+	var session *services.Session
+	var lastSeq int64
+	if token := r.URL.Query().Get("resume_token"); token != "" {
+		var err error
+		session, err = s.quizService.ResumeSession(r.Context(), token)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if quizID != "" && quizID != session.QuizID || userID != "" && userID != session.UserID {
+			writeError(w, r, apperrors.ErrInvalidResumeToken)
+			return
+		}
+		quizID, userID = session.QuizID, session.UserID
+
+		lastSeq, err = strconv.ParseInt(r.URL.Query().Get("last_seq"), 10, 64)
+		if err != nil || lastSeq < 0 {
+			lastSeq = 0
+		}
+	}
+
+	// Players without an account join with a nickname instead, as a guest
+	nickname := r.URL.Query().Get("nickname")
+	if quizID == "" || userID == "" && nickname == "" {
+		writeError(w, r, apperrors.InvalidRequest("missing quiz_id, or user_id or nickname"))
+		return
+	}
+	if !s.hasSubprotocol(r) {
+		writeError(w, r, apperrors.InvalidRequest("unsupported or missing subprotocol"))
+		return
+	}
+	if result := s.allowClient(r.Context(), r, userID, s.rateLimiters.ConnectsPerIP, s.rateLimiters.Connects); !result.Allowed {
+		writeTooManyRequests(w, result)
+		return
+	}
+	if userID == "" {
+		guest, err := s.quizService.JoinAsGuest(r.Context(), quizID, nickname)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		userID = guest.ID
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	defer conn.Close()
+	// The request's context is cancelled once the connection closes and
+	// this handler returns.
+	ctx := r.Context()
+	if err := s.configureConn(conn); err != nil {
+		log.Println(err)
+		return
+	}
 
 	s.mutex.Lock()
 	if s.clients[quizID] == nil {
-		s.clients[quizID] = make(map[*websocket.Conn]bool)
+		s.clients[quizID] = make(map[*websocket.Conn]*client)
 	}
-	s.clients[quizID][conn] = true
+	s.clients[quizID][conn] = &client{userID: userID, host: host}
 	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.clients[quizID], conn)
+		s.forgetRanks(quizID)
+		s.mutex.Unlock()
+	}()
 
-	// Send initial leaderboard
-	leaderboard, err := s.quizService.GetLeaderboard(quizID, 1, 1000) // Large page size to get all
-	if err != nil {
-		log.Println(err)
-		return
+	if !host {
+		s.trackPresence(ctx, conn, quizID, userID)
+		defer s.untrackPresence(ctx, conn, quizID, userID)
+		go s.heartbeat(ctx, quizID, userID)
 	}
-	if err := conn.WriteJSON(leaderboard); err != nil {
+	if err := s.sendWelcome(ctx, conn, session, quizID, userID, host, lastSeq); err != nil {
 		log.Println(err)
 		return
 	}
 
 	for {
-		var msg struct {
-			QuestionID string `json:"question_id"`
-			Answer     string `json:"answer"`
-		}
-		if err := conn.ReadJSON(&msg); err != nil {
-			s.mutex.Lock()
-			delete(s.clients[quizID], conn)
-			s.mutex.Unlock()
+		var msg clientMessage
+		if err := readMessage(conn, &msg); err != nil {
 			return
 		}
 
-		if err := s.quizService.ProcessAnswer(quizID, userID, msg.QuestionID, msg.Answer); err != nil {
-			log.Println(err)
-			continue
+		switch msg.Type {
+		case "", messageTypeAnswer:
+			if result := s.allowClient(ctx, r, userID, s.rateLimiters.AnswersPerIP, s.rateLimiters.Answers); !result.Allowed {
+				err := s.send(conn, errorMessage{
+					header:       header{Type: messageTypeError},
+					Code:         apperrors.ErrRateLimited.Code,
+					Message:      "too many answers, slow down",
+					RetryAfterMs: result.RetryAfter.Milliseconds(),
+				})
+				if err != nil {
+					log.Println(err)
+				}
+				continue
+			}
+			s.handleAnswer(ctx, conn, quizID, userID, msg)
+		case messageTypeJoinTeam:
+			s.handleJoinTeam(ctx, conn, quizID, userID, msg)
+		default:
+			s.sendError(conn, apperrors.ErrUnknownMessageType)
 		}
+	}
+}
+
+// sendWelcome sends the initial leaderboard and player count along with
+// the resume token. Clients resuming a session also get the current quiz
+// state, their answers and the events they missed since lastSeq.
+func (s *Server) sendWelcome(ctx context.Context, conn *websocket.Conn, session *services.Session, quizID, userID string, host bool, lastSeq int64) error {
+	welcome := welcomeMessage{header: header{Type: messageTypeWelcome}, UserID: userID}
 
-		updatedLeaderboard, err := s.quizService.GetLeaderboard(quizID, 1, 1000) // Large page size
+	var err error
+	if host {
+		welcome.PIN, err = s.quizService.JoinPIN(ctx, quizID)
 		if err != nil {
-			log.Println(err)
-			continue
+			return err
+		}
+	}
+	if session != nil {
+		welcome.Resume, err = s.quizService.GetResumeState(ctx, quizID, userID, lastSeq)
+		if err != nil {
+			return err
+		}
+	} else {
+		session, err = s.quizService.CreateSession(ctx, quizID, userID)
+		if err != nil {
+			return err
 		}
+	}
+	welcome.ResumeToken = session.Token
 
-		s.mutex.Lock()
-		for client := range s.clients[quizID] {
-			if err := client.WriteJSON(updatedLeaderboard); err != nil {
-				log.Println(err)
-				delete(s.clients[quizID], client)
-				client.Close()
-			}
+	welcome.Countdown, err = s.quizService.GetCountdown(ctx, quizID)
+	if err != nil {
+		return err
+	}
+	welcome.LastSeq, err = s.quizService.LastEventSeq(ctx, quizID)
+	if err != nil {
+		return err
+	}
+	welcome.PaginatedLeaderboard, err = s.quizService.GetLeaderboard(ctx, quizID, 1, 1000) // Large page size to get all
+	if err != nil {
+		return err
+	}
+	presence, err := s.quizService.GetPresence(ctx, quizID)
+	if err != nil {
+		return err
+	}
+	welcome.PlayerCount = presence.Count
+	return s.send(conn, welcome)
+}
+
+// handleAnswer records an answer. The leaderboards are broadcast by
+// handleAnswerRecorded once the answer is committed.
+func (s *Server) handleAnswer(ctx context.Context, conn *websocket.Conn, quizID, userID string, msg clientMessage) {
+	if err := s.quizService.ProcessAnswer(ctx, quizID, userID, msg.QuestionID, msg.Answer); err != nil {
+		s.sendError(conn, err)
+	}
+}
+
+// handleAnswerRecorded schedules a broadcast of the quiz's leaderboards.
+// Bursts of answers share a single broadcast.
+func (s *Server) handleAnswerRecorded(ctx context.Context, answer *models.AnswerRecord) {
+	s.broadcaster.markDirty(answer.QuizID)
+}
+
+func (s *Server) handleJoinTeam(ctx context.Context, conn *websocket.Conn, quizID, userID string, msg clientMessage) {
+	team, err := s.quizService.JoinTeam(ctx, quizID, userID, msg.TeamName)
+	if err != nil {
+		s.sendError(conn, err)
+		return
+	}
+
+	if err := s.send(conn, teamJoinedMessage{header: header{Type: messageTypeTeamJoined}, Team: team}); err != nil {
+		log.Println(err)
+	}
+	s.broadcastTeamLeaderboard(ctx, quizID)
+}
+
+// broadcastLeaderboards pushes the individual leaderboard, and the team
+// leaderboard when the quiz has teams, to every client of the quiz, and
+// tells players whose rank changed. Broadcasts go ahead even if the
+// request that triggered them is cancelled, so that the other clients
+// don't miss the update.
+func (s *Server) broadcastLeaderboards(ctx context.Context, quizID string) {
+	ctx = context.WithoutCancel(ctx)
+	leaderboard, err := s.quizService.GetLeaderboard(ctx, quizID, 1, 1000) // Large page size
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	s.broadcast(ctx, quizID, &leaderboardMessage{header: header{Type: messageTypeLeaderboard}, PaginatedLeaderboard: leaderboard})
+	s.notifyRankChanges(ctx, quizID, leaderboard.Leaderboard)
+	s.broadcastTeamLeaderboard(ctx, quizID)
+}
+
+func (s *Server) broadcastTeamLeaderboard(ctx context.Context, quizID string) {
+	ctx = context.WithoutCancel(ctx)
+	teamLeaderboard, err := s.quizService.GetTeamLeaderboard(ctx, quizID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(teamLeaderboard.Leaderboard) > 0 {
+		s.broadcast(ctx, quizID, &teamLeaderboardMessage{header: header{Type: messageTypeTeamLeaderboard}, TeamLeaderboard: teamLeaderboard})
+	}
+}
+
+// broadcast records the event in the quiz's event log and sends it to
+// every client and event stream of the quiz. The quiz's broadcasts are
+// made one at a time, so that clients receive events in sequence order.
+func (s *Server) broadcast(ctx context.Context, quizID string, e event) {
+	lock, _ := s.eventLocks.LoadOrStore(quizID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	data, err := s.quizService.AppendEvent(context.WithoutCancel(ctx), quizID, func(seq int64) ([]byte, error) {
+		e.setSeq(seq)
+		return json.Marshal(e)
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fanOut(quizID, data, nil)
+	for events := range s.streams[quizID] {
+		select {
+		case events <- data:
+		default:
+			delete(s.streams[quizID], events)
+			close(events)
 		}
-		s.mutex.Unlock()
 	}
 }
+
+// notify sends a message that isn't kept in the event log to the quiz's
+// clients accepted by filter, or to all of them when filter is nil.
+func (s *Server) notify(quizID string, v interface{}, filter func(*websocket.Conn, *client) bool) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.fanOut(quizID, data, filter)
+}
+
+// fanOut writes a JSON message to the quiz's clients accepted by filter,
+// or to all of them when filter is nil, closing the connections that fail.
+// The message is converted once per codec in use and sent as a prepared
+// message, which is compressed at most once per compression setting
+// however many clients receive it. The caller must hold s.mutex.
+func (s *Server) fanOut(quizID string, data []byte, filter func(*websocket.Conn, *client) bool) {
+	prepared := make(map[messageCodec]*websocket.PreparedMessage)
+	for conn, c := range s.clients[quizID] {
+		if filter != nil && !filter(conn, c) {
+			continue
+		}
+		codec := codecFor(conn.Subprotocol())
+		msg, ok := prepared[codec]
+		if !ok {
+			msg = prepareMessage(codec, data)
+			prepared[codec] = msg
+		}
+		if msg == nil {
+			continue
+		}
+		if err := conn.WritePreparedMessage(msg); err != nil {
+			log.Println(err)
+			delete(s.clients[quizID], conn)
+			conn.Close()
+		}
+	}
+}
+
+// prepareMessage converts a JSON message to the codec's encoding, or
+// returns nil if it can't be converted.
+func prepareMessage(codec messageCodec, data []byte) *websocket.PreparedMessage {
+	encoded, err := codec.Encode(data)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	msg, err := websocket.NewPreparedMessage(codec.MessageType(), encoded)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return msg
+}
+
+// send writes to a single client in its codec. Writes share the broadcast
+// lock because a connection supports only one concurrent writer.
+func (s *Server) send(conn *websocket.Conn, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return writeMessage(conn, data)
+}
+
+// readMessage reads the client's next message in its codec into v.
+func readMessage(conn *websocket.Conn, v interface{}) error {
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if data, err = codecFor(conn.Subprotocol()).Decode(data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
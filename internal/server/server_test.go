@@ -1,30 +1,83 @@
 package server
 
 import (
+	"bufio"
+	"compress/flate"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"realtime_leaderboard/internal/apperrors"
 	"realtime_leaderboard/internal/models"
+	"realtime_leaderboard/internal/ratelimit"
 	"realtime_leaderboard/internal/services"
 )
 
 type mockQuizService struct {
 	leaderboard []models.LeaderboardEntry
+	answers     []models.AnswerRecord
+	teams       map[string]string // userID -> team name
+	started     bool
+
+	mu       sync.Mutex
+	sessions map[string]*services.Session
+	events   [][]byte
+	active   *services.ActiveQuestion
+	online   map[string]int // userID -> open connections
+
+	answerHandlers     []services.AnswerHandler
+	transitionHandlers []services.QuizTransitionHandler
+	countdown          *services.Countdown
+	// participants restricts who may answer when set.
+	participants map[string]bool
+	users        map[string]*models.User
+	// results replaces the rows of quiz1's results when set, and
+	// resultsErr fails the export after them.
+	results    []models.ResultRow
+	resultsErr error
 }
 
-func (m *mockQuizService) ProcessAnswer(quizID, userID, questionID, answer string) error {
-	if answer == "Soap" && len(m.leaderboard) > 0 {
+func (m *mockQuizService) ProcessAnswer(ctx context.Context, quizID, userID, questionID string, answer models.Answer) error {
+	m.mu.Lock()
+	participant := m.participants == nil || m.participants[userID]
+	m.mu.Unlock()
+	if !participant {
+		return apperrors.ErrNotParticipant
+	}
+	if len(answer) == 1 && answer[0] == "Soap" && len(m.leaderboard) > 0 {
 		m.leaderboard[0].Score++
 	}
+	for _, handler := range m.answerHandlers {
+		handler(ctx, &models.AnswerRecord{QuizID: quizID, UserID: userID, QuestionID: questionID, Answer: answer})
+	}
+	return nil
+}
+
+func (m *mockQuizService) RegisterParticipant(ctx context.Context, quizID, userID string) error {
+	if quizID != "quiz1" {
+		return apperrors.ErrQuizNotFound
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.participants[userID] = true
 	return nil
 }
 
-func (m *mockQuizService) GetLeaderboard(quizID string, page, pageSize int) (services.PaginatedLeaderboard, error) {
+func (m *mockQuizService) OnAnswerRecorded(handler services.AnswerHandler) {
+	m.answerHandlers = append(m.answerHandlers, handler)
+}
+
+func (m *mockQuizService) GetLeaderboard(ctx context.Context, quizID string, page, pageSize int) (*services.PaginatedLeaderboard, error) {
 	start := (page - 1) * pageSize
 	if start < 0 {
 		start = 0
@@ -39,7 +92,7 @@ func (m *mockQuizService) GetLeaderboard(quizID string, page, pageSize int) (ser
 	} else {
 		paged = []models.LeaderboardEntry{}
 	}
-	return services.PaginatedLeaderboard{
+	return &services.PaginatedLeaderboard{
 		Leaderboard: paged,
 		TotalCount:  len(m.leaderboard),
 		Page:        page,
@@ -47,6 +100,384 @@ func (m *mockQuizService) GetLeaderboard(quizID string, page, pageSize int) (ser
 	}, nil
 }
 
+func (m *mockQuizService) GetRanks(ctx context.Context, quizID string, userIDs []string) (map[string]int, error) {
+	all := rankLeaderboard(m.leaderboard)
+	ranks := make(map[string]int)
+	for _, userID := range userIDs {
+		if rank, ok := all[userID]; ok {
+			ranks[userID] = rank
+		}
+	}
+	return ranks, nil
+}
+
+func (m *mockQuizService) OpenQuestion(ctx context.Context, quizID, questionID string) (*services.ActiveQuestion, error) {
+	if questionID != "q1" {
+		return nil, apperrors.ErrQuestionNotInQuiz
+	}
+	remaining := int64(20000)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active = &services.ActiveQuestion{
+		Question:    models.QuestionView{ID: questionID, QuizID: quizID, QuestionText: "What cleans best?", TimeLimitSeconds: 20},
+		OpenedAt:    time.Now(),
+		RemainingMs: &remaining,
+	}
+	return m.active, nil
+}
+
+func (m *mockQuizService) CloseQuestion(ctx context.Context, quizID, questionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active == nil || m.active.Question.ID != questionID || *m.active.RemainingMs == 0 {
+		return apperrors.ErrQuestionClosed
+	}
+	var remaining int64
+	m.active.RemainingMs = &remaining
+	return nil
+}
+
+// GetLeaderboardSnapshot has a single snapshot, of the current leaderboard.
+func (m *mockQuizService) GetLeaderboardSnapshot(ctx context.Context, quizID string, questionNumber, page, pageSize int) (*services.HistoricalLeaderboard, error) {
+	if questionNumber != 1 {
+		return nil, apperrors.ErrSnapshotNotFound
+	}
+	leaderboard, err := m.GetLeaderboard(ctx, quizID, page, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return &services.HistoricalLeaderboard{
+		LeaderboardSnapshot:  models.LeaderboardSnapshot{QuizID: quizID, QuestionNumber: questionNumber, QuestionID: "q1"},
+		PaginatedLeaderboard: *leaderboard,
+	}, nil
+}
+
+func (m *mockQuizService) GetUserResults(ctx context.Context, quizID, userID string) (*services.QuizResult, error) {
+	result := &services.QuizResult{QuizID: quizID, UserID: userID, Answers: []models.AnswerRecord{}}
+	for _, a := range m.answers {
+		if a.QuizID == quizID && a.UserID == userID {
+			result.Score += a.Points
+			result.Answers = append(result.Answers, a)
+		}
+	}
+	return result, nil
+}
+
+func (m *mockQuizService) GetUserHistory(ctx context.Context, userID string, page, pageSize int) (*services.PaginatedHistory, error) {
+	history := &services.PaginatedHistory{History: []models.AnswerRecord{}, Page: page, PageSize: pageSize}
+	for _, a := range m.answers {
+		if a.UserID == userID {
+			history.History = append(history.History, a)
+		}
+	}
+	history.TotalCount = len(history.History)
+	return history, nil
+}
+
+func (m *mockQuizService) GetGlobalLeaderboard(ctx context.Context, period services.Period, bucket string, page, pageSize int) (*services.GlobalLeaderboard, error) {
+	leaderboard, err := m.GetLeaderboard(ctx, "", page, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return &services.GlobalLeaderboard{Period: period, Bucket: bucket, PaginatedLeaderboard: *leaderboard}, nil
+}
+
+func (m *mockQuizService) JoinTeam(ctx context.Context, quizID, userID, teamName string) (*models.Team, error) {
+	if m.started {
+		return nil, apperrors.ErrQuizStarted
+	}
+	if m.teams == nil {
+		m.teams = make(map[string]string)
+	}
+	m.teams[userID] = teamName
+	return &models.Team{ID: "team-" + teamName, QuizID: quizID, Name: teamName}, nil
+}
+
+func (m *mockQuizService) GetTeamLeaderboard(ctx context.Context, quizID string) (*services.TeamLeaderboard, error) {
+	members := make(map[string]int)
+	for _, name := range m.teams {
+		members[name]++
+	}
+	result := &services.TeamLeaderboard{QuizID: quizID, Leaderboard: []models.TeamLeaderboardEntry{}}
+	for name, count := range members {
+		result.Leaderboard = append(result.Leaderboard, models.TeamLeaderboardEntry{TeamID: "team-" + name, Name: name, Members: count})
+	}
+	return result, nil
+}
+
+func (m *mockQuizService) CreateSession(ctx context.Context, quizID, userID string) (*services.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions == nil {
+		m.sessions = make(map[string]*services.Session)
+	}
+	session := &services.Session{Token: fmt.Sprintf("token-%d", len(m.sessions)+1), QuizID: quizID, UserID: userID}
+	m.sessions[session.Token] = session
+	return session, nil
+}
+
+func (m *mockQuizService) ResumeSession(ctx context.Context, token string) (*services.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[token]
+	if !ok {
+		return nil, apperrors.ErrInvalidResumeToken
+	}
+	return session, nil
+}
+
+func (m *mockQuizService) GetResumeState(ctx context.Context, quizID, userID string, lastSeq int64) (*services.ResumeState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := &services.ResumeState{QuizState: services.QuizStateLobby, Answers: []models.AnswerRecord{}, EventsComplete: true}
+	if m.active != nil {
+		state.QuizState = services.QuizStateQuestionOpen
+		state.ActiveQuestion = m.active
+	}
+	for _, a := range m.answers {
+		if a.QuizID == quizID && a.UserID == userID {
+			state.Answers = append(state.Answers, a)
+		}
+	}
+	for _, e := range m.events[lastSeq:] {
+		state.MissedEvents = append(state.MissedEvents, e)
+	}
+	return state, nil
+}
+
+func (m *mockQuizService) AppendEvent(ctx context.Context, quizID string, encode func(seq int64) ([]byte, error)) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := encode(int64(len(m.events) + 1))
+	if err != nil {
+		return nil, err
+	}
+	m.events = append(m.events, data)
+	return data, nil
+}
+
+func (m *mockQuizService) LastEventSeq(ctx context.Context, quizID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.events)), nil
+}
+
+func (m *mockQuizService) GetEventsSince(ctx context.Context, quizID string, seq int64) ([]json.RawMessage, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := []json.RawMessage{}
+	if seq > int64(len(m.events)) {
+		return events, false, nil
+	}
+	for _, e := range m.events[seq:] {
+		events = append(events, e)
+	}
+	return events, true, nil
+}
+
+func (m *mockQuizService) JoinPresence(ctx context.Context, quizID, userID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.online == nil {
+		m.online = make(map[string]int)
+	}
+	m.online[userID]++
+	return m.online[userID] == 1, nil
+}
+
+func (m *mockQuizService) LeavePresence(ctx context.Context, quizID, userID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.online[userID]--
+	if m.online[userID] > 0 {
+		return false, nil
+	}
+	delete(m.online, userID)
+	return true, nil
+}
+
+func (m *mockQuizService) HeartbeatPresence(ctx context.Context, quizID, userID string) error {
+	return nil
+}
+
+func (m *mockQuizService) GetPresence(ctx context.Context, quizID string) (*services.Presence, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	presence := &services.Presence{QuizID: quizID, Players: []services.PresenceEntry{}}
+	for userID := range m.online {
+		presence.Players = append(presence.Players, services.PresenceEntry{UserID: userID})
+	}
+	presence.Count = len(presence.Players)
+	return presence, nil
+}
+
+func (m *mockQuizService) RegisterUser(ctx context.Context, req services.NewUser) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Username == req.Username {
+			return nil, apperrors.ErrUsernameTaken
+		}
+	}
+	user := &models.User{ID: fmt.Sprintf("user%d", len(m.users)+1), Username: req.Username, DisplayName: req.DisplayName, AvatarURL: req.AvatarURL}
+	m.users[user.ID] = user
+	return user, nil
+}
+
+func (m *mockQuizService) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, apperrors.ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (m *mockQuizService) UpdateProfile(ctx context.Context, userID string, update services.ProfileUpdate) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, apperrors.ErrUserNotFound
+	}
+	if update.DisplayName != nil {
+		user.DisplayName = *update.DisplayName
+	}
+	if update.AvatarURL != nil {
+		user.AvatarURL = *update.AvatarURL
+	}
+	return user, nil
+}
+
+func (m *mockQuizService) GetActiveQuestion(ctx context.Context, quizID string) (*services.ActiveQuestion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active, nil
+}
+
+func (m *mockQuizService) ScheduleQuiz(ctx context.Context, quizID string, startsAt time.Time, lobbyLead time.Duration) (*models.QuizSchedule, error) {
+	if quizID != "quiz1" {
+		return nil, apperrors.ErrQuizNotFound
+	}
+	lobbyOpensAt := startsAt.Add(-lobbyLead)
+	return &models.QuizSchedule{QuizID: quizID, StartsAt: startsAt, Status: models.ScheduleStatusScheduled, NextTransitionAt: &lobbyOpensAt}, nil
+}
+
+func (m *mockQuizService) GetCountdown(ctx context.Context, quizID string) (*services.Countdown, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.countdown, nil
+}
+
+func (m *mockQuizService) OnQuizTransition(handler services.QuizTransitionHandler) {
+	m.transitionHandlers = append(m.transitionHandlers, handler)
+}
+
+func (m *mockQuizService) ImportQuiz(ctx context.Context, doc *services.QuizDocument) (*services.QuizDocument, error) {
+	if doc.Quiz.Title == "" {
+		return nil, apperrors.ErrInvalidQuiz.WithDetails([]services.RowError{{Field: "title", Message: "should be 1 to 200 characters"}})
+	}
+	doc.Quiz.ID = "quiz2"
+	return doc, nil
+}
+
+func (m *mockQuizService) ImportQuizCSV(ctx context.Context, quiz models.Quiz, r io.Reader) (*services.QuizDocument, error) {
+	sheet, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	quiz.ID = "quiz2"
+	return &services.QuizDocument{Quiz: quiz, Questions: []models.Question{{QuestionText: string(sheet)}}}, nil
+}
+
+func (m *mockQuizService) ExportQuiz(ctx context.Context, quizID string) (*services.QuizDocument, error) {
+	if quizID != "quiz1" {
+		return nil, apperrors.ErrQuizNotFound
+	}
+	if m.started {
+		return nil, apperrors.ErrQuizInProgress
+	}
+	return &services.QuizDocument{
+		Quiz: models.Quiz{ID: quizID, Title: "Cleaning"},
+		Questions: []models.Question{{
+			ID: "q1", QuizID: quizID, Type: models.QuestionTypeSingleChoice, QuestionText: "What cleans best?", Points: 1,
+			Options: []models.QuestionOption{{ID: "q1-1", Position: 1, Text: "Water"}, {ID: "q1-2", Position: 2, Text: "Soap", IsCorrect: true}},
+		}},
+	}, nil
+}
+
+func (m *mockQuizService) ExportResults(ctx context.Context, quizID string, w services.ResultsWriter) error {
+	if quizID != "quiz1" {
+		return apperrors.ErrQuizNotFound
+	}
+	err := w.WriteHeader([]models.Question{{ID: "q1", QuestionText: "What cleans best?"}, {ID: "q2", QuestionText: "How many?"}})
+	if err != nil {
+		return err
+	}
+	avg := 1500
+	rows := []models.ResultRow{
+		{Rank: 1, UserID: "user1", Username: "alice", Score: 3, CorrectCount: 2, AvgResponseTimeMs: &avg, QuestionPoints: map[string]int{"q1": 1, "q2": 2}},
+		{Rank: 2, UserID: "user2", Username: "bob", QuestionPoints: map[string]int{}},
+	}
+	if m.results != nil {
+		rows = m.results
+	}
+	for i := range rows {
+		if err := w.WriteRow(&rows[i]); err != nil {
+			return err
+		}
+	}
+	return m.resultsErr
+}
+
+// testHostKey is the host key of servers tested with host actions.
+const testHostKey = "secret"
+
+// newHostRequest is a request for a host action, presenting testHostKey.
+func newHostRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("X-Host-Key", testHostKey)
+	return req
+}
+
+// mockPIN is quiz1's join PIN.
+const mockPIN = "123456"
+
+func (m *mockQuizService) JoinPIN(ctx context.Context, quizID string) (string, error) {
+	if quizID != "quiz1" {
+		return "", apperrors.ErrQuizNotFound
+	}
+	return mockPIN, nil
+}
+
+func (m *mockQuizService) JoinByPIN(ctx context.Context, pin, userID, nickname string) (*services.Session, error) {
+	if pin != mockPIN {
+		return nil, apperrors.ErrPINNotFound
+	}
+	if userID == "" {
+		guest, err := m.JoinAsGuest(ctx, "quiz1", nickname)
+		if err != nil {
+			return nil, err
+		}
+		userID = guest.ID
+	}
+	return m.CreateSession(ctx, "quiz1", userID)
+}
+
+func (m *mockQuizService) JoinAsGuest(ctx context.Context, quizID, nickname string) (*models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user := &models.User{ID: "guest1", Username: nickname + "#0001", DisplayName: nickname, Guest: true}
+	if m.users != nil {
+		m.users[user.ID] = user
+	}
+	if m.participants != nil {
+		m.participants[user.ID] = true
+	}
+	return user, nil
+}
+
 func TestHandleWebSocket(t *testing.T) {
 	quizService := &mockQuizService{
 		leaderboard: []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}},
@@ -133,7 +564,9 @@ func TestHandleGetLeaderboard(t *testing.T) {
 	resp = httptest.NewRecorder()
 	server.Router.ServeHTTP(resp, req)
 	assert.Equal(t, http.StatusBadRequest, resp.Code)
-	assert.Contains(t, resp.Body.String(), "Missing quiz_id")
+	var errResp errorResponse
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Equal(t, "invalid_request", errResp.Error.Code)
 
 	// Test invalid page
 	req, err = http.NewRequest("GET", s.URL+"/leaderboard?quiz_id=quiz1&page=-1&page_size=2", nil)
@@ -153,3 +586,1406 @@ func TestHandleGetLeaderboard(t *testing.T) {
 	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
 	assert.Equal(t, 10, result.PageSize)
 }
+
+func TestHandleResultsAndHistory(t *testing.T) {
+	quizService := &mockQuizService{
+		answers: []models.AnswerRecord{
+			{QuizID: "quiz1", QuestionID: "q1", UserID: "user1", Answer: models.Answer{"q1-2"}, Correct: true, Points: 1},
+			{QuizID: "quiz1", QuestionID: "q2", UserID: "user1", Answer: models.Answer{"5"}},
+			{QuizID: "quiz2", QuestionID: "q3", UserID: "user1", Answer: models.Answer{"q3-1"}, Correct: true, Points: 1},
+		},
+	}
+	server := NewServer(quizService, WithHostKey(testHostKey))
+
+	req := httptest.NewRequest("GET", "/quizzes/quiz1/users/user1/results", nil)
+	resp := httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var result services.QuizResult
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, 1, result.Score)
+	assert.Len(t, result.Answers, 2)
+	assert.Equal(t, "q2", result.Answers[1].QuestionID)
+	assert.False(t, result.Answers[1].Correct)
+
+	req = httptest.NewRequest("GET", "/users/user1/history?page=1&page_size=10", nil)
+	resp = httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var history services.PaginatedHistory
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&history))
+	assert.Equal(t, 3, history.TotalCount)
+	assert.Len(t, history.History, 3)
+
+	// Opening a question from another quiz is rejected
+	req = newHostRequest("POST", "/quizzes/quiz1/questions/q3/open", nil)
+	resp = httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	req = newHostRequest("POST", "/quizzes/quiz1/questions/q1/open", nil)
+	resp = httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var active services.ActiveQuestion
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&active))
+	assert.Equal(t, "q1", active.Question.ID)
+
+	req = newHostRequest("POST", "/quizzes/quiz1/questions/q1/close", nil)
+	resp = httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+
+	req = newHostRequest("POST", "/quizzes/quiz1/questions/q1/close", nil)
+	resp = httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+}
+
+func TestHandleGetGlobalLeaderboard(t *testing.T) {
+	quizService := &mockQuizService{
+		leaderboard: []models.LeaderboardEntry{
+			{UserID: "user1", Username: "Alice", Score: 10},
+			{UserID: "user2", Username: "Bob", Score: 5},
+		},
+	}
+	server := NewServer(quizService)
+
+	req := httptest.NewRequest("GET", "/leaderboard/global?period=weekly&bucket=2024-W05", nil)
+	resp := httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var result services.GlobalLeaderboard
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, services.PeriodWeekly, result.Period)
+	assert.Equal(t, "2024-W05", result.Bucket)
+	assert.Len(t, result.Leaderboard, 2)
+	assert.Equal(t, 2, result.TotalCount)
+
+	// Missing period defaults to all-time
+	req = httptest.NewRequest("GET", "/leaderboard/global", nil)
+	resp = httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, services.PeriodAllTime, result.Period)
+
+	req = httptest.NewRequest("GET", "/leaderboard/global?period=hourly", nil)
+	resp = httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestHandleGetQuizLeaderboard(t *testing.T) {
+	quizService := &mockQuizService{
+		leaderboard: []models.LeaderboardEntry{
+			{UserID: "user1", Username: "Alice", Score: 10, Rank: 1},
+			{UserID: "user2", Username: "Bob", Score: 5, Rank: 2},
+		},
+	}
+	server := NewServer(quizService)
+
+	req := httptest.NewRequest("GET", "/quizzes/quiz1/leaderboard?after_question=1&page_size=1", nil)
+	resp := httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var snapshot services.HistoricalLeaderboard
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&snapshot))
+	assert.Equal(t, 1, snapshot.QuestionNumber)
+	assert.Equal(t, "q1", snapshot.QuestionID)
+	assert.Equal(t, []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 10, Rank: 1}}, snapshot.Leaderboard)
+	assert.Equal(t, 2, snapshot.TotalCount)
+
+	// Without after_question the current leaderboard is returned
+	req = httptest.NewRequest("GET", "/quizzes/quiz1/leaderboard", nil)
+	resp = httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var current services.PaginatedLeaderboard
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&current))
+	assert.Len(t, current.Leaderboard, 2)
+
+	req = httptest.NewRequest("GET", "/quizzes/quiz1/leaderboard?after_question=2", nil)
+	resp = httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	req = httptest.NewRequest("GET", "/quizzes/quiz1/leaderboard?after_question=0", nil)
+	resp = httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestHandleWebSocket_JoinTeam(t *testing.T) {
+	quizService := &mockQuizService{}
+	server := NewServer(quizService)
+
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?quiz_id=quiz1&user_id=user1"
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+
+	// Initial leaderboard
+	var welcome welcomeMessage
+	assert.NoError(t, ws.ReadJSON(&welcome))
+	assert.Equal(t, messageTypeWelcome, welcome.Type)
+
+	assert.NoError(t, ws.WriteJSON(map[string]string{"type": messageTypeJoinTeam, "team_name": "Red"}))
+
+	var joined struct {
+		Type string      `json:"type"`
+		Team models.Team `json:"team"`
+	}
+	assert.NoError(t, ws.ReadJSON(&joined))
+	assert.Equal(t, messageTypeTeamJoined, joined.Type)
+	assert.Equal(t, "Red", joined.Team.Name)
+
+	var teams struct {
+		Type        string                        `json:"type"`
+		Leaderboard []models.TeamLeaderboardEntry `json:"leaderboard"`
+	}
+	assert.NoError(t, ws.ReadJSON(&teams))
+	assert.Equal(t, messageTypeTeamLeaderboard, teams.Type)
+	assert.Len(t, teams.Leaderboard, 1)
+	assert.Equal(t, 1, teams.Leaderboard[0].Members)
+
+	// Once the quiz has started teams are locked
+	quizService.started = true
+	assert.NoError(t, ws.WriteJSON(map[string]string{"type": messageTypeJoinTeam, "team_name": "Blue"}))
+	var errMsg errorMessage
+	assert.NoError(t, ws.ReadJSON(&errMsg))
+	assert.Equal(t, messageTypeError, errMsg.Type)
+}
+
+// denyingLimiter rejects every key in deny.
+type denyingLimiter struct {
+	deny map[string]bool
+}
+
+func (l *denyingLimiter) Allow(ctx context.Context, key string) (ratelimit.Result, error) {
+	return l.Check(ctx, key)
+}
+
+func (l *denyingLimiter) Check(ctx context.Context, key string) (ratelimit.Result, error) {
+	if l.deny[key] {
+		return ratelimit.Result{RetryAfter: 1500 * time.Millisecond}, nil
+	}
+	return ratelimit.Result{Allowed: true}, nil
+}
+
+// burstLimiter allows burst requests per key, which are never refilled.
+type burstLimiter struct {
+	burst int
+	mu    sync.Mutex
+	taken map[string]int
+}
+
+func (l *burstLimiter) Allow(ctx context.Context, key string) (ratelimit.Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.taken[key] >= l.burst {
+		return ratelimit.Result{RetryAfter: time.Second}, nil
+	}
+	l.taken[key]++
+	return ratelimit.Result{Allowed: true}, nil
+}
+
+func (l *burstLimiter) Check(ctx context.Context, key string) (ratelimit.Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.taken[key] >= l.burst {
+		return ratelimit.Result{RetryAfter: time.Second}, nil
+	}
+	return ratelimit.Result{Allowed: true}, nil
+}
+
+func TestRateLimits(t *testing.T) {
+	quizService := &mockQuizService{
+		leaderboard: []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}},
+	}
+	server := NewServer(quizService, WithRateLimiters(RateLimiters{
+		Answers: &denyingLimiter{deny: map[string]bool{"user:user2": true}},
+		// Per-user limits don't count against the address players share
+		Connects:      &denyingLimiter{deny: map[string]bool{"user:blocked": true, "ip:127.0.0.1": true}},
+		ConnectsPerIP: &denyingLimiter{deny: map[string]bool{"ip:192.0.2.1": true}},
+		Leaderboard:   &denyingLimiter{deny: map[string]bool{"ip:192.0.2.1": true}},
+	}))
+
+	// Leaderboard requests are limited per IP
+	req := httptest.NewRequest("GET", "/leaderboard?quiz_id=quiz1&page=1&page_size=10", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	resp := httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "2", resp.Header().Get("Retry-After"))
+
+	req = httptest.NewRequest("GET", "/leaderboard?quiz_id=quiz1&page=1&page_size=10", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	resp = httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	// Connects are limited per IP as well as per user
+	req = httptest.NewRequest("GET", "/leaderboard/stream?quiz_id=quiz1&user_id=user1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	resp = httptest.NewRecorder()
+	server.Router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?quiz_id=quiz1&user_id="
+
+	_, wsResp, err := websocket.DefaultDialer.Dial(wsURL+"blocked", nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, wsResp.StatusCode)
+
+	// Answers over the limit are rejected with an error message
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL+"user2", nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+
+	var leaderboard leaderboardMessage
+	assert.NoError(t, ws.ReadJSON(&leaderboard))
+	assert.NoError(t, ws.WriteJSON(map[string]string{"question_id": "q1", "answer": "Soap"}))
+
+	var errMsg errorMessage
+	assert.NoError(t, ws.ReadJSON(&errMsg))
+	assert.Equal(t, messageTypeError, errMsg.Type)
+	assert.Equal(t, int64(1500), errMsg.RetryAfterMs)
+	assert.Equal(t, 1, quizService.leaderboard[0].Score)
+}
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{"no origin header", nil, "", true},
+		{"same origin by default", nil, "http://quiz.example.com", true},
+		{"cross origin rejected by default", nil, "https://evil.example.net", false},
+		{"listed origin", []string{"https://app.example.com"}, "https://app.example.com", true},
+		{"unlisted origin", []string{"https://app.example.com"}, "https://evil.example.net", false},
+		{"wildcard subdomain", []string{"https://*.example.com"}, "https://eu.example.com", true},
+		{"wildcard subdomain needs same scheme", []string{"https://*.example.com"}, "http://eu.example.com", false},
+		{"any origin", []string{"*"}, "https://evil.example.net", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(&mockQuizService{}, WithWebSocketConfig(WebSocketConfig{AllowedOrigins: tt.allowed}))
+			req := httptest.NewRequest("GET", "http://quiz.example.com/ws", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			assert.Equal(t, tt.want, server.checkOrigin(req))
+		})
+	}
+}
+
+func TestWebSocketHardening(t *testing.T) {
+	server := NewServer(&mockQuizService{}, WithWebSocketConfig(WebSocketConfig{
+		AllowedOrigins:     []string{"https://app.example.com"},
+		Subprotocols:       []string{"quiz.v1.json"},
+		RequireSubprotocol: true,
+		ReadLimit:          64,
+	}))
+
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?quiz_id=quiz1&user_id=user1"
+
+	// Cross-site connections are refused
+	dialer := websocket.Dialer{Subprotocols: []string{"quiz.v1.json"}}
+	_, resp, err := dialer.Dial(wsURL, http.Header{"Origin": {"https://evil.example.net"}})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Clients must ask for a supported subprotocol
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://app.example.com"}})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	ws, resp, err := dialer.Dial(wsURL, http.Header{"Origin": {"https://app.example.com"}})
+	assert.NoError(t, err)
+	defer ws.Close()
+	assert.Equal(t, "quiz.v1.json", resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	var leaderboard leaderboardMessage
+	assert.NoError(t, ws.ReadJSON(&leaderboard))
+
+	// Oversized messages close the connection
+	assert.NoError(t, ws.WriteJSON(map[string]string{"question_id": "q1", "answer": strings.Repeat("a", 100)}))
+	_, _, err = ws.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "unexpected error: %v", err)
+}
+
+func TestHandleWebSocket_Resume(t *testing.T) {
+	quizService := &mockQuizService{
+		leaderboard: []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}},
+		answers:     []models.AnswerRecord{{QuizID: "quiz1", QuestionID: "q0", UserID: "user1", Correct: true, Points: 1}},
+	}
+	server := NewServer(quizService, WithHostKey(testHostKey))
+
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL+"?quiz_id=quiz1&user_id=user1", nil)
+	assert.NoError(t, err)
+
+	var welcome welcomeMessage
+	assert.NoError(t, ws.ReadJSON(&welcome))
+	assert.NotEmpty(t, welcome.ResumeToken)
+	assert.Equal(t, int64(0), welcome.LastSeq)
+	assert.Nil(t, welcome.Resume)
+
+	// Broadcast events carry sequence numbers
+	assert.NoError(t, ws.WriteJSON(map[string]string{"question_id": "q1", "answer": "Soap"}))
+	var leaderboard leaderboardMessage
+	assert.NoError(t, ws.ReadJSON(&leaderboard))
+	assert.Equal(t, int64(1), leaderboard.Seq)
+	ws.Close()
+
+	// The question opens while the player is disconnected
+	req := newHostRequest("POST", "/quizzes/quiz1/questions/q1/open", nil)
+	server.Router.ServeHTTP(httptest.NewRecorder(), req)
+
+	ws, _, err = websocket.DefaultDialer.Dial(wsURL+"?resume_token="+welcome.ResumeToken+"&last_seq=1", nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+
+	var resumed welcomeMessage
+	assert.NoError(t, ws.ReadJSON(&resumed))
+	assert.Equal(t, welcome.ResumeToken, resumed.ResumeToken)
+	assert.Equal(t, int64(2), resumed.LastSeq)
+	if assert.NotNil(t, resumed.Resume) {
+		assert.Equal(t, services.QuizStateQuestionOpen, resumed.Resume.QuizState)
+		assert.Equal(t, "q1", resumed.Resume.ActiveQuestion.Question.ID)
+		assert.Equal(t, int64(20000), *resumed.Resume.ActiveQuestion.RemainingMs)
+		assert.Len(t, resumed.Resume.Answers, 1)
+		if assert.Len(t, resumed.Resume.MissedEvents, 1) {
+			var missed header
+			assert.NoError(t, json.Unmarshal(resumed.Resume.MissedEvents[0], &missed))
+			assert.Equal(t, header{Type: messageTypeQuestionOpened, Seq: 2}, missed)
+		}
+	}
+
+	// Unknown tokens and tokens for another user are refused
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"?resume_token=bogus", nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL+"?resume_token="+welcome.ResumeToken+"&user_id=user2", nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestHandleWebSocket_HostKey(t *testing.T) {
+	server := NewServer(&mockQuizService{}, WithHostKey("secret"))
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?quiz_id=quiz1&user_id=host1&role=host"
+
+	for _, query := range []string{"", "&host_key=guess"} {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL+query, nil)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	host, _, err := websocket.DefaultDialer.Dial(wsURL+"&host_key=secret", nil)
+	assert.NoError(t, err)
+	defer host.Close()
+	var welcome welcomeMessage
+	assert.NoError(t, host.ReadJSON(&welcome))
+	assert.Equal(t, mockPIN, welcome.PIN)
+
+	// Without a key configured, nobody can host
+	server = NewServer(&mockQuizService{})
+	unkeyed := httptest.NewServer(server.Router)
+	defer unkeyed.Close()
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(unkeyed.URL, "http")+"/ws?quiz_id=quiz1&user_id=host1&role=host&host_key=", nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestHostActions_HostKey(t *testing.T) {
+	server := NewServer(&mockQuizService{}, WithHostKey(testHostKey))
+	actions := []struct{ method, target, body string }{
+		{"POST", "/quizzes/import", `{"quiz":{"title":"Cleaning"},"questions":[]}`},
+		{"POST", "/quizzes/quiz1/pin", ""},
+		{"PUT", "/quizzes/quiz1/schedule", `{"starts_at":"2099-01-01T00:00:00Z"}`},
+		{"POST", "/quizzes/quiz1/questions/q1/open", ""},
+		{"POST", "/quizzes/quiz1/questions/q1/close", ""},
+	}
+	for _, action := range actions {
+		for _, key := range []string{"", "guess"} {
+			req := httptest.NewRequest(action.method, action.target, strings.NewReader(action.body))
+			if key != "" {
+				req.Header.Set("X-Host-Key", key)
+			}
+			rr := httptest.NewRecorder()
+			server.Router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusUnauthorized, rr.Code, "%s %s with key %q", action.method, action.target, key)
+			assert.Contains(t, rr.Body.String(), apperrors.ErrInvalidHostKey.Code)
+		}
+
+		rr := httptest.NewRecorder()
+		server.Router.ServeHTTP(rr, newHostRequest(action.method, action.target, strings.NewReader(action.body)))
+		assert.Less(t, rr.Code, 300, "%s %s", action.method, action.target)
+	}
+}
+func TestHandleWebSocket_Presence(t *testing.T) {
+	quizService := &mockQuizService{}
+	server := NewServer(quizService, WithHostKey("secret"))
+
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?quiz_id=quiz1"
+
+	host, _, err := websocket.DefaultDialer.Dial(wsURL+"&user_id=host1&role=host&host_key=secret", nil)
+	assert.NoError(t, err)
+	defer host.Close()
+	var welcome welcomeMessage
+	assert.NoError(t, host.ReadJSON(&welcome))
+	assert.Equal(t, 0, welcome.PlayerCount)
+
+	player, _, err := websocket.DefaultDialer.Dial(wsURL+"&user_id=user1", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, player.ReadJSON(&welcome))
+	assert.Equal(t, 1, welcome.PlayerCount)
+
+	var joined presenceMessage
+	assert.NoError(t, host.ReadJSON(&joined))
+	assert.Equal(t, presenceMessage{header: header{Type: messageTypePlayerJoined}, UserID: "user1", Count: 1}, joined)
+	var count playerCountMessage
+	assert.NoError(t, host.ReadJSON(&count))
+	assert.Equal(t, playerCountMessage{header: header{Type: messageTypePlayerCount}, Count: 1}, count)
+
+	req := httptest.NewRequest("GET", "/quizzes/quiz1/presence", nil)
+	rr := httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var presence services.Presence
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&presence))
+	assert.Equal(t, 1, presence.Count)
+	if assert.Len(t, presence.Players, 1) {
+		assert.Equal(t, "user1", presence.Players[0].UserID)
+	}
+
+	player.Close()
+	var left presenceMessage
+	assert.NoError(t, host.ReadJSON(&left))
+	assert.Equal(t, presenceMessage{header: header{Type: messageTypePlayerLeft}, UserID: "user1", Count: 0}, left)
+	assert.NoError(t, host.ReadJSON(&count))
+	assert.Equal(t, 0, count.Count)
+}
+
+func TestRankChange(t *testing.T) {
+	before := []models.LeaderboardEntry{
+		{UserID: "user1", Username: "Alice", Score: 5},
+		{UserID: "user2", Username: "Bob", Score: 3},
+		{UserID: "user3", Username: "Carol", Score: 3},
+	}
+	after := []models.LeaderboardEntry{
+		{UserID: "user3", Username: "Carol", Score: 7},
+		{UserID: "user4", Username: "Dan", Score: 6},
+		{UserID: "user1", Username: "Alice", Score: 5},
+		{UserID: "user2", Username: "Bob", Score: 3},
+	}
+	previous := standings{ranks: rankLeaderboard(before), lastPageRank: 2}
+	assert.Equal(t, map[string]int{"user1": 1, "user2": 2, "user3": 2}, previous.ranks)
+	current := rankLeaderboard(after)
+
+	assert.Equal(t, &rankChangedMessage{
+		header: header{Type: messageTypeRankChanged}, Rank: 3, PreviousRank: 1, PlacesMoved: -2,
+		OvertakenBy: []overtaker{{UserID: "user3", Username: "Carol"}, {UserID: "user4", Username: "Dan"}},
+	}, rankChange("user1", previous, current, after))
+	assert.Equal(t, &rankChangedMessage{
+		header: header{Type: messageTypeRankChanged}, Rank: 1, PreviousRank: 2, PlacesMoved: 1,
+	}, rankChange("user3", previous, current, after))
+	assert.Equal(t, &rankChangedMessage{
+		header: header{Type: messageTypeRankChanged}, Rank: 2, EnteredTop: topRanks,
+	}, rankChange("user4", previous, current, after))
+	assert.Equal(t, 4, rankChange("user2", previous, current, after).Rank)
+	assert.Nil(t, rankChange("user1", previous, previous.ranks, before))
+	assert.Nil(t, rankChange("user5", previous, current, after))
+
+	// Players who were beyond the page may have been ahead of players
+	// beyond it too, so they aren't named
+	previous.ranks["user5"] = 8
+	current["user5"] = 9
+	assert.Equal(t, &rankChangedMessage{
+		header: header{Type: messageTypeRankChanged}, Rank: 9, PreviousRank: 8, PlacesMoved: -1,
+	}, rankChange("user5", previous, current, after))
+}
+
+func TestHandleWebSocket_RankChanged(t *testing.T) {
+	quizService := &mockQuizService{
+		leaderboard: []models.LeaderboardEntry{
+			{UserID: "user1", Username: "Alice", Score: 2},
+			{UserID: "user2", Username: "Bob", Score: 1},
+		},
+	}
+	server := NewServer(quizService)
+
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?quiz_id=quiz1&user_id=user2"
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+	var welcome welcomeMessage
+	assert.NoError(t, ws.ReadJSON(&welcome))
+
+	// The first broadcast only records the ranks
+	ctx := context.Background()
+	server.broadcastLeaderboards(ctx, "quiz1")
+	var leaderboard leaderboardMessage
+	assert.NoError(t, ws.ReadJSON(&leaderboard))
+
+	quizService.leaderboard = []models.LeaderboardEntry{
+		{UserID: "user2", Username: "Bob", Score: 3},
+		{UserID: "user1", Username: "Alice", Score: 2},
+	}
+	server.broadcastLeaderboards(ctx, "quiz1")
+	assert.NoError(t, ws.ReadJSON(&leaderboard))
+	var changed rankChangedMessage
+	assert.NoError(t, ws.ReadJSON(&changed))
+	assert.Equal(t, rankChangedMessage{header: header{Type: messageTypeRankChanged}, Rank: 1, PreviousRank: 2, PlacesMoved: 1}, changed)
+
+	ws.Close()
+	assert.Eventually(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		_, ok := server.ranks["quiz1"]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestHandleWebSocket_RankChangedBeyondPage(t *testing.T) {
+	// The page broadcast holds the first 1000 players
+	var leaderboard []models.LeaderboardEntry
+	for i := 0; i < 1000; i++ {
+		leaderboard = append(leaderboard, models.LeaderboardEntry{UserID: fmt.Sprintf("player%d", i), Score: 2000 - i})
+	}
+	quizService := &mockQuizService{
+		leaderboard: append(leaderboard[:1000:1000],
+			models.LeaderboardEntry{UserID: "user2", Username: "Bob", Score: 5},
+			models.LeaderboardEntry{UserID: "user3", Username: "Carol", Score: 4}),
+	}
+	server := NewServer(quizService)
+
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?quiz_id=quiz1&user_id=user2"
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+	var welcome welcomeMessage
+	assert.NoError(t, ws.ReadJSON(&welcome))
+
+	ctx := context.Background()
+	server.broadcastLeaderboards(ctx, "quiz1")
+	var page leaderboardMessage
+	assert.NoError(t, ws.ReadJSON(&page))
+
+	quizService.leaderboard = append(leaderboard[:1000:1000],
+		models.LeaderboardEntry{UserID: "user3", Username: "Carol", Score: 6},
+		models.LeaderboardEntry{UserID: "user2", Username: "Bob", Score: 5})
+	server.broadcastLeaderboards(ctx, "quiz1")
+	assert.NoError(t, ws.ReadJSON(&page))
+	var changed rankChangedMessage
+	assert.NoError(t, ws.ReadJSON(&changed))
+	assert.Equal(t, rankChangedMessage{header: header{Type: messageTypeRankChanged}, Rank: 1002, PreviousRank: 1001, PlacesMoved: -1}, changed)
+}
+
+func TestLeaderboardStream(t *testing.T) {
+	quizService := &mockQuizService{
+		leaderboard: []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}},
+	}
+	server := NewServer(quizService)
+
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/leaderboard/stream?quiz_id=quiz1")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	stream := bufio.NewReader(resp.Body)
+
+	// New streams start with the current leaderboard
+	id, eventType, data := readStreamEvent(t, stream)
+	assert.Equal(t, "0", id)
+	assert.Equal(t, messageTypeLeaderboard, eventType)
+	var leaderboard leaderboardMessage
+	assert.NoError(t, json.Unmarshal([]byte(data), &leaderboard))
+	assert.Equal(t, 1, leaderboard.Leaderboard[0].Score)
+
+	// Answers over HTTP reach the stream like any other
+	answer, err := http.Post(s.URL+"/answers", "application/json",
+		strings.NewReader(`{"quiz_id":"quiz1","user_id":"user1","question_id":"q1","answer":"Soap"}`))
+	assert.NoError(t, err)
+	answer.Body.Close()
+	assert.Equal(t, http.StatusNoContent, answer.StatusCode)
+
+	id, eventType, data = readStreamEvent(t, stream)
+	assert.Equal(t, "1", id)
+	assert.Equal(t, messageTypeLeaderboard, eventType)
+	assert.NoError(t, json.Unmarshal([]byte(data), &leaderboard))
+	assert.Equal(t, int64(1), leaderboard.Seq)
+	assert.Equal(t, 2, leaderboard.Leaderboard[0].Score)
+
+	// Reconnecting streams replay what they missed
+	req, _ := http.NewRequest("GET", s.URL+"/leaderboard/stream?quiz_id=quiz1", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resumed, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resumed.Body.Close()
+	id, eventType, _ = readStreamEvent(t, bufio.NewReader(resumed.Body))
+	assert.Equal(t, "1", id)
+	assert.Equal(t, messageTypeLeaderboard, eventType)
+
+	// Streams that saw events from an expired log start again from the
+	// current leaderboard
+	req, _ = http.NewRequest("GET", s.URL+"/leaderboard/stream?quiz_id=quiz1", nil)
+	req.Header.Set("Last-Event-ID", "7")
+	restarted, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer restarted.Body.Close()
+	id, _, data = readStreamEvent(t, bufio.NewReader(restarted.Body))
+	assert.Equal(t, "1", id)
+	leaderboard = leaderboardMessage{}
+	assert.NoError(t, json.Unmarshal([]byte(data), &leaderboard))
+	assert.Zero(t, leaderboard.Seq)
+}
+
+func TestBroadcast_InSequence(t *testing.T) {
+	server := NewServer(&mockQuizService{})
+
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?quiz_id=quiz1&user_id=user1"
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+	var welcome welcomeMessage
+	assert.NoError(t, ws.ReadJSON(&welcome))
+
+	// Concurrent broadcasts reach clients in the order they were numbered
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.broadcast(context.Background(), "quiz1", &questionClosedMessage{header: header{Type: messageTypeQuestionClosed}, QuestionID: "q1"})
+		}()
+	}
+	wg.Wait()
+	for i := 1; i <= 20; i++ {
+		var msg questionClosedMessage
+		assert.NoError(t, ws.ReadJSON(&msg))
+		assert.Equal(t, int64(i), msg.Seq)
+	}
+}
+
+func TestHandleSubmitAnswer_Invalid(t *testing.T) {
+	server := NewServer(&mockQuizService{})
+
+	for _, body := range []string{`not json`, `{"quiz_id":"quiz1","user_id":"user1"}`} {
+		req := httptest.NewRequest("POST", "/answers", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		server.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+}
+
+// readStreamEvent reads the next Server-Sent Event, skipping comments.
+func readStreamEvent(t *testing.T, stream *bufio.Reader) (id, eventType, data string) {
+	t.Helper()
+	for {
+		line, err := stream.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && eventType != "":
+			return
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestRegisterParticipant(t *testing.T) {
+	quizService := &mockQuizService{
+		leaderboard:  []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}},
+		participants: map[string]bool{},
+	}
+	server := NewServer(quizService)
+
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws?quiz_id=quiz1&user_id=user1", nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+	var welcome welcomeMessage
+	assert.NoError(t, ws.ReadJSON(&welcome))
+
+	// Answers from users who haven't registered are refused
+	assert.NoError(t, ws.WriteJSON(map[string]string{"question_id": "q1", "answer": "Soap"}))
+	var errMsg errorMessage
+	assert.NoError(t, ws.ReadJSON(&errMsg))
+	assert.Equal(t, apperrors.ErrNotParticipant.Code, errMsg.Code)
+
+	rr := httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("POST", "/quizzes/quiz1/participants", strings.NewReader(`{"user_id":"user1"}`)))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	assert.NoError(t, ws.WriteJSON(map[string]string{"question_id": "q1", "answer": "Soap"}))
+	var leaderboard leaderboardMessage
+	assert.NoError(t, ws.ReadJSON(&leaderboard))
+	assert.Equal(t, messageTypeLeaderboard, leaderboard.Type)
+	assert.Equal(t, 2, leaderboard.Leaderboard[0].Score)
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("POST", "/quizzes/quiz2/participants", strings.NewReader(`{"user_id":"user1"}`)))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	var errResp errorResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	assert.Equal(t, apperrors.ErrQuizNotFound.Code, errResp.Error.Code)
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("POST", "/quizzes/quiz1/participants", strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestUsers(t *testing.T) {
+	server := NewServer(&mockQuizService{users: map[string]*models.User{}})
+
+	rr := httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("POST", "/users", strings.NewReader(`{"username":"alice","display_name":"Alice"}`)))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var user models.User
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&user))
+	assert.Equal(t, "alice", user.Username)
+	assert.Equal(t, "/users/"+user.ID, rr.Header().Get("Location"))
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("POST", "/users", strings.NewReader(`{"username":"alice"}`)))
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	var errResp errorResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	assert.Equal(t, apperrors.ErrUsernameTaken.Code, errResp.Error.Code)
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("PATCH", "/users/"+user.ID, strings.NewReader(`{"avatar_url":"https://example.com/a.png"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/users/"+user.ID, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&user))
+	assert.Equal(t, "Alice", user.DisplayName)
+	assert.Equal(t, "https://example.com/a.png", user.AvatarURL)
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/users/missing", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestHandleWebSocket_Guest(t *testing.T) {
+	quizService := &mockQuizService{
+		leaderboard:  []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}},
+		participants: map[string]bool{},
+	}
+	s := httptest.NewServer(NewServer(quizService).Router)
+	defer s.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws?quiz_id=quiz1&nickname=Bob", nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+	var welcome welcomeMessage
+	assert.NoError(t, ws.ReadJSON(&welcome))
+	assert.Equal(t, "guest1", welcome.UserID)
+
+	// The guest was registered for the quiz, so may answer
+	assert.NoError(t, ws.WriteJSON(map[string]string{"question_id": "q1", "answer": "Soap"}))
+	var leaderboard leaderboardMessage
+	assert.NoError(t, ws.ReadJSON(&leaderboard))
+	assert.Equal(t, messageTypeLeaderboard, leaderboard.Type)
+}
+
+func TestJoinByPIN(t *testing.T) {
+	quizService := &mockQuizService{
+		leaderboard:  []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}},
+		participants: map[string]bool{},
+	}
+	server := NewServer(quizService, WithHostKey("secret"))
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws"
+
+	// The host screen shows the PIN
+	host, _, err := websocket.DefaultDialer.Dial(wsURL+"?quiz_id=quiz1&user_id=host1&role=host&host_key=secret", nil)
+	assert.NoError(t, err)
+	defer host.Close()
+	var welcome welcomeMessage
+	assert.NoError(t, host.ReadJSON(&welcome))
+	assert.Equal(t, mockPIN, welcome.PIN)
+
+	rr := httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("POST", "/join", strings.NewReader(`{"pin":"123456","nickname":"Bob"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var session services.Session
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&session))
+	assert.Equal(t, "quiz1", session.QuizID)
+	assert.Equal(t, "guest1", session.UserID)
+
+	// The player connects with the token they were given
+	player, _, err := websocket.DefaultDialer.Dial(wsURL+"?resume_token="+session.Token, nil)
+	assert.NoError(t, err)
+	defer player.Close()
+	var playerWelcome welcomeMessage
+	assert.NoError(t, player.ReadJSON(&playerWelcome))
+	assert.Equal(t, "guest1", playerWelcome.UserID)
+	assert.Empty(t, playerWelcome.PIN)
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("POST", "/join", strings.NewReader(`{"pin":"654321","nickname":"Bob"}`)))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	var errResp errorResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	assert.Equal(t, apperrors.ErrPINNotFound.Code, errResp.Error.Code)
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("POST", "/join", strings.NewReader(`{"pin":"123456"}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestJoinByPIN_SharedAddress(t *testing.T) {
+	server := NewServer(&mockQuizService{}, WithRateLimiters(RateLimiters{
+		Joins:       &burstLimiter{burst: 100, taken: map[string]int{}},
+		FailedJoins: &burstLimiter{burst: 5, taken: map[string]int{}},
+	}))
+	join := func(pin string) int {
+		req := httptest.NewRequest("POST", "/join", strings.NewReader(fmt.Sprintf(`{"pin":%q,"nickname":"Bob"}`, pin)))
+		req.RemoteAddr = "192.0.2.1:1234"
+		rr := httptest.NewRecorder()
+		server.Router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// A class behind one address joins without waiting
+	for i := 0; i < 30; i++ {
+		assert.Equal(t, http.StatusOK, join(mockPIN), "join %d", i+1)
+	}
+
+	// Guessing PINs from it soon stops, even for the right PIN
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusNotFound, join("654321"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, join("654322"))
+	assert.Equal(t, http.StatusTooManyRequests, join(mockPIN))
+}
+
+func TestJoinByPIN_SpoofedForwardedFor(t *testing.T) {
+	server := NewServer(&mockQuizService{}, WithTrustProxyHeaders(true), WithRateLimiters(RateLimiters{
+		FailedJoins: &burstLimiter{burst: 5, taken: map[string]int{}},
+	}))
+	join := func(forwardedFor ...string) int {
+		req := httptest.NewRequest("POST", "/join", strings.NewReader(`{"pin":"654321","nickname":"Bob"}`))
+		req.RemoteAddr = "10.0.0.1:1234"
+		for _, value := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		rr := httptest.NewRecorder()
+		server.Router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// The proxy appends the real address to whatever the client sent, so a
+	// new made-up address each time doesn't get round the limit
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusNotFound, join(fmt.Sprintf("198.51.100.%d, 192.0.2.1", i)))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, join("198.51.100.99, 192.0.2.1"))
+	assert.Equal(t, http.StatusTooManyRequests, join("198.51.100.99", "192.0.2.1"))
+	assert.Equal(t, http.StatusNotFound, join("192.0.2.2"))
+
+	// Behind two proxies, the client is the address the outer one added
+	server = NewServer(&mockQuizService{}, WithTrustProxyHeaders(true), WithProxyHops(2))
+	req := httptest.NewRequest("GET", "/leaderboard", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 192.0.2.1, 203.0.113.1")
+	assert.Equal(t, "192.0.2.1", server.clientIP(req))
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	req.RemoteAddr = "10.0.0.1:1234"
+	assert.Equal(t, "10.0.0.1", server.clientIP(req))
+}
+
+func TestScheduledQuiz(t *testing.T) {
+	startsAt := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	quizService := &mockQuizService{
+		leaderboard: []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}},
+		countdown:   services.NewCountdown(startsAt, time.Now()),
+	}
+	server := NewServer(quizService, WithHostKey(testHostKey))
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+
+	rr := httptest.NewRecorder()
+	body := fmt.Sprintf(`{"starts_at":%q,"lobby_minutes":2}`, startsAt.Format(time.RFC3339Nano))
+	server.Router.ServeHTTP(rr, newHostRequest("PUT", "/quizzes/quiz1/schedule", strings.NewReader(body)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var schedule models.QuizSchedule
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&schedule))
+	assert.True(t, startsAt.Add(-2*time.Minute).Equal(*schedule.NextTransitionAt))
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, newHostRequest("PUT", "/quizzes/quiz1/schedule", strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Clients joining the lobby get the countdown with their welcome
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws?quiz_id=quiz1&user_id=user1", nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+	var welcome welcomeMessage
+	assert.NoError(t, ws.ReadJSON(&welcome))
+	if assert.NotNil(t, welcome.Countdown) {
+		assert.True(t, startsAt.Equal(welcome.Countdown.StartsAt))
+	}
+
+	ctx := context.Background()
+	transition := func(status models.ScheduleStatus) {
+		for _, handler := range quizService.transitionHandlers {
+			handler(ctx, &models.QuizTransition{QuizID: "quiz1", Status: status, StartsAt: startsAt, At: time.Now()})
+		}
+	}
+
+	transition(models.ScheduleStatusLobby)
+	var countdown quizCountdownMessage
+	assert.NoError(t, ws.ReadJSON(&countdown))
+	assert.Equal(t, messageTypeQuizCountdown, countdown.Type)
+	assert.InDelta(t, time.Minute.Milliseconds(), countdown.RemainingMs, float64(time.Second.Milliseconds()))
+
+	quizService.mu.Lock()
+	quizService.active = &services.ActiveQuestion{Question: models.QuestionView{ID: "q1"}, OpenedAt: time.Now()}
+	quizService.mu.Unlock()
+	transition(models.ScheduleStatusRunning)
+	var opened questionOpenedMessage
+	assert.NoError(t, ws.ReadJSON(&opened))
+	assert.Equal(t, messageTypeQuestionOpened, opened.Type)
+	assert.Equal(t, "q1", opened.Question.ID)
+
+	transition(models.ScheduleStatusFinished)
+	var finished quizFinishedMessage
+	assert.NoError(t, ws.ReadJSON(&finished))
+	assert.Equal(t, messageTypeQuizFinished, finished.Type)
+}
+
+func TestImportExportQuiz(t *testing.T) {
+	server := NewServer(&mockQuizService{}, WithHostKey(testHostKey))
+
+	rr := httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, newHostRequest("POST", "/quizzes/import", strings.NewReader(`{"quiz":{"title":"Cleaning"},"questions":[]}`)))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "/quizzes/quiz2/export", rr.Header().Get("Location"))
+
+	// Every problem is reported in the error's details
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, newHostRequest("POST", "/quizzes/import", strings.NewReader(`{"quiz":{}}`)))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var errResp struct {
+		Error struct {
+			Code    string              `json:"code"`
+			Details []services.RowError `json:"details"`
+		} `json:"error"`
+	}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+	assert.Equal(t, apperrors.ErrInvalidQuiz.Code, errResp.Error.Code)
+	assert.Equal(t, []services.RowError{{Field: "title", Message: "should be 1 to 200 characters"}}, errResp.Error.Details)
+
+	req := newHostRequest("POST", "/quizzes/import?title=Sheet&team_best_n=2", strings.NewReader("question\nWhat?\n"))
+	req.Header.Set("Content-Type", "text/csv; charset=utf-8")
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var doc services.QuizDocument
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&doc))
+	assert.Equal(t, models.Quiz{ID: "quiz2", Title: "Sheet", TeamBestN: 2}, doc.Quiz)
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/quizzes/quiz1/export", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&doc))
+	assert.Equal(t, "Cleaning", doc.Quiz.Title)
+	assert.Len(t, doc.Questions, 1)
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/quizzes/quiz1/export?format=csv", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "type,question,options,correct,points,time_limit_seconds,tolerance,partial_credit\n"+
+		"single_choice,What cleans best?,Water|Soap,2,1,0,0,false\n", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/quizzes/quiz9/export", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestExportQuiz_InProgress(t *testing.T) {
+	server := NewServer(&mockQuizService{started: true})
+
+	for _, format := range []string{"json", "csv"} {
+		rr := httptest.NewRecorder()
+		server.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/quizzes/quiz1/export?format="+format, nil))
+		assert.Equal(t, http.StatusConflict, rr.Code)
+		assert.NotContains(t, rr.Body.String(), "Soap")
+	}
+}
+
+func TestExportResults(t *testing.T) {
+	server := NewServer(&mockQuizService{})
+
+	rr := httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/quizzes/quiz1/results.csv", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv", rr.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="quiz1-results.csv"`, rr.Header().Get("Content-Disposition"))
+	assert.Equal(t, "rank,username,score,correct_count,avg_response_time_ms,q1,q2\n"+
+		"1,alice,3,2,1500,1,2\n"+
+		"2,bob,0,0,,,\n", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/quizzes/quiz1/results.json", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	var resp struct {
+		QuizID    string            `json:"quiz_id"`
+		Questions []resultsQuestion `json:"questions"`
+		Results   []resultsEntry    `json:"results"`
+	}
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	assert.Equal(t, "quiz1", resp.QuizID)
+	assert.Len(t, resp.Questions, 2)
+	assert.Len(t, resp.Results, 2)
+	assert.Equal(t, "alice", resp.Results[0].Username)
+	assert.Equal(t, 2, *resp.Results[0].QuestionPoints[1])
+	assert.Equal(t, []*int{nil, nil}, resp.Results[1].QuestionPoints)
+	assert.Nil(t, resp.Results[1].AvgResponseTimeMs)
+
+	// Errors before the header are still reported
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/quizzes/quiz9/results.csv", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/quizzes/quiz1/results.xml", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Display names can't smuggle formulas into spreadsheets
+	server = NewServer(&mockQuizService{results: []models.ResultRow{
+		{Rank: 1, UserID: "user1", Username: "=HYPERLINK(\"http://example.com\")"},
+		{Rank: 2, UserID: "user2", Username: "@SUM(A1)"},
+		{Rank: 3, UserID: "user3", Username: "Bob-2"},
+	}})
+	rr = httptest.NewRecorder()
+	server.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/quizzes/quiz1/results.csv", nil))
+	assert.Equal(t, "rank,username,score,correct_count,avg_response_time_ms,q1,q2\n"+
+		"1,\"'=HYPERLINK(\"\"http://example.com\"\")\",0,0,,,\n"+
+		"2,'@SUM(A1),0,0,,,\n"+
+		"3,Bob-2,0,0,,,\n", rr.Body.String())
+}
+
+func TestExportResults_Fails(t *testing.T) {
+	// Failures while the response is still buffered are reported
+	quizService := &mockQuizService{resultsErr: errors.New("connection reset")}
+	server := NewServer(quizService)
+	for _, format := range []string{"csv", "json"} {
+		rr := httptest.NewRecorder()
+		server.Router.ServeHTTP(rr, httptest.NewRequest("GET", "/quizzes/quiz1/results."+format, nil))
+		assert.Equal(t, http.StatusInternalServerError, rr.Code)
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+		assert.Empty(t, rr.Header().Get("Content-Disposition"))
+		assert.Contains(t, rr.Body.String(), apperrors.ErrInternal.Code)
+	}
+
+	// Once rows have reached the client, the download is broken off
+	quizService.results = make([]models.ResultRow, 1000)
+	for i := range quizService.results {
+		quizService.results[i] = models.ResultRow{Rank: i + 1, UserID: fmt.Sprint("user", i), Username: fmt.Sprint("player", i)}
+	}
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+	for _, format := range []string{"csv", "json"} {
+		resp, err := http.Get(s.URL + "/quizzes/quiz1/results." + format)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		_, err = io.ReadAll(resp.Body)
+		assert.Error(t, err)
+		resp.Body.Close()
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{apperrors.ErrQuestionNotFound, http.StatusNotFound, "question_not_found"},
+		{fmt.Errorf("recording answer: %w", apperrors.ErrDuplicateAnswer), http.StatusConflict, "duplicate_answer"},
+		{apperrors.ErrUnauthorized, http.StatusUnauthorized, "unauthorized"},
+		{errors.New("connection refused"), http.StatusInternalServerError, "internal"},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		writeError(rr, httptest.NewRequest("GET", "/", nil), tt.err)
+		assert.Equal(t, tt.status, rr.Code)
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+		var resp errorResponse
+		assert.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		assert.Equal(t, tt.code, resp.Error.Code)
+	}
+}
+
+func TestBroadcasterCoalescesUpdates(t *testing.T) {
+	var mu sync.Mutex
+	sent := 0
+	release := make(chan struct{})
+	b := newBroadcaster(20*time.Millisecond, func(ctx context.Context, quizID string) {
+		mu.Lock()
+		sent++
+		first := sent == 1
+		mu.Unlock()
+		if first {
+			<-release
+		}
+	})
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return sent
+	}
+	idle := func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.dirty) == 0
+	}
+
+	// The first update goes out straight away
+	b.markDirty("quiz1")
+	assert.Eventually(t, func() bool { return count() == 1 }, time.Second, time.Millisecond)
+
+	// Updates made while it is being sent are merged into one more
+	for i := 0; i < 100; i++ {
+		b.markDirty("quiz1")
+	}
+	close(release)
+	assert.Eventually(t, idle, time.Second, time.Millisecond)
+	assert.Equal(t, 2, count())
+
+	// Once the quiz has been quiet for an interval, updates go out
+	// straight away again
+	b.markDirty("quiz1")
+	assert.Eventually(t, func() bool { return count() == 3 }, time.Second, time.Millisecond)
+}
+
+func TestBroadcastCompression(t *testing.T) {
+	quizService := &mockQuizService{leaderboard: []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}}}
+	server := NewServer(quizService, WithWebSocketConfig(WebSocketConfig{
+		EnableCompression: true,
+		CompressionLevel:  flate.BestSpeed,
+		ReadLimit:         4096,
+	}))
+
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+	wsURL := "ws" + strings.TrimPrefix(s.URL, "http") + "/ws?quiz_id=quiz1&user_id="
+
+	// Clients that support permessage-deflate get compressed frames and
+	// the rest get them uncompressed, from the same prepared message
+	compressed, resp, err := (&websocket.Dialer{EnableCompression: true}).Dial(wsURL+"user1", nil)
+	assert.NoError(t, err)
+	defer compressed.Close()
+	assert.Contains(t, resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	var welcome welcomeMessage
+	assert.NoError(t, compressed.ReadJSON(&welcome))
+
+	plain, resp, err := websocket.DefaultDialer.Dial(wsURL+"user2", nil)
+	assert.NoError(t, err)
+	defer plain.Close()
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Extensions"))
+	assert.NoError(t, plain.ReadJSON(&welcome))
+	var count playerCountMessage
+	assert.NoError(t, compressed.ReadJSON(&count))
+
+	assert.NoError(t, plain.WriteJSON(map[string]string{"question_id": "q1", "answer": "Soap"}))
+	for _, ws := range []*websocket.Conn{compressed, plain} {
+		var leaderboard leaderboardMessage
+		assert.NoError(t, ws.ReadJSON(&leaderboard))
+		assert.Equal(t, messageTypeLeaderboard, leaderboard.Type)
+		assert.Equal(t, 2, leaderboard.Leaderboard[0].Score)
+	}
+}
+
+// benchmarkConns connects n WebSocket clients that discard everything they
+// receive, and returns the server side of their connections.
+func benchmarkConns(b *testing.B, n int, compress bool) []*websocket.Conn {
+	upgrader := websocket.Upgrader{EnableCompression: compress}
+	accepted := make(chan *websocket.Conn, n)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		conn.EnableWriteCompression(compress)
+		accepted <- conn
+	}))
+	b.Cleanup(s.Close)
+
+	dialer := websocket.Dialer{EnableCompression: compress}
+	conns := make([]*websocket.Conn, n)
+	for i := range conns {
+		ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { ws.Close() })
+		go func() {
+			for {
+				if _, _, err := ws.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		conns[i] = <-accepted
+	}
+	return conns
+}
+
+// BenchmarkFanOut measures the CPU cost of sending a 1,000 entry leaderboard
+// to 100 clients, encoding it for every client as before or once as a
+// prepared message.
+func BenchmarkFanOut(b *testing.B) {
+	leaderboard := &services.PaginatedLeaderboard{Page: 1, PageSize: 1000, TotalCount: 1000}
+	for i := 0; i < 1000; i++ {
+		leaderboard.Leaderboard = append(leaderboard.Leaderboard,
+			models.LeaderboardEntry{UserID: fmt.Sprintf("user%d", i), Username: fmt.Sprintf("Player %d", i), Score: 1000 - i})
+	}
+	msg := &leaderboardMessage{header: header{Type: messageTypeLeaderboard}, PaginatedLeaderboard: leaderboard}
+
+	for _, compress := range []bool{false, true} {
+		conns := benchmarkConns(b, 100, compress)
+
+		b.Run(fmt.Sprintf("WriteJSON/compress=%t", compress), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, conn := range conns {
+					if err := conn.WriteJSON(msg); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("Prepared/compress=%t", compress), func(b *testing.B) {
+			server := NewServer(&mockQuizService{})
+			server.clients["quiz1"] = make(map[*websocket.Conn]*client)
+			for _, conn := range conns {
+				server.clients["quiz1"][conn] = &client{}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				server.notify("quiz1", msg, nil)
+			}
+			if len(server.clients["quiz1"]) != len(conns) {
+				b.Fatal("clients were dropped")
+			}
+		})
+	}
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	msg := []byte(`{"type":"leaderboard","seq":3,"ratio":0.5,"leaderboard":[{"user_id":"user1","score":2}],"team":null,"final":true}`)
+
+	encoded, err := codecFor(SubprotocolMsgpack).Encode(msg)
+	assert.NoError(t, err)
+	assert.Less(t, len(encoded), len(msg))
+
+	decoded, err := codecFor(SubprotocolMsgpack).Decode(encoded)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(msg), string(decoded))
+
+	_, err = codecFor(SubprotocolMsgpack).Decode([]byte{0xc1})
+	assert.Error(t, err)
+}
+
+func TestHandleWebSocket_Msgpack(t *testing.T) {
+	quizService := &mockQuizService{leaderboard: []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}}}
+	server := NewServer(quizService)
+
+	s := httptest.NewServer(server.Router)
+	defer s.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{SubprotocolMsgpack}}
+	ws, resp, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws?quiz_id=quiz1&user_id=user1", nil)
+	assert.NoError(t, err)
+	defer ws.Close()
+	assert.Equal(t, SubprotocolMsgpack, resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	// readMsgpack reads a binary message and decodes it like a JSON one
+	readMsgpack := func(v interface{}) {
+		messageType, data, err := ws.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, websocket.BinaryMessage, messageType)
+		data, err = codecFor(SubprotocolMsgpack).Decode(data)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(data, v))
+	}
+
+	var welcome welcomeMessage
+	readMsgpack(&welcome)
+	assert.Equal(t, messageTypeWelcome, welcome.Type)
+	assert.NotEmpty(t, welcome.ResumeToken)
+	assert.Equal(t, 1, welcome.Leaderboard[0].Score)
+
+	answer, err := codecFor(SubprotocolMsgpack).Encode([]byte(`{"question_id":"q1","answer":"Soap"}`))
+	assert.NoError(t, err)
+	assert.NoError(t, ws.WriteMessage(websocket.BinaryMessage, answer))
+	var leaderboard leaderboardMessage
+	readMsgpack(&leaderboard)
+	assert.Equal(t, messageTypeLeaderboard, leaderboard.Type)
+	assert.Equal(t, 2, leaderboard.Leaderboard[0].Score)
+
+	unknown, err := codecFor(SubprotocolMsgpack).Encode([]byte(`{"type":"dance"}`))
+	assert.NoError(t, err)
+	assert.NoError(t, ws.WriteMessage(websocket.BinaryMessage, unknown))
+	var errMsg errorMessage
+	readMsgpack(&errMsg)
+	assert.Equal(t, apperrors.ErrUnknownMessageType.Code, errMsg.Code)
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+const (
+	// streamBuffer is how many events a stream may fall behind before it is
+	// dropped. Dropped clients reconnect and catch up from the event log.
+	streamBuffer = 64
+	// streamKeepAlive is how often an idle stream sends a comment so that
+	// proxies don't time it out.
+	streamKeepAlive = 15 * time.Second
+)
+
+// answerRequest is the body of POST /answers, the HTTP equivalent of an
+// answer message on /ws.
+type answerRequest struct {
+	QuizID     string        `json:"quiz_id"`
+	UserID     string        `json:"user_id"`
+	QuestionID string        `json:"question_id"`
+	Answer     models.Answer `json:"answer"`
+}
+
+// handleLeaderboardStream streams the quiz's events as Server-Sent Events
+// for clients that can't hold a WebSocket open. Each event's ID is its
+// sequence number, so a reconnecting EventSource resumes from where it left
+// off through the Last-Event-ID header. New streams, and streams that have
+// missed more than the event log holds, start with the current leaderboard.
+func (s *Server) handleLeaderboardStream(w http.ResponseWriter, r *http.Request) {
+	quizID := r.URL.Query().Get("quiz_id")
+	if quizID == "" {
+		writeError(w, r, apperrors.InvalidRequest("missing quiz_id"))
+		return
+	}
+	if result := s.allowClient(r.Context(), r, r.URL.Query().Get("user_id"), s.rateLimiters.ConnectsPerIP, s.rateLimiters.Connects); !result.Allowed {
+		writeTooManyRequests(w, result)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, errors.New("response writer does not support flushing"))
+		return
+	}
+
+	// Subscribe before reading the log so nothing broadcast in between is
+	// lost. Events already sent from the log are skipped by sequence number.
+	events := s.subscribe(quizID)
+	defer s.unsubscribe(quizID, events)
+
+	ctx := r.Context()
+	var lastSeq int64
+	var replay []json.RawMessage
+	if id, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil && id >= 0 {
+		missed, complete, err := s.quizService.GetEventsSince(ctx, quizID, id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if complete {
+			lastSeq, replay = id, missed
+		}
+	}
+
+	var snapshot []byte
+	if replay == nil {
+		var err error
+		lastSeq, err = s.quizService.LastEventSeq(ctx, quizID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		leaderboard, err := s.quizService.GetLeaderboard(ctx, quizID, 1, 1000) // Large page size to get all
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		snapshot, err = json.Marshal(leaderboardMessage{header: header{Type: messageTypeLeaderboard}, PaginatedLeaderboard: leaderboard})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	out := bufio.NewWriter(w)
+	if snapshot != nil {
+		writeStreamEvent(out, lastSeq, messageTypeLeaderboard, snapshot)
+	}
+	for _, data := range replay {
+		if seq, ok := writeLoggedEvent(out, lastSeq, data); ok {
+			lastSeq = seq
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case data, ok := <-events:
+			if !ok {
+				// Too slow to keep up; the client reconnects and catches up
+				return
+			}
+			if seq, ok := writeLoggedEvent(out, lastSeq, data); ok {
+				lastSeq = seq
+			}
+		case <-keepAlive.C:
+			fmt.Fprint(out, ": keep-alive\n\n")
+		}
+		if err := out.Flush(); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeLoggedEvent writes an event from the quiz's event log unless it is
+// not newer than lastSeq, and returns its sequence number.
+func writeLoggedEvent(out *bufio.Writer, lastSeq int64, data []byte) (int64, bool) {
+	var h header
+	if err := json.Unmarshal(data, &h); err != nil {
+		log.Println(err)
+		return 0, false
+	}
+	if h.Seq <= lastSeq {
+		return 0, false
+	}
+	writeStreamEvent(out, h.Seq, h.Type, data)
+	return h.Seq, true
+}
+
+func writeStreamEvent(out *bufio.Writer, id int64, eventType string, data []byte) {
+	fmt.Fprintf(out, "id: %d\nevent: %s\ndata: %s\n\n", id, eventType, data)
+}
+
+func (s *Server) subscribe(quizID string) chan []byte {
+	events := make(chan []byte, streamBuffer)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.streams[quizID] == nil {
+		s.streams[quizID] = make(map[chan []byte]bool)
+	}
+	s.streams[quizID][events] = true
+	return events
+}
+
+func (s *Server) unsubscribe(quizID string, events chan []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.streams[quizID][events] {
+		delete(s.streams[quizID], events)
+		close(events)
+	}
+}
+
+// handleSubmitAnswer lets clients without a WebSocket submit answers.
+// Leaderboard updates reach them through the event stream.
+func (s *Server) handleSubmitAnswer(w http.ResponseWriter, r *http.Request) {
+	// Answers are held to the same size limit as WebSocket messages
+	body := r.Body
+	if s.wsConfig.ReadLimit > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.wsConfig.ReadLimit)
+	}
+	var req answerRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeError(w, r, apperrors.InvalidRequest("invalid request body"))
+		return
+	}
+	if req.QuizID == "" || req.UserID == "" || req.QuestionID == "" {
+		writeError(w, r, apperrors.InvalidRequest("missing quiz_id, user_id or question_id"))
+		return
+	}
+	if result := s.allowClient(r.Context(), r, req.UserID, s.rateLimiters.AnswersPerIP, s.rateLimiters.Answers); !result.Allowed {
+		writeTooManyRequests(w, result)
+		return
+	}
+
+	if err := s.quizService.ProcessAnswer(r.Context(), req.QuizID, req.UserID, req.QuestionID, req.Answer); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
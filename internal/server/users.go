@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/services"
+)
+
+func (s *Server) handleRegisterUser(w http.ResponseWriter, r *http.Request) {
+	var req services.NewUser
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, apperrors.InvalidRequest("invalid request body"))
+		return
+	}
+
+	user, err := s.quizService.RegisterUser(r.Context(), req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/users/"+user.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, user)
+}
+
+func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := s.quizService.GetUser(r.Context(), mux.Vars(r)["userID"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, user)
+}
+
+func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	var update services.ProfileUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, r, apperrors.InvalidRequest("invalid request body"))
+		return
+	}
+
+	user, err := s.quizService.UpdateProfile(r.Context(), mux.Vars(r)["userID"], update)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, user)
+}
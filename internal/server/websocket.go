@@ -0,0 +1,117 @@
+package server
+
+import (
+	"compress/flate"
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketConfig controls how /ws connections are accepted.
+type WebSocketConfig struct {
+	// AllowedOrigins lists the origins browsers may connect from, e.g.
+	// "https://quiz.example.com". "*" allows any origin and
+	// "https://*.example.com" allows any subdomain. When empty only
+	// same-origin connections are allowed.
+	AllowedOrigins []string
+	// Subprotocols are offered in order of preference. SubprotocolMsgpack
+	// selects MessagePack and any other subprotocol JSON.
+	Subprotocols []string
+	// RequireSubprotocol rejects clients that don't request one of
+	// Subprotocols.
+	RequireSubprotocol bool
+	// EnableCompression negotiates permessage-deflate with clients that
+	// support it, compressing at CompressionLevel.
+	EnableCompression bool
+	CompressionLevel  int
+	// ReadLimit is the largest message in bytes a client may send. Larger
+	// messages close the connection.
+	ReadLimit int64
+}
+
+func DefaultWebSocketConfig() WebSocketConfig {
+	return WebSocketConfig{
+		Subprotocols:     []string{SubprotocolJSON, SubprotocolMsgpack},
+		CompressionLevel: flate.BestSpeed,
+		ReadLimit:        4096,
+	}
+}
+
+func WithWebSocketConfig(cfg WebSocketConfig) Option {
+	return func(s *Server) {
+		s.wsConfig = cfg
+	}
+}
+
+func (s *Server) newUpgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		Subprotocols:      s.wsConfig.Subprotocols,
+		EnableCompression: s.wsConfig.EnableCompression,
+		CheckOrigin:       s.checkOrigin,
+	}
+}
+
+// checkOrigin allows requests without an Origin header, which only
+// non-browser clients can send, and browser requests from allowed origins.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if len(s.wsConfig.AllowedOrigins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+
+	for _, allowed := range s.wsConfig.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		// "https://*.example.com" matches any subdomain of example.com
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok &&
+			strings.EqualFold(u.Scheme, scheme) &&
+			strings.HasSuffix(strings.ToLower(u.Host), "."+strings.ToLower(domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHostKey reports whether key is the configured host key.
+func (s *Server) isHostKey(key string) bool {
+	return s.hostKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(s.hostKey)) == 1
+}
+
+// hasSubprotocol reports whether the client requested a supported
+// subprotocol, or one isn't required.
+func (s *Server) hasSubprotocol(r *http.Request) bool {
+	if !s.wsConfig.RequireSubprotocol {
+		return true
+	}
+	for _, requested := range websocket.Subprotocols(r) {
+		for _, supported := range s.wsConfig.Subprotocols {
+			if requested == supported {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// configureConn applies the per-connection limits and compression level.
+func (s *Server) configureConn(conn *websocket.Conn) error {
+	if s.wsConfig.ReadLimit > 0 {
+		conn.SetReadLimit(s.wsConfig.ReadLimit)
+	}
+	if s.wsConfig.EnableCompression {
+		conn.EnableWriteCompression(true)
+		return conn.SetCompressionLevel(s.wsConfig.CompressionLevel)
+	}
+	return nil
+}
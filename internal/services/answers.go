@@ -0,0 +1,373 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+type QuizResult struct {
+	QuizID  string                `json:"quiz_id"`
+	UserID  string                `json:"user_id"`
+	Score   int                   `json:"score"`
+	Answers []models.AnswerRecord `json:"answers"`
+}
+
+type PaginatedHistory struct {
+	History    []models.AnswerRecord `json:"history"`
+	TotalCount int                   `json:"total_count"`
+	Page       int                   `json:"page"`
+	PageSize   int                   `json:"page_size"`
+}
+
+func activeQuestionKey(quizID string) string {
+	return fmt.Sprintf("quiz:%s:active_question", quizID)
+}
+
+// ActiveQuestion is the question currently open in a quiz.
+type ActiveQuestion struct {
+	Question models.QuestionView `json:"question"`
+	OpenedAt time.Time           `json:"opened_at"`
+	// ClosesAt and RemainingMs are only set for questions with a time
+	// limit.
+	ClosesAt    *time.Time `json:"closes_at,omitempty"`
+	RemainingMs *int64     `json:"remaining_ms,omitempty"`
+}
+
+func newActiveQuestion(question *models.Question, openedAt, now time.Time) *ActiveQuestion {
+	active := &ActiveQuestion{Question: question.View(), OpenedAt: openedAt}
+	if question.TimeLimitSeconds > 0 {
+		closesAt := openedAt.Add(time.Duration(question.TimeLimitSeconds) * time.Second)
+		remaining := closesAt.Sub(now).Milliseconds()
+		if remaining < 0 {
+			remaining = 0
+		}
+		active.ClosesAt = &closesAt
+		active.RemainingMs = &remaining
+	}
+	return active
+}
+
+// closingQuestionsKey is a sorted set of the quizzes whose host opened a
+// timed question, scored by when the question stops taking answers.
+const closingQuestionsKey = "questions:closing"
+
+// closeQuestionScript sets closed_at, ARGV[2], on the active question in
+// KEYS[1] if it is still ARGV[1] and open, returning 1 if it did. Closing
+// is a compare-and-set so that, of concurrent closes, only one goes on to
+// snapshot the leaderboard.
+var closeQuestionScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "question_id") ~= ARGV[1] then
+	return 0
+end
+local closed = redis.call("HGET", KEYS[1], "closed_at")
+if closed and closed ~= "" then
+	return 0
+end
+redis.call("HSET", KEYS[1], "closed_at", ARGV[2])
+return 1
+`)
+
+// unscheduleCloseScript removes the quiz ARGV[1] from the sorted set in
+// KEYS[1] unless its score has changed from ARGV[2], which means the host
+// has opened another timed question since.
+var unscheduleCloseScript = redis.NewScript(`
+local score = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if score and tonumber(score) == tonumber(ARGV[2]) then
+	return redis.call("ZREM", KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// OpenQuestion marks a question as the one currently being answered in a
+// quiz, starting the quiz if it was in the lobby. Response times of answers
+// are measured from this moment. A different question left open by the
+// host closes, and the leaderboard is snapshotted. Timed questions close
+// by themselves once their time and the grace period are up.
+func (s *QuizService) OpenQuestion(ctx context.Context, quizID, questionID string) (*ActiveQuestion, error) {
+	question, err := s.getQuizQuestion(ctx, quizID, questionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.db.StartQuiz(ctx, quizID); err != nil {
+		return nil, err
+	}
+	previous, err := s.activeQuestionState(ctx, quizID)
+	if err != nil {
+		return nil, err
+	}
+
+	openedAt := time.Now()
+	if previous != nil && previous.questionID != questionID {
+		closed, err := s.closeActiveQuestion(ctx, quizID, previous.questionID, openedAt)
+		if err != nil {
+			return nil, err
+		}
+		if closed {
+			if err := s.db.SnapshotLeaderboard(ctx, quizID, previous.questionID, openedAt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	active := newActiveQuestion(question, openedAt, openedAt)
+	if err := s.setActiveQuestion(ctx, quizID, questionID, openedAt, active.ClosesAt); err != nil {
+		return nil, err
+	}
+	if active.ClosesAt != nil {
+		closeAt := active.ClosesAt.Add(answerGracePeriod).UnixMilli()
+		err := s.redis.ZAdd(ctx, closingQuestionsKey, &redis.Z{Score: float64(closeAt), Member: quizID}).Err()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return active, nil
+}
+
+// CloseQuestion stops the quiz's open question taking answers and
+// snapshots the leaderboard. The question stays the quiz's active one until
+// the next is opened, unless it was the quiz's last question, which
+// finishes the quiz.
+func (s *QuizService) CloseQuestion(ctx context.Context, quizID, questionID string) error {
+	closed, err := s.closeQuestion(ctx, quizID, questionID, time.Now())
+	if err != nil {
+		return err
+	}
+	if !closed {
+		return apperrors.ErrQuestionClosed
+	}
+	return nil
+}
+
+// CloseExpiredQuestions closes, as CloseQuestion does, the timed questions
+// opened by hosts whose time and grace period were up by now.
+func (s *QuizService) CloseExpiredQuestions(ctx context.Context, now time.Time) error {
+	due, err := s.redis.ZRangeByScoreWithScores(ctx, closingQuestionsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, z := range due {
+		quizID := fmt.Sprint(z.Member)
+		state, err := s.activeQuestionState(ctx, quizID)
+		if err != nil {
+			return err
+		}
+		if state != nil && state.closesAt != nil && !state.closesAt.Add(answerGracePeriod).After(now) {
+			if _, err := s.closeQuestion(ctx, quizID, state.questionID, now); err != nil {
+				return err
+			}
+		}
+		err = unscheduleCloseScript.Run(ctx, s.redis, []string{closingQuestionsKey}, quizID, int64(z.Score)).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunQuestionCloser closes expired timed questions every interval until
+// ctx is cancelled.
+func (s *QuizService) RunQuestionCloser(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.CloseExpiredQuestions(ctx, time.Now()); err != nil {
+			log.Printf("Error closing expired questions: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeQuestion closes the quiz's active question if it is still
+// questionID and open, snapshotting the leaderboard and finishing the quiz
+// after its last question, and reports whether it did.
+func (s *QuizService) closeQuestion(ctx context.Context, quizID, questionID string, closedAt time.Time) (bool, error) {
+	closed, err := s.closeActiveQuestion(ctx, quizID, questionID, closedAt)
+	if err != nil || !closed {
+		return false, err
+	}
+	if err := s.db.SnapshotLeaderboard(ctx, quizID, questionID, closedAt); err != nil {
+		return true, err
+	}
+	finished, err := s.db.FinishQuiz(ctx, quizID, questionID)
+	if err != nil || !finished {
+		return true, err
+	}
+	return true, s.redis.Del(ctx, activeQuestionKey(quizID)).Err()
+}
+
+// closeActiveQuestion marks the quiz's active question closed at closedAt
+// if it is still questionID and open, reporting whether it did.
+func (s *QuizService) closeActiveQuestion(ctx context.Context, quizID, questionID string, closedAt time.Time) (bool, error) {
+	closed, err := closeQuestionScript.Run(ctx, s.redis, []string{activeQuestionKey(quizID)}, questionID, closedAt.UnixMilli()).Int()
+	return closed == 1, err
+}
+
+// setActiveQuestion records the question as open since openedAt, until
+// closesAt for timed questions.
+func (s *QuizService) setActiveQuestion(ctx context.Context, quizID, questionID string, openedAt time.Time, closesAt *time.Time) error {
+	var closes interface{} = ""
+	if closesAt != nil {
+		closes = closesAt.UnixMilli()
+	}
+	return s.redis.HSet(ctx, activeQuestionKey(quizID),
+		"question_id", questionID,
+		"opened_at", openedAt.UnixMilli(),
+		"closes_at", closes,
+		"closed_at", "",
+	).Err()
+}
+
+// activeQuestionState is the quiz's active question as stored in Redis.
+type activeQuestionState struct {
+	questionID string
+	openedAt   time.Time
+	// closesAt is set for timed questions, and closedAt once the question
+	// has been closed.
+	closesAt *time.Time
+	closedAt *time.Time
+}
+
+// activeQuestionState returns the quiz's active question, or nil while the
+// quiz is still in the lobby.
+func (s *QuizService) activeQuestionState(ctx context.Context, quizID string) (*activeQuestionState, error) {
+	active, err := s.redis.HGetAll(ctx, activeQuestionKey(quizID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if active["question_id"] == "" {
+		return nil, nil
+	}
+	openedAt, err := strconv.ParseInt(active["opened_at"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &activeQuestionState{questionID: active["question_id"], openedAt: time.UnixMilli(openedAt)}
+	if state.closesAt, err = parseOptionalMillis(active["closes_at"]); err != nil {
+		return nil, err
+	}
+	if state.closedAt, err = parseOptionalMillis(active["closed_at"]); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// parseOptionalMillis parses a Unix time in milliseconds, or returns nil
+// for an empty one.
+func parseOptionalMillis(v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	t := time.UnixMilli(ms)
+	return &t, nil
+}
+
+// getQuizQuestion loads a question, checking that it belongs to the quiz.
+func (s *QuizService) getQuizQuestion(ctx context.Context, quizID, questionID string) (*models.Question, error) {
+	question, err := s.db.GetQuestion(ctx, questionID)
+	if err != nil {
+		return nil, err
+	}
+	if question.QuizID != quizID {
+		return nil, apperrors.ErrQuestionNotInQuiz
+	}
+	return question, nil
+}
+
+// GetActiveQuestion returns the question currently open in the quiz, or nil
+// while the quiz is still in the lobby. Questions the host has closed have
+// no time remaining.
+func (s *QuizService) GetActiveQuestion(ctx context.Context, quizID string) (*ActiveQuestion, error) {
+	state, err := s.activeQuestionState(ctx, quizID)
+	if err != nil || state == nil {
+		return nil, err
+	}
+
+	question, err := s.db.GetQuestion(ctx, state.questionID)
+	if err != nil {
+		return nil, err
+	}
+	active := newActiveQuestion(question, state.openedAt, time.Now())
+	if state.closedAt != nil {
+		var remaining int64
+		active.ClosesAt = state.closedAt
+		active.RemainingMs = &remaining
+	}
+	return active, nil
+}
+
+// responseTime returns how long after the question was opened the answer
+// arrived. Only the quiz's active question can be answered, and only while
+// it is open: before any question has been opened answers are refused with
+// ErrQuestionNotOpen, and once the host has closed the question, or opened
+// another, with ErrQuestionClosed.
+func (s *QuizService) responseTime(ctx context.Context, quizID, questionID string, answeredAt time.Time) (int, error) {
+	state, err := s.activeQuestionState(ctx, quizID)
+	if err != nil {
+		return 0, err
+	}
+	if state == nil {
+		return 0, apperrors.ErrQuestionNotOpen
+	}
+	if state.questionID != questionID || state.closedAt != nil {
+		return 0, apperrors.ErrQuestionClosed
+	}
+	ms := int(answeredAt.UnixMilli() - state.openedAt.UnixMilli())
+	if ms < 0 {
+		ms = 0
+	}
+	return ms, nil
+}
+
+func (s *QuizService) GetUserResults(ctx context.Context, quizID, userID string) (*QuizResult, error) {
+	score, err := s.db.GetUserScore(ctx, quizID, userID)
+	if err != nil {
+		return nil, err
+	}
+	answers, err := s.db.GetUserQuizAnswers(ctx, quizID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if answers == nil {
+		answers = []models.AnswerRecord{}
+	}
+	return &QuizResult{
+		QuizID:  quizID,
+		UserID:  userID,
+		Score:   score,
+		Answers: answers,
+	}, nil
+}
+
+func (s *QuizService) GetUserHistory(ctx context.Context, userID string, page, pageSize int) (*PaginatedHistory, error) {
+	history, totalCount, err := s.db.GetUserAnswerHistory(ctx, userID, page, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	if history == nil {
+		history = []models.AnswerRecord{}
+	}
+	return &PaginatedHistory{
+		History:    history,
+		TotalCount: totalCount,
+		Page:       page,
+		PageSize:   pageSize,
+	}, nil
+}
@@ -0,0 +1,256 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+// Period is the time span a global leaderboard aggregates scores over.
+type Period string
+
+const (
+	PeriodDaily   Period = "daily"
+	PeriodWeekly  Period = "weekly"
+	PeriodMonthly Period = "monthly"
+	PeriodAllTime Period = "alltime"
+)
+
+const (
+	// archiveRetention is how long a finished period stays in Redis after
+	// it ends, giving the archiver time to copy it to Postgres.
+	archiveRetention = 7 * 24 * time.Hour
+	// archiveGracePeriod is how long the archiver waits after a period ends
+	// before copying it. Points count towards the period they were scored
+	// in, and the outbox may still be applying, or retrying, ones scored
+	// just before it ended.
+	archiveGracePeriod = 15 * time.Minute
+)
+
+var periods = []Period{PeriodDaily, PeriodWeekly, PeriodMonthly, PeriodAllTime}
+
+// ParsePeriod parses a period name, defaulting to all-time when empty.
+func ParsePeriod(s string) (Period, error) {
+	switch Period(s) {
+	case "", "all-time", PeriodAllTime:
+		return PeriodAllTime, nil
+	case PeriodDaily, PeriodWeekly, PeriodMonthly:
+		return Period(s), nil
+	}
+	return "", apperrors.ErrInvalidPeriod
+}
+
+// bounds returns the start and end of the bucket containing t. The
+// all-time period has a single bucket with zero bounds.
+func (p Period) bounds(t time.Time) (time.Time, time.Time) {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch p {
+	case PeriodDaily:
+		return day, day.AddDate(0, 0, 1)
+	case PeriodWeekly:
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	case PeriodMonthly:
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+	return time.Time{}, time.Time{}
+}
+
+// bucket names the bucket containing t, e.g. "2024-01-31", "2024-W05" or
+// "2024-01".
+func (p Period) bucket(t time.Time) string {
+	start, _ := p.bounds(t)
+	switch p {
+	case PeriodDaily:
+		return start.Format("2006-01-02")
+	case PeriodWeekly:
+		year, week := start.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case PeriodMonthly:
+		return start.Format("2006-01")
+	}
+	return "all"
+}
+
+// finishedBuckets names the buckets that finished at least
+// archiveGracePeriod before t and are still in Redis, most recent first.
+func (p Period) finishedBuckets(t time.Time) []string {
+	var buckets []string
+	end, _ := p.bounds(t.Add(-archiveGracePeriod))
+	for !end.IsZero() && end.Add(archiveRetention).After(t) {
+		start, _ := p.bounds(end.Add(-time.Second))
+		buckets = append(buckets, p.bucket(start))
+		end = start
+	}
+	return buckets
+}
+
+func globalLeaderboardKey(period Period, bucket string) string {
+	return fmt.Sprintf("leaderboard:global:%s:%s", period, bucket)
+}
+
+type GlobalLeaderboard struct {
+	Period Period `json:"period"`
+	Bucket string `json:"bucket"`
+	PaginatedLeaderboard
+}
+
+// globalBuckets returns the key of every period's bucket that points
+// scored at count towards, with when each expires, or 0 for buckets that
+// never end. Buckets expire once they have had time to be archived, which
+// is what rolls the periods over.
+func globalBuckets(at time.Time) ([]string, []int64) {
+	keys := make([]string, len(periods))
+	expireAt := make([]int64, len(periods))
+	for i, period := range periods {
+		keys[i] = globalLeaderboardKey(period, period.bucket(at))
+		if _, end := period.bounds(at); !end.IsZero() {
+			expireAt[i] = end.Add(archiveRetention).Unix()
+		}
+	}
+	return keys, expireAt
+}
+
+// GetGlobalLeaderboard returns standings across all quizzes for a bucket of
+// the period, defaulting to the current one. Buckets that are no longer in
+// Redis are read from the archive.
+func (s *QuizService) GetGlobalLeaderboard(ctx context.Context, period Period, bucket string, page, pageSize int) (*GlobalLeaderboard, error) {
+	if bucket == "" {
+		bucket = period.bucket(time.Now())
+	}
+	result := &GlobalLeaderboard{
+		Period: period,
+		Bucket: bucket,
+		PaginatedLeaderboard: PaginatedLeaderboard{
+			Leaderboard: []models.LeaderboardEntry{},
+			Page:        page,
+			PageSize:    pageSize,
+		},
+	}
+
+	key := globalLeaderboardKey(period, bucket)
+	totalCount, err := s.redis.ZCard(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if totalCount == 0 && bucket != period.bucket(time.Now()) {
+		leaderboard, totalCount, err := s.db.GetArchivedLeaderboard(ctx, string(period), bucket, page, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		if leaderboard != nil {
+			result.Leaderboard = leaderboard
+		}
+		result.TotalCount = totalCount
+		return result, nil
+	}
+
+	start := int64((page - 1) * pageSize)
+	members, err := s.redis.ZRevRangeWithScores(ctx, key, start, start+int64(pageSize)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	leaderboard, err := s.leaderboardEntries(ctx, members)
+	if err != nil {
+		return nil, err
+	}
+	result.Leaderboard = leaderboard
+	result.TotalCount = int(totalCount)
+	return result, nil
+}
+
+// leaderboardEntries turns sorted set members keyed by user ID into
+// leaderboard entries with usernames.
+func (s *QuizService) leaderboardEntries(ctx context.Context, members []redis.Z) ([]models.LeaderboardEntry, error) {
+	entries := make([]models.LeaderboardEntry, len(members))
+	if len(members) == 0 {
+		return entries, nil
+	}
+	userIDs := make([]string, len(members))
+	for i, m := range members {
+		userIDs[i] = fmt.Sprint(m.Member)
+	}
+	usernames, err := s.db.GetUsernames(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range members {
+		entries[i] = models.LeaderboardEntry{
+			UserID:   userIDs[i],
+			Username: usernames[userIDs[i]],
+			Score:    int(m.Score),
+		}
+	}
+	return entries, nil
+}
+
+// ArchiveFinishedPeriods copies every finished bucket of every period that
+// hasn't been archived yet from Redis to Postgres, so that buckets missed
+// while the archiver wasn't running are caught up on. Buckets are left for
+// archiveGracePeriod after they finish, for late points to arrive. It is
+// safe to call repeatedly.
+func (s *QuizService) ArchiveFinishedPeriods(ctx context.Context, now time.Time) error {
+	for _, period := range []Period{PeriodDaily, PeriodWeekly, PeriodMonthly} {
+		for _, bucket := range period.finishedBuckets(now) {
+			if err := s.archiveBucket(ctx, period, bucket); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveBucket copies a finished bucket to Postgres unless it has already
+// been archived.
+func (s *QuizService) archiveBucket(ctx context.Context, period Period, bucket string) error {
+	key := globalLeaderboardKey(period, bucket)
+	archivedKey := key + ":archived"
+
+	archived, err := s.redis.Exists(ctx, archivedKey).Result()
+	if err != nil {
+		return err
+	}
+	if archived > 0 {
+		return nil
+	}
+
+	members, err := s.redis.ZRevRangeWithScores(ctx, key, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	if len(members) > 0 {
+		entries := make([]models.LeaderboardEntry, len(members))
+		for i, m := range members {
+			entries[i] = models.LeaderboardEntry{UserID: fmt.Sprint(m.Member), Score: int(m.Score)}
+		}
+		if err := s.db.ArchiveLeaderboard(ctx, string(period), bucket, entries); err != nil {
+			return err
+		}
+	}
+
+	return s.redis.Set(ctx, archivedKey, 1, archiveRetention).Err()
+}
+
+// RunLeaderboardArchiver archives finished periods every interval until ctx
+// is cancelled.
+func (s *QuizService) RunLeaderboardArchiver(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.ArchiveFinishedPeriods(ctx, time.Now()); err != nil {
+			log.Printf("Error archiving leaderboards: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
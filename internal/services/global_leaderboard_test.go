@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-redis/redis/v8"
+	"github.com/go-redis/redismock/v8"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/database"
+)
+
+func TestPeriodBuckets(t *testing.T) {
+	// Wednesday 31 January 2024
+	at := time.Date(2024, 1, 31, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		period Period
+		bucket string
+		end    time.Time
+	}{
+		{PeriodDaily, "2024-01-31", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{PeriodWeekly, "2024-W05", time.Date(2024, 2, 5, 0, 0, 0, 0, time.UTC)},
+		{PeriodMonthly, "2024-01", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{PeriodAllTime, "all", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.period), func(t *testing.T) {
+			assert.Equal(t, tt.bucket, tt.period.bucket(at))
+			_, end := tt.period.bounds(at)
+			assert.Equal(t, tt.end, end)
+		})
+	}
+}
+
+func TestFinishedBuckets(t *testing.T) {
+	// Wednesday 31 January 2024
+	at := time.Date(2024, 1, 31, 15, 4, 5, 0, time.UTC)
+
+	assert.Equal(t, []string{
+		"2024-01-30", "2024-01-29", "2024-01-28", "2024-01-27",
+		"2024-01-26", "2024-01-25", "2024-01-24",
+	}, PeriodDaily.finishedBuckets(at))
+	assert.Equal(t, []string{"2024-W04"}, PeriodWeekly.finishedBuckets(at))
+	// December expired from Redis a week into January
+	assert.Empty(t, PeriodMonthly.finishedBuckets(at))
+	assert.Empty(t, PeriodAllTime.finishedBuckets(at))
+
+	// Periods that have only just finished are left for late points
+	at = time.Date(2024, 2, 1, 0, 5, 0, 0, time.UTC)
+	assert.Equal(t, "2024-01-30", PeriodDaily.finishedBuckets(at)[0])
+	assert.Empty(t, PeriodMonthly.finishedBuckets(at))
+	at = at.Add(archiveGracePeriod)
+	assert.Equal(t, "2024-01-31", PeriodDaily.finishedBuckets(at)[0])
+	assert.Equal(t, []string{"2024-01"}, PeriodMonthly.finishedBuckets(at))
+}
+
+func TestParsePeriod(t *testing.T) {
+	period, err := ParsePeriod("")
+	assert.NoError(t, err)
+	assert.Equal(t, PeriodAllTime, period)
+
+	period, err = ParsePeriod("weekly")
+	assert.NoError(t, err)
+	assert.Equal(t, PeriodWeekly, period)
+
+	_, err = ParsePeriod("hourly")
+	assert.ErrorIs(t, err, apperrors.ErrInvalidPeriod)
+}
+
+func TestGetGlobalLeaderboard_FromRedis(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+
+	key := globalLeaderboardKey(PeriodWeekly, PeriodWeekly.bucket(time.Now()))
+	redisMock.ExpectZCard(key).SetVal(3)
+	redisMock.ExpectZRevRangeWithScores(key, 0, 1).SetVal([]redis.Z{
+		{Member: "user2", Score: 7},
+		{Member: "user1", Score: 4},
+	})
+	mock.ExpectQuery(`SELECT id, COALESCE\(NULLIF\(display_name, ''\), username\) FROM users WHERE id = ANY\(\$1\)`).
+		WithArgs(pq.StringArray{"user2", "user1"}).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow("user1", "Alice").AddRow("user2", "Bob"))
+
+	got, err := s.GetGlobalLeaderboard(context.Background(), PeriodWeekly, "", 1, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, got.TotalCount)
+	assert.Len(t, got.Leaderboard, 2)
+	assert.Equal(t, "Bob", got.Leaderboard[0].Username)
+	assert.Equal(t, 7, got.Leaderboard[0].Score)
+	assert.Equal(t, "user1", got.Leaderboard[1].UserID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestArchiveFinishedPeriods(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+	now := time.Date(2024, 2, 1, 0, 20, 0, 0, time.UTC)
+
+	// The day has finished and has scores to archive
+	daily := globalLeaderboardKey(PeriodDaily, "2024-01-31")
+	redisMock.ExpectExists(daily + ":archived").SetVal(0)
+	redisMock.ExpectZRevRangeWithScores(daily, 0, -1).SetVal([]redis.Z{
+		{Member: "user1", Score: 5},
+		{Member: "user2", Score: 5},
+		{Member: "user3", Score: 2},
+	})
+	mock.ExpectExec(`INSERT INTO leaderboard_archives`).
+		WithArgs("daily", "2024-01-31", pq.StringArray{"user1", "user2", "user3"},
+			pq.Int64Array{5, 5, 2}, pq.Int64Array{1, 1, 3}).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	redisMock.ExpectSet(daily+":archived", 1, archiveRetention).SetVal("OK")
+
+	// The day before was archived, but the one before that was missed
+	redisMock.ExpectExists(globalLeaderboardKey(PeriodDaily, "2024-01-30") + ":archived").SetVal(1)
+	missed := globalLeaderboardKey(PeriodDaily, "2024-01-29")
+	redisMock.ExpectExists(missed + ":archived").SetVal(0)
+	redisMock.ExpectZRevRangeWithScores(missed, 0, -1).SetVal([]redis.Z{{Member: "user2", Score: 3}})
+	mock.ExpectExec(`INSERT INTO leaderboard_archives`).
+		WithArgs("daily", "2024-01-29", pq.StringArray{"user2"}, pq.Int64Array{3}, pq.Int64Array{1}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	redisMock.ExpectSet(missed+":archived", 1, archiveRetention).SetVal("OK")
+	for _, bucket := range []string{"2024-01-28", "2024-01-27", "2024-01-26", "2024-01-25"} {
+		redisMock.ExpectExists(globalLeaderboardKey(PeriodDaily, bucket) + ":archived").SetVal(1)
+	}
+
+	// The week was archived on an earlier run
+	redisMock.ExpectExists(globalLeaderboardKey(PeriodWeekly, "2024-W04") + ":archived").SetVal(1)
+
+	// Nobody scored last month
+	monthly := globalLeaderboardKey(PeriodMonthly, "2024-01")
+	redisMock.ExpectExists(monthly + ":archived").SetVal(0)
+	redisMock.ExpectZRevRangeWithScores(monthly, 0, -1).SetVal([]redis.Z{})
+	redisMock.ExpectSet(monthly+":archived", 1, archiveRetention).SetVal("OK")
+
+	assert.NoError(t, s.ArchiveFinishedPeriods(context.Background(), now))
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestArchiveFinishedPeriods_LatePoints(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+	ctx := context.Background()
+	expectArchived := func() {
+		for _, bucket := range []string{"2024-01-30", "2024-01-29", "2024-01-28", "2024-01-27", "2024-01-26", "2024-01-25"} {
+			redisMock.ExpectExists(globalLeaderboardKey(PeriodDaily, bucket) + ":archived").SetVal(1)
+		}
+		redisMock.ExpectExists(globalLeaderboardKey(PeriodWeekly, "2024-W04") + ":archived").SetVal(1)
+	}
+
+	// Just after midnight, the day and month that ended are left alone
+	expectArchived()
+	assert.NoError(t, s.ArchiveFinishedPeriods(ctx, time.Date(2024, 2, 1, 0, 5, 0, 0, time.UTC)))
+
+	// An answer given just before midnight has been applied since, so the
+	// archives include its points
+	for _, period := range []Period{PeriodDaily, PeriodMonthly} {
+		bucket := period.bucket(time.Date(2024, 1, 31, 23, 59, 59, 0, time.UTC))
+		key := globalLeaderboardKey(period, bucket)
+		redisMock.ExpectExists(key + ":archived").SetVal(0)
+		redisMock.ExpectZRevRangeWithScores(key, 0, -1).SetVal([]redis.Z{{Member: "user1", Score: 3}})
+		mock.ExpectExec(`INSERT INTO leaderboard_archives`).
+			WithArgs(string(period), bucket, pq.StringArray{"user1"}, pq.Int64Array{3}, pq.Int64Array{1}).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		redisMock.ExpectSet(key+":archived", 1, archiveRetention).SetVal("OK")
+		if period == PeriodDaily {
+			expectArchived()
+		}
+	}
+	assert.NoError(t, s.ArchiveFinishedPeriods(ctx, time.Date(2024, 2, 1, 0, 20, 0, 0, time.UTC)))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"realtime_leaderboard/internal/models"
+)
+
+// Grade is the outcome of checking an answer against a question.
+type Grade struct {
+	Correct bool
+	Points  int
+}
+
+// validator returns the fraction of the question's points earned by an
+// answer, between 0 and 1.
+type validator func(q *models.Question, answer models.Answer) float64
+
+var validators = map[models.QuestionType]validator{
+	models.QuestionTypeSingleChoice:   validateSingleChoice,
+	models.QuestionTypeMultipleSelect: validateMultipleSelect,
+	models.QuestionTypeTrueFalse:      validateTrueFalse,
+	models.QuestionTypeNumeric:        validateNumeric,
+	models.QuestionTypeFreeText:       validateFreeText,
+	models.QuestionTypeOrdering:       validateOrdering,
+}
+
+// GradeAnswer grades an answer with the validator registered for the
+// question's type. Questions without a type are graded as single choice.
+func GradeAnswer(q *models.Question, answer models.Answer) (Grade, error) {
+	questionType := q.Type
+	if questionType == "" {
+		questionType = models.QuestionTypeSingleChoice
+	}
+	validate, ok := validators[questionType]
+	if !ok {
+		return Grade{}, fmt.Errorf("unsupported question type %q", q.Type)
+	}
+
+	credit := validate(q, answer)
+	return Grade{
+		Correct: credit >= 1,
+		Points:  int(math.Round(credit * float64(q.Points))),
+	}, nil
+}
+
+func validateSingleChoice(q *models.Question, answer models.Answer) float64 {
+	if len(answer) != 1 {
+		return 0
+	}
+	for _, option := range q.Options {
+		if option.ID == answer[0] && option.IsCorrect {
+			return 1
+		}
+	}
+	return 0
+}
+
+func validateMultipleSelect(q *models.Question, answer models.Answer) float64 {
+	correct := make(map[string]bool, len(q.Options))
+	for _, option := range q.Options {
+		if option.IsCorrect {
+			correct[option.ID] = true
+		}
+	}
+	if len(correct) == 0 {
+		return 0
+	}
+
+	hits, misses := 0, 0
+	seen := make(map[string]bool, len(answer))
+	for _, option := range answer {
+		if seen[option] {
+			continue
+		}
+		seen[option] = true
+		if correct[option] {
+			hits++
+		} else {
+			misses++
+		}
+	}
+
+	if hits == len(correct) && misses == 0 {
+		return 1
+	}
+	if !q.PartialCredit {
+		return 0
+	}
+	// Each wrong selection cancels out a right one so that selecting every
+	// option never earns credit.
+	return math.Max(0, float64(hits-misses)/float64(len(correct)))
+}
+
+func validateTrueFalse(q *models.Question, answer models.Answer) float64 {
+	if len(answer) != 1 {
+		return 0
+	}
+	want, err := strconv.ParseBool(strings.ToLower(strings.TrimSpace(q.CorrectAnswer)))
+	if err != nil {
+		return 0
+	}
+	got, err := strconv.ParseBool(strings.ToLower(strings.TrimSpace(answer[0])))
+	if err != nil || got != want {
+		return 0
+	}
+	return 1
+}
+
+func validateNumeric(q *models.Question, answer models.Answer) float64 {
+	if len(answer) != 1 {
+		return 0
+	}
+	want, err := strconv.ParseFloat(strings.TrimSpace(q.CorrectAnswer), 64)
+	if err != nil {
+		return 0
+	}
+	got, err := strconv.ParseFloat(strings.TrimSpace(answer[0]), 64)
+	if err != nil || math.Abs(got-want) > q.Tolerance {
+		return 0
+	}
+	return 1
+}
+
+func validateFreeText(q *models.Question, answer models.Answer) float64 {
+	if len(answer) != 1 {
+		return 0
+	}
+	got := normaliseText(answer[0])
+	if got == normaliseText(q.CorrectAnswer) {
+		return 1
+	}
+	for _, alternative := range q.CorrectAnswers {
+		if got == normaliseText(alternative) {
+			return 1
+		}
+	}
+	return 0
+}
+
+func validateOrdering(q *models.Question, answer models.Answer) float64 {
+	sequence := correctSequence(q.Options)
+	if len(sequence) == 0 {
+		return 0
+	}
+	inPlace := 0
+	for i, optionID := range sequence {
+		if i < len(answer) && answer[i] == optionID {
+			inPlace++
+		}
+	}
+
+	if inPlace == len(sequence) && len(answer) == len(sequence) {
+		return 1
+	}
+	if !q.PartialCredit {
+		return 0
+	}
+	return float64(inPlace) / math.Max(float64(len(sequence)), float64(len(answer)))
+}
+
+// correctSequence returns the option IDs of an ordering question in their
+// correct order. Options without a correct position are left out.
+func correctSequence(options []models.QuestionOption) []string {
+	ordered := make([]models.QuestionOption, 0, len(options))
+	for _, option := range options {
+		if option.CorrectPosition != nil {
+			ordered = append(ordered, option)
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return *ordered[i].CorrectPosition < *ordered[j].CorrectPosition
+	})
+
+	sequence := make([]string, len(ordered))
+	for i, option := range ordered {
+		sequence[i] = option.ID
+	}
+	return sequence
+}
+
+// normaliseText lowercases s and collapses runs of whitespace so that
+// free-text answers don't fail on capitalisation or stray spaces.
+func normaliseText(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"realtime_leaderboard/internal/models"
+)
+
+func TestGradeAnswer(t *testing.T) {
+	tests := []struct {
+		name     string
+		question models.Question
+		answer   models.Answer
+		want     Grade
+	}{
+		{
+			name:     "single choice correct",
+			question: models.Question{Type: models.QuestionTypeSingleChoice, Options: options("a", "b"), Points: 1},
+			answer:   models.Answer{"opt-b"},
+			want:     Grade{Correct: true, Points: 1},
+		},
+		{
+			name:     "single choice matches option IDs, not text",
+			question: models.Question{Type: models.QuestionTypeSingleChoice, Options: options("a", "b"), Points: 1},
+			answer:   models.Answer{"b"},
+			want:     Grade{},
+		},
+		{
+			name:     "untyped question graded as single choice",
+			question: models.Question{Options: options("a", "b"), Points: 1},
+			answer:   models.Answer{"opt-a"},
+			want:     Grade{},
+		},
+		{
+			name: "multiple select exact set",
+			question: models.Question{Type: models.QuestionTypeMultipleSelect,
+				Options: options("a", "b", "c"), Points: 4},
+			answer: models.Answer{"opt-c", "opt-b"},
+			want:   Grade{Correct: true, Points: 4},
+		},
+		{
+			name: "multiple select without partial credit",
+			question: models.Question{Type: models.QuestionTypeMultipleSelect,
+				Options: options("a", "b", "c"), Points: 4},
+			answer: models.Answer{"opt-b"},
+			want:   Grade{},
+		},
+		{
+			name: "multiple select partial credit",
+			question: models.Question{Type: models.QuestionTypeMultipleSelect,
+				Options: options("a", "b", "c", "d", "e"), PartialCredit: true, Points: 4},
+			answer: models.Answer{"opt-b", "opt-c", "opt-d", "opt-a"},
+			want:   Grade{Points: 2},
+		},
+		{
+			name:     "true false accepts any casing",
+			question: models.Question{Type: models.QuestionTypeTrueFalse, CorrectAnswer: "true", Points: 1},
+			answer:   models.Answer{"TRUE"},
+			want:     Grade{Correct: true, Points: 1},
+		},
+		{
+			name:     "numeric within tolerance",
+			question: models.Question{Type: models.QuestionTypeNumeric, CorrectAnswer: "3.14", Tolerance: 0.01, Points: 1},
+			answer:   models.Answer{"3.1415"},
+			want:     Grade{Correct: true, Points: 1},
+		},
+		{
+			name:     "numeric outside tolerance",
+			question: models.Question{Type: models.QuestionTypeNumeric, CorrectAnswer: "3.14", Tolerance: 0.01, Points: 1},
+			answer:   models.Answer{"3.2"},
+			want:     Grade{},
+		},
+		{
+			name:     "numeric rejects non-numbers",
+			question: models.Question{Type: models.QuestionTypeNumeric, CorrectAnswer: "3", Points: 1},
+			answer:   models.Answer{"three"},
+			want:     Grade{},
+		},
+		{
+			name: "free text normalises whitespace and case",
+			question: models.Question{Type: models.QuestionTypeFreeText, CorrectAnswer: "New York",
+				CorrectAnswers: pq.StringArray{"NYC"}, Points: 1},
+			answer: models.Answer{"  new   york "},
+			want:   Grade{Correct: true, Points: 1},
+		},
+		{
+			name: "free text accepted alternative",
+			question: models.Question{Type: models.QuestionTypeFreeText, CorrectAnswer: "New York",
+				CorrectAnswers: pq.StringArray{"NYC"}, Points: 1},
+			answer: models.Answer{"nyc"},
+			want:   Grade{Correct: true, Points: 1},
+		},
+		{
+			name:     "ordering exact sequence",
+			question: models.Question{Type: models.QuestionTypeOrdering, Options: ordering("x", "y", "z"), Points: 3},
+			answer:   models.Answer{"opt-z", "opt-y", "opt-x"},
+			want:     Grade{Correct: true, Points: 3},
+		},
+		{
+			name: "ordering partial credit",
+			question: models.Question{Type: models.QuestionTypeOrdering, Options: ordering("x", "y", "z"),
+				PartialCredit: true, Points: 3},
+			answer: models.Answer{"opt-z", "opt-x", "opt-y"},
+			want:   Grade{Points: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GradeAnswer(&tt.question, tt.answer)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGradeAnswer_UnknownType(t *testing.T) {
+	_, err := GradeAnswer(&models.Question{Type: "essay"}, models.Answer{"anything"})
+	assert.Error(t, err)
+}
+
+// options builds choice options with IDs "opt-<name>". Every option after
+// the first is marked correct.
+func options(names ...string) []models.QuestionOption {
+	result := make([]models.QuestionOption, len(names))
+	for i, name := range names {
+		result[i] = models.QuestionOption{ID: "opt-" + name, Position: i + 1, Text: name, IsCorrect: i > 0}
+	}
+	return result
+}
+
+// ordering builds ordering options whose correct sequence is the reverse
+// of their display order.
+func ordering(names ...string) []models.QuestionOption {
+	result := make([]models.QuestionOption, len(names))
+	for i, name := range names {
+		correctPosition := len(names) - i
+		result[i] = models.QuestionOption{ID: "opt-" + name, Position: i + 1, Text: name, CorrectPosition: &correctPosition}
+	}
+	return result
+}
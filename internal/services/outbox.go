@@ -0,0 +1,179 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"realtime_leaderboard/internal/models"
+)
+
+const (
+	// outboxBatchSize is how many outbox events are claimed at a time.
+	outboxBatchSize = 100
+	// outboxClaimTTL is how long a relay has to handle the events it has
+	// claimed before other relays may claim them again.
+	outboxClaimTTL = time.Minute
+	// outboxAppliedTTL is how long Redis remembers which events it has
+	// applied, so that a retried event doesn't count its points twice.
+	outboxAppliedTTL = 24 * time.Hour
+)
+
+// AnswerHandler is called for every committed answer, after the
+// leaderboard caches have been updated.
+type AnswerHandler func(ctx context.Context, answer *models.AnswerRecord)
+
+func outboxAppliedKey(eventID int64) string {
+	return fmt.Sprintf("outbox:%d:applied", eventID)
+}
+
+// OnAnswerRecorded registers a handler for committed answers.
+func (s *QuizService) OnAnswerRecorded(handler AnswerHandler) {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	s.answerHandlers = append(s.answerHandlers, handler)
+}
+
+func (s *QuizService) wakeOutboxRelay() {
+	select {
+	case s.outboxReady <- struct{}{}:
+	default:
+	}
+}
+
+// ProcessOutbox carries out the side effects of committed writes until the
+// outbox is empty.
+func (s *QuizService) ProcessOutbox(ctx context.Context) error {
+	for {
+		events, err := s.db.ClaimOutbox(ctx, outboxBatchSize, outboxClaimTTL)
+		if err != nil {
+			return err
+		}
+		if err := s.processOutboxBatch(ctx, events); err != nil || len(events) < outboxBatchSize {
+			return err
+		}
+	}
+}
+
+// processOutboxBatch handles the claimed events in order, stopping at the
+// first failure. The leaderboard caches of quizzes that scored are then
+// refreshed once for the batch, before the answer handlers are notified of
+// its answers. Handled events are deleted and the rest released to be
+// retried.
+func (s *QuizService) processOutboxBatch(ctx context.Context, events []models.OutboxEvent) error {
+	var answers []*models.AnswerRecord
+	handled := 0
+	var handleErr error
+	for _, e := range events {
+		var answer *models.AnswerRecord
+		if answer, handleErr = s.handleOutboxEvent(ctx, e); handleErr != nil {
+			break
+		}
+		if answer != nil {
+			answers = append(answers, answer)
+		}
+		handled++
+	}
+	s.answersApplied(ctx, answers)
+
+	if err := s.db.DeleteOutboxEvents(ctx, outboxEventIDs(events[:handled])); err != nil {
+		return err
+	}
+	if handleErr != nil {
+		if err := s.db.ReleaseOutboxEvents(ctx, outboxEventIDs(events[handled:])); err != nil {
+			log.Printf("Error releasing outbox events: %v", err)
+		}
+	}
+	return handleErr
+}
+
+func outboxEventIDs(events []models.OutboxEvent) []int64 {
+	ids := make([]int64, len(events))
+	for i, e := range events {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+// RunOutboxRelay processes the outbox whenever an answer is committed, and
+// every interval to pick up events left behind by failures or by other
+// server instances, until ctx is cancelled.
+func (s *QuizService) RunOutboxRelay(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.ProcessOutbox(ctx); err != nil {
+			log.Printf("Error processing outbox: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.outboxReady:
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleOutboxEvent carries out the event, returning its answer for answer
+// events.
+func (s *QuizService) handleOutboxEvent(ctx context.Context, e models.OutboxEvent) (*models.AnswerRecord, error) {
+	switch e.Type {
+	case models.OutboxEventAnswerRecorded:
+		var answer models.AnswerRecord
+		if err := json.Unmarshal(e.Payload, &answer); err != nil {
+			return nil, err
+		}
+		if answer.Points > 0 {
+			if err := s.applyPoints(ctx, e.ID, &answer); err != nil {
+				return nil, err
+			}
+		}
+		return &answer, nil
+	case models.OutboxEventQuizTransition:
+		var transition models.QuizTransition
+		if err := json.Unmarshal(e.Payload, &transition); err != nil {
+			return nil, err
+		}
+		return nil, s.applyQuizTransition(ctx, &transition)
+	}
+	log.Printf("Dropping outbox event %d of unknown type %q", e.ID, e.Type)
+	return nil, nil
+}
+
+// answersApplied refreshes the leaderboard cache of every quiz the answers
+// scored in, then notifies the answer handlers.
+func (s *QuizService) answersApplied(ctx context.Context, answers []*models.AnswerRecord) {
+	refreshed := make(map[string]bool)
+	for _, answer := range answers {
+		if answer.Points == 0 || refreshed[answer.QuizID] {
+			continue
+		}
+		refreshed[answer.QuizID] = true
+		if err := s.refreshLeaderboardCache(ctx, answer.QuizID); err != nil {
+			log.Printf("Error refreshing leaderboard of quiz %s: %v", answer.QuizID, err)
+		}
+	}
+
+	s.handlersMu.RLock()
+	handlers := s.answerHandlers
+	s.handlersMu.RUnlock()
+	for _, answer := range answers {
+		for _, handler := range handlers {
+			handler(ctx, answer)
+		}
+	}
+}
+
+// refreshLeaderboardCache clears the quiz's cached leaderboard pages and
+// caches the first page again.
+func (s *QuizService) refreshLeaderboardCache(ctx context.Context, quizID string) error {
+	if keys, err := s.redis.Keys(ctx, fmt.Sprintf("quiz:%s:leaderboard:*", quizID)).Result(); err == nil {
+		for _, key := range keys {
+			s.redis.Del(ctx, key)
+		}
+	}
+	_, err := s.GetLeaderboard(ctx, quizID, 1, 10)
+	return err
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-redis/redis/v8"
+	"github.com/go-redis/redismock/v8"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"realtime_leaderboard/internal/database"
+	"realtime_leaderboard/internal/models"
+)
+
+// expectOutbox mocks the query that claims outbox events.
+func expectOutbox(mock sqlmock.Sqlmock, events ...models.OutboxEvent) {
+	rows := sqlmock.NewRows([]string{"id", "event_type", "quiz_id", "payload", "created_at"})
+	for _, e := range events {
+		rows.AddRow(e.ID, e.Type, e.QuizID, []byte(e.Payload), e.CreatedAt)
+	}
+	mock.ExpectQuery(`UPDATE outbox SET claimed_until`).
+		WithArgs(outboxBatchSize, outboxClaimTTL.Milliseconds()).
+		WillReturnRows(rows)
+}
+
+func answerRecorded(t *testing.T, id int64, answer models.AnswerRecord) models.OutboxEvent {
+	payload, err := json.Marshal(answer)
+	assert.NoError(t, err)
+	return models.OutboxEvent{ID: id, Type: models.OutboxEventAnswerRecorded, QuizID: answer.QuizID, Payload: payload}
+}
+
+// expectApplyPoints mocks adding an answer's points to quiz1's scores and
+// the global leaderboards.
+func expectApplyPoints(redisMock redismock.ClientMock, eventID int64, userID string, points int, at time.Time) *redismock.ExpectedCmd {
+	buckets, expireAt := globalBuckets(at)
+	keys := append([]string{outboxAppliedKey(eventID), "quiz:quiz1:scores"}, buckets...)
+	args := []interface{}{points, userID, int(outboxAppliedTTL.Seconds()), int(quizScoresTTL.Seconds())}
+	for _, at := range expireAt {
+		args = append(args, at)
+	}
+	return redisMock.ExpectEvalSha(applyPointsScript.Hash(), keys, args...)
+}
+
+func TestProcessOutbox(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+
+	var recorded []*models.AnswerRecord
+	s.OnAnswerRecorded(func(ctx context.Context, answer *models.AnswerRecord) {
+		recorded = append(recorded, answer)
+	})
+
+	answeredAt := time.Now().UTC().Truncate(time.Millisecond)
+	first := answerRecorded(t, 7, models.AnswerRecord{ID: 1, QuizID: "quiz1", QuestionID: "q1", UserID: "user1",
+		Answer: models.Answer{"q1-2"}, Correct: true, Points: 1, AnsweredAt: answeredAt})
+	// A retried event has already been applied
+	retried := answerRecorded(t, 8, models.AnswerRecord{ID: 2, QuizID: "quiz1", QuestionID: "q2", UserID: "user2",
+		Answer: models.Answer{"4"}, Correct: true, Points: 2, AnsweredAt: answeredAt})
+	wrong := answerRecorded(t, 9, models.AnswerRecord{ID: 3, QuizID: "quiz1", QuestionID: "q2", UserID: "user1",
+		Answer: models.Answer{"5"}, AnsweredAt: answeredAt})
+	expectOutbox(mock, first, retried, wrong)
+
+	// The quiz's scores aren't in Redis yet, so they are loaded without the
+	// points of answers still to be applied
+	expectApplyPoints(redisMock, 7, "user1", 1, answeredAt).SetVal(int64(0))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT quiz_id, user_id, score\s+FROM quiz_scores`).
+		WithArgs("quiz1").
+		WillReturnRows(sqlmock.NewRows([]string{"quiz_id", "user_id", "score"}).
+			AddRow("quiz1", "user1", 1).
+			AddRow("quiz1", "user2", 2))
+	mock.ExpectQuery(`SELECT id, event_type, quiz_id, payload, created_at\s+FROM outbox`).
+		WithArgs("quiz1", models.OutboxEventAnswerRecorded).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "event_type", "quiz_id", "payload", "created_at"}).
+			AddRow(first.ID, first.Type, first.QuizID, []byte(first.Payload), first.CreatedAt).
+			AddRow(retried.ID, retried.Type, retried.QuizID, []byte(retried.Payload), retried.CreatedAt))
+	mock.ExpectCommit()
+	redisMock.ExpectMGet("outbox:7:applied", "outbox:8:applied").SetVal([]interface{}{nil, "1"})
+	redisMock.ExpectEvalSha(loadScoresScript.Hash(), []string{"quiz:quiz1:scores"},
+		int(quizScoresTTL.Seconds()), 0, "user1", 2, "user2").SetVal(int64(1))
+	expectApplyPoints(redisMock, 7, "user1", 1, answeredAt).SetVal(int64(1))
+
+	expectApplyPoints(redisMock, 8, "user2", 2, answeredAt).SetVal(int64(1))
+
+	// The leaderboard is refreshed once for the batch
+	expectLeaderboardRefresh(mock, redisMock)
+	mock.ExpectExec(`DELETE FROM outbox WHERE id = ANY\(\$1\)`).
+		WithArgs(pq.Int64Array{7, 8, 9}).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	assert.NoError(t, s.ProcessOutbox(context.Background()))
+	if assert.Len(t, recorded, 3) {
+		assert.Equal(t, "user1", recorded[0].UserID)
+		assert.Equal(t, "user2", recorded[1].UserID)
+		assert.Equal(t, 0, recorded[2].Points)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestProcessOutbox_KeepsFailedEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+
+	expectOutbox(mock,
+		answerRecorded(t, 7, models.AnswerRecord{QuizID: "quiz1", UserID: "user1", Points: 0}),
+		answerRecorded(t, 8, models.AnswerRecord{QuizID: "quiz1", UserID: "user1", Points: 1}),
+		answerRecorded(t, 9, models.AnswerRecord{QuizID: "quiz1", UserID: "user2", Points: 0}),
+	)
+	expectApplyPoints(redisMock, 8, "user1", 1, time.Time{}).SetErr(errors.New("redis down"))
+	// The failed event and those after it are released to be retried
+	mock.ExpectExec(`DELETE FROM outbox WHERE id = ANY\(\$1\)`).
+		WithArgs(pq.Int64Array{7}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE outbox SET claimed_until = NULL WHERE id = ANY\(\$1\)`).
+		WithArgs(pq.Int64Array{8, 9}).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	assert.Error(t, s.ProcessOutbox(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+// expectLeaderboardRefresh mocks clearing quiz1's leaderboard cache and
+// caching its first page again.
+func expectLeaderboardRefresh(mock sqlmock.Sqlmock, redisMock redismock.ClientMock) {
+	redisMock.ExpectKeys("quiz:quiz1:leaderboard:*").SetVal([]string{"quiz:quiz1:leaderboard:1:10"})
+	redisMock.ExpectDel("quiz:quiz1:leaderboard:1:10").SetVal(1)
+	redisMock.ExpectGet("quiz:quiz1:leaderboard:1:10").RedisNil()
+
+	redisMock.ExpectZCard("quiz:quiz1:scores").SetVal(1)
+	redisMock.ExpectZRevRangeWithScores("quiz:quiz1:scores", 0, 9).SetVal([]redis.Z{{Score: 1, Member: "user1"}})
+	mock.ExpectQuery(`SELECT id, COALESCE\(NULLIF\(display_name, ''\), username\) FROM users WHERE id = ANY\(\$1\)`).
+		WithArgs(pq.StringArray{"user1"}).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow("user1", "Alice"))
+
+	result := PaginatedLeaderboard{
+		Leaderboard: []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}},
+		TotalCount:  1,
+		Page:        1,
+		PageSize:    10,
+	}
+	jsonData, _ := json.Marshal(result)
+	redisMock.ExpectSet("quiz:quiz1:leaderboard:1:10", jsonData, 0).SetVal("OK")
+}
@@ -0,0 +1,21 @@
+package services
+
+import (
+	"context"
+
+	"realtime_leaderboard/internal/apperrors"
+)
+
+// RegisterParticipant lets the user answer the quiz's questions.
+func (s *QuizService) RegisterParticipant(ctx context.Context, quizID, userID string) error {
+	quizExists, userExists, err := s.db.AddParticipant(ctx, quizID, userID)
+	switch {
+	case err != nil:
+		return err
+	case !quizExists:
+		return apperrors.ErrQuizNotFound
+	case !userExists:
+		return apperrors.ErrUserNotFound
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"realtime_leaderboard/internal/apperrors"
+)
+
+const (
+	pinDigits = 6
+	// pinTTL is how long a join PIN stays valid after the host last asked
+	// for it.
+	pinTTL = 4 * time.Hour
+	// pinAttempts is how many random PINs are tried before giving up on
+	// finding one that isn't in use.
+	pinAttempts = 10
+)
+
+var errNoFreePIN = errors.New("no free join PIN")
+
+// pinKey maps a join PIN to its quiz, and quizPINKey the quiz back to it.
+func pinKey(pin string) string {
+	return fmt.Sprintf("pin:%s", pin)
+}
+
+func quizPINKey(quizID string) string {
+	return fmt.Sprintf("quiz:%s:pin", quizID)
+}
+
+// JoinPIN returns the short numeric PIN players join the quiz with,
+// creating one when the quiz hasn't got one. PINs are unique among the
+// quizzes that have one and expire pinTTL after they were last asked for.
+func (s *QuizService) JoinPIN(ctx context.Context, quizID string) (string, error) {
+	pin, err := s.currentPIN(ctx, quizID)
+	if err != nil || pin != "" {
+		return pin, err
+	}
+	exists, err := s.db.QuizExists(ctx, quizID)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", apperrors.ErrQuizNotFound
+	}
+
+	for attempt := 0; attempt < pinAttempts; attempt++ {
+		pin, err := newPIN()
+		if err != nil {
+			return "", err
+		}
+		claimed, err := s.redis.SetNX(ctx, pinKey(pin), quizID, pinTTL).Result()
+		if err != nil {
+			return "", err
+		}
+		if !claimed {
+			continue
+		}
+		assigned, err := s.redis.SetNX(ctx, quizPINKey(quizID), pin, pinTTL).Result()
+		if err != nil || !assigned {
+			// Another host connection gave the quiz a PIN first
+			s.redis.Del(ctx, pinKey(pin))
+			if err != nil {
+				return "", err
+			}
+			return s.currentPIN(ctx, quizID)
+		}
+		return pin, nil
+	}
+	return "", errNoFreePIN
+}
+
+// currentPIN returns the quiz's PIN, extending its expiry, or "" when it
+// hasn't got one.
+func (s *QuizService) currentPIN(ctx context.Context, quizID string) (string, error) {
+	pin, err := s.redis.Get(ctx, quizPINKey(quizID)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Expire(ctx, quizPINKey(quizID), pinTTL)
+		pipe.Expire(ctx, pinKey(pin), pinTTL)
+		return nil
+	})
+	return pin, err
+}
+
+// JoinByPIN registers a player for the quiz with the PIN and issues them a
+// resume token to connect with. Players with an account give their user
+// ID, anyone else a nickname to join as a guest.
+func (s *QuizService) JoinByPIN(ctx context.Context, pin, userID, nickname string) (*Session, error) {
+	quizID, err := s.resolvePIN(ctx, pin)
+	if err != nil {
+		return nil, err
+	}
+	if userID != "" {
+		if err := s.RegisterParticipant(ctx, quizID, userID); err != nil {
+			return nil, err
+		}
+	} else {
+		guest, err := s.JoinAsGuest(ctx, quizID, nickname)
+		if err != nil {
+			return nil, err
+		}
+		userID = guest.ID
+	}
+	return s.CreateSession(ctx, quizID, userID)
+}
+
+func (s *QuizService) resolvePIN(ctx context.Context, pin string) (string, error) {
+	if len(pin) != pinDigits {
+		return "", apperrors.ErrPINNotFound
+	}
+	quizID, err := s.redis.Get(ctx, pinKey(pin)).Result()
+	if err == redis.Nil {
+		return "", apperrors.ErrPINNotFound
+	}
+	return quizID, err
+}
+
+// newPIN returns a random pinDigits digit PIN, which may start with zeros.
+func newPIN() (string, error) {
+	n, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(10), big.NewInt(pinDigits), nil))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", pinDigits, n), nil
+}
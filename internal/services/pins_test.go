@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/database"
+)
+
+func TestJoinPIN(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+	ctx := context.Background()
+
+	// A quiz without a PIN is given a new one
+	redisMock.ExpectGet("quiz:quiz1:pin").RedisNil()
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM quizzes WHERE id = \$1\)`).
+		WithArgs("quiz1").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	redisMock.Regexp().ExpectSetNX(`^pin:\d{6}$`, "quiz1", pinTTL).SetVal(true)
+	redisMock.Regexp().ExpectSetNX("quiz:quiz1:pin", `^\d{6}$`, pinTTL).SetVal(true)
+
+	pin, err := s.JoinPIN(ctx, "quiz1")
+	assert.NoError(t, err)
+	assert.Regexp(t, `^\d{6}$`, pin)
+
+	// Asking again returns the same PIN and keeps it alive
+	redisMock.ExpectGet("quiz:quiz1:pin").SetVal("012345")
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectExpire("quiz:quiz1:pin", pinTTL).SetVal(true)
+	redisMock.ExpectExpire("pin:012345", pinTTL).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+
+	pin, err = s.JoinPIN(ctx, "quiz1")
+	assert.NoError(t, err)
+	assert.Equal(t, "012345", pin)
+
+	redisMock.ExpectGet("quiz:quiz2:pin").RedisNil()
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM quizzes WHERE id = \$1\)`).
+		WithArgs("quiz2").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	_, err = s.JoinPIN(ctx, "quiz2")
+	assert.ErrorIs(t, err, apperrors.ErrQuizNotFound)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestJoinByPIN_UnknownPIN(t *testing.T) {
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(nil, redisClient)
+	ctx := context.Background()
+
+	redisMock.ExpectGet("pin:999999").RedisNil()
+	_, err := s.JoinByPIN(ctx, "999999", "", "Bob")
+	assert.ErrorIs(t, err, apperrors.ErrPINNotFound)
+
+	_, err = s.JoinByPIN(ctx, "12", "", "Bob")
+	assert.ErrorIs(t, err, apperrors.ErrPINNotFound)
+
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// PresenceTTL is how long a player counts as online after their last
+	// heartbeat. Connections should heartbeat well within it.
+	PresenceTTL = 60 * time.Second
+)
+
+// presenceJoin records a connection for a player and returns how many
+// connections they now have. Players whose heartbeats have lapsed, for
+// example because their server instance died, are cleared out first so
+// their stale connection counts don't linger.
+var presenceJoin = redis.NewScript(`
+local stale = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[2])
+for _, member in ipairs(stale) do
+	redis.call("HDEL", KEYS[2], member)
+end
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[2])
+local conns = redis.call("HINCRBY", KEYS[2], ARGV[3], 1)
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+redis.call("PEXPIRE", KEYS[2], ARGV[4])
+return conns
+`)
+
+// presenceLeave drops a connection and returns 1 if it was the player's
+// last one.
+var presenceLeave = redis.NewScript(`
+local conns = redis.call("HINCRBY", KEYS[2], ARGV[1], -1)
+if conns > 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[2], ARGV[1])
+return redis.call("ZREM", KEYS[1], ARGV[1])
+`)
+
+type PresenceEntry struct {
+	UserID   string    `json:"user_id"`
+	Username string    `json:"username"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type Presence struct {
+	QuizID  string          `json:"quiz_id"`
+	Count   int             `json:"count"`
+	Players []PresenceEntry `json:"players"`
+}
+
+func presenceKey(quizID string) string {
+	return fmt.Sprintf("quiz:%s:presence", quizID)
+}
+
+func presenceConnsKey(quizID string) string {
+	return fmt.Sprintf("quiz:%s:presence:conns", quizID)
+}
+
+// JoinPresence marks the player online in the quiz and reports whether
+// they were offline before, i.e. this is their first connection.
+func (s *QuizService) JoinPresence(ctx context.Context, quizID, userID string) (bool, error) {
+	now := time.Now()
+	conns, err := presenceJoin.Run(ctx, s.redis,
+		[]string{presenceKey(quizID), presenceConnsKey(quizID)},
+		now.UnixMilli(), now.Add(-PresenceTTL).UnixMilli(), userID, PresenceTTL.Milliseconds(),
+	).Int64()
+	if err != nil {
+		return false, err
+	}
+	return conns == 1, nil
+}
+
+// LeavePresence drops one of the player's connections and reports whether
+// they are now offline.
+func (s *QuizService) LeavePresence(ctx context.Context, quizID, userID string) (bool, error) {
+	left, err := presenceLeave.Run(ctx, s.redis,
+		[]string{presenceKey(quizID), presenceConnsKey(quizID)},
+		userID,
+	).Int64()
+	if err != nil {
+		return false, err
+	}
+	return left == 1, nil
+}
+
+// HeartbeatPresence keeps an online player from timing out.
+func (s *QuizService) HeartbeatPresence(ctx context.Context, quizID, userID string) error {
+	key := presenceKey(quizID)
+	_, err := s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAddXX(ctx, key, &redis.Z{Score: float64(time.Now().UnixMilli()), Member: userID})
+		pipe.Expire(ctx, key, PresenceTTL)
+		pipe.Expire(ctx, presenceConnsKey(quizID), PresenceTTL)
+		return nil
+	})
+	return err
+}
+
+// GetPresence lists the players online in the quiz across all server
+// instances.
+func (s *QuizService) GetPresence(ctx context.Context, quizID string) (*Presence, error) {
+	cutoff := time.Now().Add(-PresenceTTL).UnixMilli()
+	members, err := s.redis.ZRangeByScoreWithScores(ctx, presenceKey(quizID), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(cutoff, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	players := make([]PresenceEntry, len(members))
+	if len(members) == 0 {
+		return &Presence{QuizID: quizID, Players: players}, nil
+	}
+	userIDs := make([]string, len(members))
+	for i, m := range members {
+		userIDs[i] = fmt.Sprint(m.Member)
+	}
+	usernames, err := s.db.GetUsernames(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range members {
+		players[i] = PresenceEntry{
+			UserID:   userIDs[i],
+			Username: usernames[userIDs[i]],
+			LastSeen: time.UnixMilli(int64(m.Score)),
+		}
+	}
+	return &Presence{QuizID: quizID, Count: len(players), Players: players}, nil
+}
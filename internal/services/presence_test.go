@@ -0,0 +1,56 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJoinPresence(t *testing.T) {
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(nil, redisClient)
+	ctx := context.Background()
+
+	// The script's arguments start with timestamps, so only the keys and
+	// user are checked.
+	matchUser := func(expected, actual []interface{}) error {
+		assert.Equal(t, expected[:5], actual[:5])
+		assert.Equal(t, "user1", actual[7])
+		return nil
+	}
+	keys := []string{"quiz:quiz1:presence", "quiz:quiz1:presence:conns"}
+
+	redisMock.CustomMatch(matchUser).ExpectEvalSha(presenceJoin.Hash(), keys, 0, 0, "user1", PresenceTTL.Milliseconds()).SetVal(int64(1))
+	joined, err := s.JoinPresence(ctx, "quiz1", "user1")
+	assert.NoError(t, err)
+	assert.True(t, joined)
+
+	// A second tab doesn't count as joining again
+	redisMock.CustomMatch(matchUser).ExpectEvalSha(presenceJoin.Hash(), keys, 0, 0, "user1", PresenceTTL.Milliseconds()).SetVal(int64(2))
+	joined, err = s.JoinPresence(ctx, "quiz1", "user1")
+	assert.NoError(t, err)
+	assert.False(t, joined)
+
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestLeavePresence(t *testing.T) {
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(nil, redisClient)
+	ctx := context.Background()
+	keys := []string{"quiz:quiz1:presence", "quiz:quiz1:presence:conns"}
+
+	redisMock.ExpectEvalSha(presenceLeave.Hash(), keys, "user1").SetVal(int64(0))
+	left, err := s.LeavePresence(ctx, "quiz1", "user1")
+	assert.NoError(t, err)
+	assert.False(t, left)
+
+	redisMock.ExpectEvalSha(presenceLeave.Hash(), keys, "user1").SetVal(int64(1))
+	left, err = s.LeavePresence(ctx, "quiz1", "user1")
+	assert.NoError(t, err)
+	assert.True(t, left)
+
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
@@ -4,42 +4,91 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-redis/redis/v8"
+	"realtime_leaderboard/internal/apperrors"
 	"realtime_leaderboard/internal/database"
 	"realtime_leaderboard/internal/models"
 )
 
+// answerGracePeriod is how late an answer to a timed question may arrive,
+// allowing for the time it spends in transit.
+const answerGracePeriod = 500 * time.Millisecond
+
 type QuizService struct {
 	db    *database.DB
 	redis *redis.Client
+
+	handlersMu         sync.RWMutex
+	answerHandlers     []AnswerHandler
+	transitionHandlers []QuizTransitionHandler
+	// outboxReady wakes the outbox relay when new events are committed.
+	outboxReady chan struct{}
+	// pendingScores counts the answers recorded since the last score flush,
+	// and scoresReady wakes the flusher when there are enough of them.
+	pendingScores atomic.Int64
+	scoresReady   chan struct{}
 }
 
 func NewQuizService(db *database.DB, redis *redis.Client) *QuizService {
-	return &QuizService{db, redis}
+	return &QuizService{
+		db:          db,
+		redis:       redis,
+		outboxReady: make(chan struct{}, 1),
+		scoresReady: make(chan struct{}, 1),
+	}
 }
 
-func (s *QuizService) ProcessAnswer(quizID, userID, questionID, answer string) error {
-	ctx := context.Background()
-	question, err := s.db.GetQuestion(ctx, questionID)
+// ProcessAnswer grades and commits the answer. Its points are added to the
+// user's stored score by the score flusher, while cache updates and
+// handlers registered with OnAnswerRecorded run from the outbox. The
+// question must belong to the quiz, be the one open in it and not yet be
+// answered by the user, who must be one of the quiz's participants.
+func (s *QuizService) ProcessAnswer(ctx context.Context, quizID, userID, questionID string, answer models.Answer) error {
+	question, err := s.getQuizQuestion(ctx, quizID, questionID)
+	if err != nil {
+		return err
+	}
+	participant, err := s.db.IsParticipant(ctx, quizID, userID)
+	if err != nil {
+		return err
+	}
+	if !participant {
+		return apperrors.ErrNotParticipant
+	}
+	responseTime, err := s.responseTime(ctx, quizID, questionID, time.Now())
+	if err != nil {
+		return err
+	}
+	if question.TimeLimitSeconds > 0 &&
+		time.Duration(responseTime)*time.Millisecond > time.Duration(question.TimeLimitSeconds)*time.Second+answerGracePeriod {
+		return apperrors.ErrQuestionClosed
+	}
+	grade, err := GradeAnswer(question, answer)
 	if err != nil {
 		return err
 	}
-	if question.CorrectAnswer == answer {
-		if err := s.db.UpdateUserScore(ctx, quizID, userID, 1); err != nil {
-			return err
-		}
-		// Clear all leaderboard caches for this quiz
-		if keys, err := s.redis.Keys(ctx, fmt.Sprintf("quiz:%s:leaderboard:*", quizID)).Result(); err == nil {
-			for _, key := range keys {
-				s.redis.Del(ctx, key)
-			}
-		}
 
-		// Get and cache the updated leaderboard (first page)
-		_, err = s.GetLeaderboard(quizID, 1, 10)
+	record := &models.AnswerRecord{
+		QuizID:         quizID,
+		QuestionID:     questionID,
+		UserID:         userID,
+		Answer:         answer,
+		Correct:        grade.Correct,
+		Points:         grade.Points,
+		ResponseTimeMs: &responseTime,
+	}
+	if err := s.db.RecordAnswer(ctx, record); err != nil {
 		return err
 	}
+	if record.Points > 0 {
+		s.bufferScore()
+	}
+	s.wakeOutboxRelay()
 	return nil
 }
 
@@ -50,8 +99,7 @@ type PaginatedLeaderboard struct {
 	PageSize    int                       `json:"page_size"`
 }
 
-func (s *QuizService) GetLeaderboard(quizID string, page, pageSize int) (*PaginatedLeaderboard, error) {
-	ctx := context.Background()
+func (s *QuizService) GetLeaderboard(ctx context.Context, quizID string, page, pageSize int) (*PaginatedLeaderboard, error) {
 	cacheKey := fmt.Sprintf("quiz:%s:leaderboard:%d:%d", quizID, page, pageSize)
 
 	// Get from Redis
@@ -63,19 +111,11 @@ func (s *QuizService) GetLeaderboard(quizID string, page, pageSize int) (*Pagina
 		}
 	}
 
-	// Fetch from database if not in Redis
-	leaderboard, totalCount, err := s.db.GetLeaderboard(ctx, quizID, page, pageSize)
+	result, err := s.readLeaderboard(ctx, quizID, page, pageSize)
 	if err != nil {
 		return nil, err
 	}
 
-	result := &PaginatedLeaderboard{
-		Leaderboard: leaderboard,
-		TotalCount:  totalCount,
-		Page:        page,
-		PageSize:    pageSize,
-	}
-
 	// Cache in Redis
 	jsonData, _ := json.Marshal(result)
 	s.redis.Set(ctx, cacheKey, jsonData, 0)
@@ -83,7 +123,70 @@ func (s *QuizService) GetLeaderboard(quizID string, page, pageSize int) (*Pagina
 	return result, nil
 }
 
+// readLeaderboard reads a page of the quiz's leaderboard from its scores in
+// Redis, or from the database when they aren't there.
+func (s *QuizService) readLeaderboard(ctx context.Context, quizID string, page, pageSize int) (*PaginatedLeaderboard, error) {
+	key := quizScoresKey(quizID)
+	totalCount, err := s.redis.ZCard(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if totalCount == 0 {
+		leaderboard, totalCount, err := s.db.GetLeaderboard(ctx, quizID, page, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		return &PaginatedLeaderboard{Leaderboard: leaderboard, TotalCount: totalCount, Page: page, PageSize: pageSize}, nil
+	}
+
+	start := int64((page - 1) * pageSize)
+	members, err := s.redis.ZRevRangeWithScores(ctx, key, start, start+int64(pageSize)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	leaderboard, err := s.leaderboardEntries(ctx, members)
+	if err != nil {
+		return nil, err
+	}
+	return &PaginatedLeaderboard{Leaderboard: leaderboard, TotalCount: int(totalCount), Page: page, PageSize: pageSize}, nil
+}
+
 type QuizServiceInterface interface {
-	ProcessAnswer(quizID, userID, questionID, answer string) error
-	GetLeaderboard(quizID string, page int, pageSize int) (PaginatedLeaderboard, error)
+	ProcessAnswer(ctx context.Context, quizID, userID, questionID string, answer models.Answer) error
+	GetLeaderboard(ctx context.Context, quizID string, page int, pageSize int) (*PaginatedLeaderboard, error)
+	GetLeaderboardSnapshot(ctx context.Context, quizID string, questionNumber, page, pageSize int) (*HistoricalLeaderboard, error)
+	GetRanks(ctx context.Context, quizID string, userIDs []string) (map[string]int, error)
+	OpenQuestion(ctx context.Context, quizID, questionID string) (*ActiveQuestion, error)
+	CloseQuestion(ctx context.Context, quizID, questionID string) error
+	GetActiveQuestion(ctx context.Context, quizID string) (*ActiveQuestion, error)
+	GetUserResults(ctx context.Context, quizID, userID string) (*QuizResult, error)
+	GetUserHistory(ctx context.Context, userID string, page, pageSize int) (*PaginatedHistory, error)
+	GetGlobalLeaderboard(ctx context.Context, period Period, bucket string, page, pageSize int) (*GlobalLeaderboard, error)
+	JoinTeam(ctx context.Context, quizID, userID, teamName string) (*models.Team, error)
+	GetTeamLeaderboard(ctx context.Context, quizID string) (*TeamLeaderboard, error)
+	CreateSession(ctx context.Context, quizID, userID string) (*Session, error)
+	ResumeSession(ctx context.Context, token string) (*Session, error)
+	GetResumeState(ctx context.Context, quizID, userID string, lastSeq int64) (*ResumeState, error)
+	AppendEvent(ctx context.Context, quizID string, encode func(seq int64) ([]byte, error)) ([]byte, error)
+	LastEventSeq(ctx context.Context, quizID string) (int64, error)
+	GetEventsSince(ctx context.Context, quizID string, seq int64) ([]json.RawMessage, bool, error)
+	JoinPresence(ctx context.Context, quizID, userID string) (bool, error)
+	LeavePresence(ctx context.Context, quizID, userID string) (bool, error)
+	HeartbeatPresence(ctx context.Context, quizID, userID string) error
+	GetPresence(ctx context.Context, quizID string) (*Presence, error)
+	OnAnswerRecorded(handler AnswerHandler)
+	RegisterParticipant(ctx context.Context, quizID, userID string) error
+	RegisterUser(ctx context.Context, req NewUser) (*models.User, error)
+	GetUser(ctx context.Context, userID string) (*models.User, error)
+	UpdateProfile(ctx context.Context, userID string, update ProfileUpdate) (*models.User, error)
+	JoinAsGuest(ctx context.Context, quizID, nickname string) (*models.User, error)
+	JoinPIN(ctx context.Context, quizID string) (string, error)
+	JoinByPIN(ctx context.Context, pin, userID, nickname string) (*Session, error)
+	ScheduleQuiz(ctx context.Context, quizID string, startsAt time.Time, lobbyLead time.Duration) (*models.QuizSchedule, error)
+	GetCountdown(ctx context.Context, quizID string) (*Countdown, error)
+	OnQuizTransition(handler QuizTransitionHandler)
+	ImportQuiz(ctx context.Context, doc *QuizDocument) (*QuizDocument, error)
+	ImportQuizCSV(ctx context.Context, quiz models.Quiz, r io.Reader) (*QuizDocument, error)
+	ExportQuiz(ctx context.Context, quizID string) (*QuizDocument, error)
+	ExportResults(ctx context.Context, quizID string, w ResultsWriter) error
 }
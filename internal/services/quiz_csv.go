@@ -0,0 +1,252 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+// Columns of a quiz CSV sheet, one question per row after the header.
+// Options and answers with several values separate them with '|', which is
+// escaped with a backslash where it appears in the text. The correct column
+// holds the numbers of the correct options of single choice and multiple
+// select questions, the option numbers in their correct order for ordering
+// questions, and the accepted answers of the other types.
+var quizCSVColumns = []string{"type", "question", "options", "correct", "points", "time_limit_seconds", "tolerance", "partial_credit"}
+
+const listSeparator = '|'
+
+// ImportQuizCSV imports a quiz whose questions are given as a CSV sheet.
+// Problems are reported with the line of the sheet they were found on.
+func (s *QuizService) ImportQuizCSV(ctx context.Context, quiz models.Quiz, r io.Reader) (*QuizDocument, error) {
+	questions, rows, errs := readQuizCSV(r)
+	if len(errs) > 0 {
+		return nil, apperrors.ErrInvalidQuiz.WithDetails(errs)
+	}
+	return s.importQuiz(ctx, &QuizDocument{Quiz: quiz, Questions: questions}, rows)
+}
+
+// readQuizCSV parses the sheet's questions and the lines they start on.
+// Questions are only checked for values that can't be parsed; the rest is
+// left to normaliseQuestion.
+func readQuizCSV(r io.Reader) ([]models.Question, []int, []RowError) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, []RowError{{Row: 1, Message: "missing header"}}
+	}
+	columns := make(map[string]int, len(header))
+	var errs []RowError
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !isQuizCSVColumn(name) {
+			errs = append(errs, RowError{Row: 1, Field: name, Message: "unknown column"})
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["question"]; !ok {
+		errs = append(errs, RowError{Row: 1, Field: "question", Message: "missing column"})
+	}
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	var questions []models.Question
+	var rows []int
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, nil, append(errs, RowError{Row: parseErr.StartLine, Message: parseErr.Err.Error()})
+		}
+		if err != nil {
+			return nil, nil, append(errs, RowError{Message: err.Error()})
+		}
+		row, _ := reader.FieldPos(0)
+		cell := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		q, rowErrs := parseQuizCSVRow(cell)
+		for _, err := range rowErrs {
+			err.Row = row
+			errs = append(errs, err)
+		}
+		questions = append(questions, q)
+		rows = append(rows, row)
+	}
+	return questions, rows, errs
+}
+
+func isQuizCSVColumn(name string) bool {
+	for _, column := range quizCSVColumns {
+		if column == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseQuizCSVRow(cell func(column string) string) (models.Question, []RowError) {
+	var errs []RowError
+	invalid := func(field, message string) {
+		errs = append(errs, RowError{Field: field, Message: message})
+	}
+
+	q := models.Question{
+		Type:         models.QuestionType(strings.ToLower(cell("type"))),
+		QuestionText: cell("question"),
+	}
+	if v := cell("points"); v != "" {
+		points, err := strconv.Atoi(v)
+		if err != nil {
+			invalid("points", "should be a whole number")
+		}
+		q.Points = points
+	}
+	if v := cell("time_limit_seconds"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil {
+			invalid("time_limit_seconds", "should be a whole number")
+		}
+		q.TimeLimitSeconds = seconds
+	}
+	if v := cell("tolerance"); v != "" {
+		tolerance, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			invalid("tolerance", "should be a number")
+		}
+		q.Tolerance = tolerance
+	}
+	if v := cell("partial_credit"); v != "" {
+		partialCredit, err := strconv.ParseBool(strings.ToLower(v))
+		if err != nil {
+			invalid("partial_credit", "should be true or false")
+		}
+		q.PartialCredit = partialCredit
+	}
+	for _, text := range splitList(cell("options")) {
+		q.Options = append(q.Options, models.QuestionOption{Text: text})
+	}
+
+	correct := splitList(cell("correct"))
+	switch q.Type {
+	case "", models.QuestionTypeSingleChoice, models.QuestionTypeMultipleSelect, models.QuestionTypeOrdering:
+		for i, v := range correct {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > len(q.Options) {
+				invalid("correct", fmt.Sprintf("%q is not an option number", v))
+				continue
+			}
+			option := &q.Options[n-1]
+			if q.Type == models.QuestionTypeOrdering {
+				position := i + 1
+				option.CorrectPosition = &position
+			} else {
+				option.IsCorrect = true
+			}
+		}
+	default:
+		if len(correct) > 0 {
+			q.CorrectAnswer = correct[0]
+		}
+		if len(correct) > 1 {
+			q.CorrectAnswers = correct[1:]
+		}
+	}
+	return q, errs
+}
+
+// WriteQuizCSV writes the questions as a CSV sheet that ImportQuizCSV
+// reads back.
+func WriteQuizCSV(w io.Writer, questions []models.Question) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(quizCSVColumns); err != nil {
+		return err
+	}
+	for _, q := range questions {
+		options := make([]string, len(q.Options))
+		var correct []string
+		correctOrder := make([]string, len(q.Options))
+		for i, o := range q.Options {
+			options[i] = o.Text
+			if o.IsCorrect {
+				correct = append(correct, strconv.Itoa(i+1))
+			}
+			if o.CorrectPosition != nil && *o.CorrectPosition >= 1 && *o.CorrectPosition <= len(q.Options) {
+				correctOrder[*o.CorrectPosition-1] = strconv.Itoa(i + 1)
+			}
+		}
+		switch q.Type {
+		case models.QuestionTypeOrdering:
+			correct = correctOrder
+		case models.QuestionTypeTrueFalse, models.QuestionTypeNumeric, models.QuestionTypeFreeText:
+			correct = append([]string{q.CorrectAnswer}, q.CorrectAnswers...)
+		}
+
+		err := writer.Write([]string{
+			string(q.Type),
+			q.QuestionText,
+			joinList(options),
+			joinList(correct),
+			strconv.Itoa(q.Points),
+			strconv.Itoa(q.TimeLimitSeconds),
+			strconv.FormatFloat(q.Tolerance, 'f', -1, 64),
+			strconv.FormatBool(q.PartialCredit),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// splitList splits a cell on unescaped separators, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	var item strings.Builder
+	flush := func() {
+		if v := strings.TrimSpace(item.String()); v != "" {
+			items = append(items, v)
+		}
+		item.Reset()
+	}
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+			item.WriteByte(s[i])
+		case s[i] == listSeparator:
+			flush()
+		default:
+			item.WriteByte(s[i])
+		}
+	}
+	flush()
+	return items
+}
+
+func joinList(items []string) string {
+	escaped := make([]string, len(items))
+	for i, item := range items {
+		item = strings.ReplaceAll(item, `\`, `\\`)
+		escaped[i] = strings.ReplaceAll(item, string(listSeparator), `\`+string(listSeparator))
+	}
+	return strings.Join(escaped, string(listSeparator))
+}
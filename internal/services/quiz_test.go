@@ -2,76 +2,352 @@ package services
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-redis/redis/v8"
 	"github.com/go-redis/redismock/v8"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	"realtime_leaderboard/internal/apperrors"
 	"realtime_leaderboard/internal/database"
 	"realtime_leaderboard/internal/models"
 )
 
+// soapQuestion is a single choice question whose correct option is "q1-2".
+func soapQuestion() *models.Question {
+	return &models.Question{
+		ID:           "q1",
+		QuizID:       "quiz1",
+		Type:         models.QuestionTypeSingleChoice,
+		QuestionText: "What cleans best?",
+		Options: []models.QuestionOption{
+			{ID: "q1-1", QuestionID: "q1", Position: 1, Text: "Water"},
+			{ID: "q1-2", QuestionID: "q1", Position: 2, Text: "Soap", IsCorrect: true},
+		},
+		Points: 1,
+	}
+}
+
+// expectGetQuestion mocks the queries made by database.GetQuestion.
+func expectGetQuestion(mock sqlmock.Sqlmock, q *models.Question) {
+	mock.ExpectQuery(`SELECT id, quiz_id, question_type, question_text, COALESCE\(correct_answer, ''\),\s+correct_answers, tolerance, partial_credit, points, time_limit_seconds\s+FROM questions WHERE id = \$1`).
+		WithArgs(q.ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "quiz_id", "question_type", "question_text", "correct_answer",
+			"correct_answers", "tolerance", "partial_credit", "points", "time_limit_seconds"}).
+			AddRow(q.ID, q.QuizID, string(q.Type), q.QuestionText, q.CorrectAnswer, q.CorrectAnswers,
+				q.Tolerance, q.PartialCredit, q.Points, q.TimeLimitSeconds))
+
+	options := sqlmock.NewRows([]string{"id", "question_id", "position", "option_text", "is_correct", "correct_position"})
+	for _, o := range q.Options {
+		options.AddRow(o.ID, o.QuestionID, o.Position, o.Text, o.IsCorrect, o.CorrectPosition)
+	}
+	mock.ExpectQuery(`SELECT id, question_id, position, option_text, is_correct, correct_position\s+FROM question_options`).
+		WithArgs(q.ID).
+		WillReturnRows(options)
+}
+
+// expectParticipant mocks the participant check for user1 in quiz1.
+func expectParticipant(mock sqlmock.Sqlmock, participant bool) {
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM quiz_participants`).
+		WithArgs("quiz1", "user1").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(participant))
+}
+
 func TestProcessAnswer_CorrectAnswer(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
 	redisClient, redisMock := redismock.NewClientMock()
-	s := NewQuizService(&database.DB{db}, redisClient)
-	context.Background()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
 
 	// Mock GetQuestion
-	rows := sqlmock.NewRows([]string{"id", "quiz_id", "question_text", "options", "correct_answer"}).
-		AddRow("q1", "quiz1", "What cleans best?", "{Water,Soap}", "Soap")
-	mock.ExpectQuery(`SELECT id, quiz_id, question_text, options, correct_answer FROM questions WHERE id = \$1`).
-		WithArgs("q1").
-		WillReturnRows(rows)
+	expectGetQuestion(mock, soapQuestion())
+	expectParticipant(mock, true)
+
+	// The question opened a second ago
+	openedAt := time.Now().Add(-time.Second).UnixMilli()
+	redisMock.ExpectHGetAll("quiz:quiz1:active_question").SetVal(map[string]string{
+		"question_id": "q1",
+		"opened_at":   strconv.FormatInt(openedAt, 10),
+	})
 
-	// Mock UpdateUserScore
-	mock.ExpectExec(`INSERT INTO user_scores`).
-		WithArgs("quiz1", "user1", 1).
+	// The answer and outbox event are committed together, leaving the score
+	// to the flusher
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO answers`).
+		WithArgs("quiz1", "q1", "user1", pq.StringArray{"q1-2"}, true, 1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "answered_at"}).AddRow(1, time.Now()))
+	mock.ExpectExec(`INSERT INTO outbox`).
+		WithArgs(models.OutboxEventAnswerRecorded, "quiz1", sqlmock.AnyArg()).
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	// Mock COUNT(*) query for GetLeaderboard
-	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM user_scores WHERE quiz_id = \$1`).
-		WithArgs("quiz1").
-		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	err = s.ProcessAnswer(context.Background(), "quiz1", "user1", "q1", models.Answer{"q1-2"})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
 
-	// Mock paginated leaderboard query
-	leaderboardRows := sqlmock.NewRows([]string{"id", "username", "score"}).
-		AddRow("user1", "Alice", 1)
-	mock.ExpectQuery(`SELECT u\.id, u\.username, us\.score FROM user_scores us`).
-		WithArgs("quiz1", 10, 0). // Default page=1, page_size=10
-		WillReturnRows(leaderboardRows)
+func TestProcessAnswer_Rejected(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
 
-	// Mock Redis cache invalidation
-	redisMock.ExpectKeys("quiz:quiz1:leaderboard:*").SetVal([]string{"quiz:quiz1:leaderboard:1:10"})
-	redisMock.ExpectDel("quiz:quiz1:leaderboard:1:10").SetVal(1)
+	s := NewQuizService(&database.DB{DB: db}, nil)
+	ctx := context.Background()
 
-	// Mock Redis SET for new leaderboard
-	result := PaginatedLeaderboard{
-		Leaderboard: []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}},
-		TotalCount:  1,
-		Page:        1,
-		PageSize:    10,
+	// Questions of another quiz don't score in this one
+	expectGetQuestion(mock, soapQuestion())
+	err = s.ProcessAnswer(ctx, "quiz2", "user1", "q1", models.Answer{"q1-2"})
+	assert.ErrorIs(t, err, apperrors.ErrQuestionNotInQuiz)
+
+	mock.ExpectQuery(`SELECT id, quiz_id, question_type`).
+		WithArgs("missing").
+		WillReturnError(sql.ErrNoRows)
+	err = s.ProcessAnswer(ctx, "quiz1", "user1", "missing", models.Answer{"q1-2"})
+	assert.ErrorIs(t, err, apperrors.ErrQuestionNotFound)
+
+	expectGetQuestion(mock, soapQuestion())
+	expectParticipant(mock, false)
+	err = s.ProcessAnswer(ctx, "quiz1", "user1", "q1", models.Answer{"q1-2"})
+	assert.ErrorIs(t, err, apperrors.ErrNotParticipant)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessAnswer_QuestionClosed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+
+	q := soapQuestion()
+	q.TimeLimitSeconds = 10
+	expectGetQuestion(mock, q)
+	expectParticipant(mock, true)
+
+	// Answers arriving after the time limit and grace period are refused
+	openedAt := time.Now().Add(-11 * time.Second).UnixMilli()
+	redisMock.ExpectHGetAll("quiz:quiz1:active_question").SetVal(map[string]string{
+		"question_id": "q1",
+		"opened_at":   strconv.FormatInt(openedAt, 10),
+	})
+
+	err = s.ProcessAnswer(context.Background(), "quiz1", "user1", "q1", models.Answer{"q1-2"})
+	assert.ErrorIs(t, err, apperrors.ErrQuestionClosed)
+
+	// So are answers to any question but the one open now, timed or not
+	expectGetQuestion(mock, soapQuestion())
+	expectParticipant(mock, true)
+	redisMock.ExpectHGetAll("quiz:quiz1:active_question").SetVal(map[string]string{
+		"question_id": "q2",
+		"opened_at":   strconv.FormatInt(time.Now().UnixMilli(), 10),
+	})
+
+	err = s.ProcessAnswer(context.Background(), "quiz1", "user1", "q1", models.Answer{"q1-2"})
+	assert.ErrorIs(t, err, apperrors.ErrQuestionClosed)
+
+	// Questions can't be answered before the host has shown any
+	expectGetQuestion(mock, soapQuestion())
+	expectParticipant(mock, true)
+	redisMock.ExpectHGetAll("quiz:quiz1:active_question").SetVal(map[string]string{})
+	err = s.ProcessAnswer(context.Background(), "quiz1", "user1", "q1", models.Answer{"q1-2"})
+	assert.ErrorIs(t, err, apperrors.ErrQuestionNotOpen)
+
+	// Nor while it can't be told which question is open
+	expectGetQuestion(mock, soapQuestion())
+	expectParticipant(mock, true)
+	redisMock.ExpectHGetAll("quiz:quiz1:active_question").SetErr(errors.New("connection refused"))
+	err = s.ProcessAnswer(context.Background(), "quiz1", "user1", "q1", models.Answer{"q1-2"})
+	assert.EqualError(t, err, "connection refused")
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestCloseQuestion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+	ctx := context.Background()
+	openedAt := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	expectSnapshot := func(questionID string, questionNumber int) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`UPDATE quizzes SET questions_closed = questions_closed \+ 1`).
+			WithArgs("quiz1").
+			WillReturnRows(sqlmock.NewRows([]string{"questions_closed"}).AddRow(questionNumber))
+		mock.ExpectExec(`INSERT INTO leaderboard_snapshots`).
+			WithArgs("quiz1", questionNumber, questionID, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
 	}
-	jsonData, _ := json.Marshal(result)
-	redisMock.ExpectSet("quiz:quiz1:leaderboard:1:10", jsonData, 0).SetVal("OK")
+	expectClose := func(questionID string, closed int64) {
+		redisMock.Regexp().ExpectEvalSha(closeQuestionScript.Hash(), []string{"quiz:quiz1:active_question"}, questionID, `\d+`).
+			SetVal(closed)
+	}
+	expectFinish := func(questionID string, last bool) {
+		rows := sqlmock.NewRows([]string{"id"})
+		if last {
+			rows.AddRow("quiz1")
+		}
+		mock.ExpectQuery(`UPDATE quizzes SET status = \$3`).
+			WithArgs("quiz1", questionID, models.QuizStatusFinished).
+			WillReturnRows(rows)
+	}
+
+	// Opening the next question closes the one left open
+	q2 := soapQuestion()
+	q2.ID = "q2"
+	expectGetQuestion(mock, q2)
+	mock.ExpectQuery(`UPDATE quizzes SET status = \$2`).
+		WithArgs("quiz1", models.QuizStatusStarted, models.QuizStatusFinished).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("quiz1"))
+	redisMock.ExpectHGetAll("quiz:quiz1:active_question").SetVal(map[string]string{
+		"question_id": "q1", "opened_at": openedAt, "closes_at": "", "closed_at": "",
+	})
+	expectClose("q1", 1)
+	expectSnapshot("q1", 1)
+	redisMock.Regexp().ExpectHSet("quiz:quiz1:active_question",
+		"question_id", "q2", "opened_at", `\d+`, "closes_at", "", "closed_at", "").SetVal(0)
+	_, err = s.OpenQuestion(ctx, "quiz1", "q2")
+	assert.NoError(t, err)
+
+	expectClose("q2", 1)
+	expectSnapshot("q2", 2)
+	expectFinish("q2", false)
+	assert.NoError(t, s.CloseQuestion(ctx, "quiz1", "q2"))
+
+	// Closed questions can't be closed again or answered. Of two hosts
+	// closing at once, only the first snapshots the leaderboard.
+	expectClose("q2", 0)
+	assert.ErrorIs(t, s.CloseQuestion(ctx, "quiz1", "q2"), apperrors.ErrQuestionClosed)
+
+	closed := map[string]string{"question_id": "q2", "opened_at": openedAt, "closes_at": "", "closed_at": openedAt}
+	expectGetQuestion(mock, q2)
+	expectParticipant(mock, true)
+	redisMock.ExpectHGetAll("quiz:quiz1:active_question").SetVal(closed)
+	err = s.ProcessAnswer(ctx, "quiz1", "user1", "q2", models.Answer{"q1-2"})
+	assert.ErrorIs(t, err, apperrors.ErrQuestionClosed)
+
+	// Closing the last question finishes the quiz, which clears its active
+	// question
+	expectClose("q3", 1)
+	expectSnapshot("q3", 3)
+	expectFinish("q3", true)
+	redisMock.ExpectDel("quiz:quiz1:active_question").SetVal(1)
+	assert.NoError(t, s.CloseQuestion(ctx, "quiz1", "q3"))
+
+	// Finished quizzes can't be played again
+	expectGetQuestion(mock, q2)
+	mock.ExpectQuery(`UPDATE quizzes SET status = \$2`).
+		WithArgs("quiz1", models.QuizStatusStarted, models.QuizStatusFinished).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM quizzes`).
+		WithArgs("quiz1").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	_, err = s.OpenQuestion(ctx, "quiz1", "q2")
+	assert.ErrorIs(t, err, apperrors.ErrQuizFinished)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
 
-	err = s.ProcessAnswer("quiz1", "user1", "q1", "Soap")
+func TestCloseExpiredQuestions(t *testing.T) {
+	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+	ctx := context.Background()
+	now := time.UnixMilli(time.Now().UnixMilli())
+	ms := func(t time.Time) string { return strconv.FormatInt(t.UnixMilli(), 10) }
+	expired := now.Add(-answerGracePeriod)
+	later := now.Add(10 * time.Second)
+
+	redisMock.ExpectZRangeByScoreWithScores(closingQuestionsKey, &redis.ZRangeBy{Min: "-inf", Max: ms(now)}).
+		SetVal([]redis.Z{
+			{Score: float64(expired.Add(answerGracePeriod).UnixMilli()), Member: "quiz1"},
+			{Score: float64(expired.Add(answerGracePeriod).UnixMilli()), Member: "quiz2"},
+		})
+
+	// quiz1's question ran out, so it closes as if by the host
+	redisMock.ExpectHGetAll("quiz:quiz1:active_question").SetVal(map[string]string{
+		"question_id": "q1", "opened_at": ms(now.Add(-time.Minute)), "closes_at": ms(expired), "closed_at": "",
+	})
+	redisMock.ExpectEvalSha(closeQuestionScript.Hash(), []string{"quiz:quiz1:active_question"}, "q1", now.UnixMilli()).
+		SetVal(int64(1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE quizzes SET questions_closed = questions_closed \+ 1`).
+		WithArgs("quiz1").
+		WillReturnRows(sqlmock.NewRows([]string{"questions_closed"}).AddRow(1))
+	mock.ExpectExec(`INSERT INTO leaderboard_snapshots`).
+		WithArgs("quiz1", 1, "q1", now).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`UPDATE quizzes SET status = \$3`).
+		WithArgs("quiz1", "q1", models.QuizStatusFinished).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	redisMock.ExpectEvalSha(unscheduleCloseScript.Hash(), []string{closingQuestionsKey},
+		"quiz1", expired.Add(answerGracePeriod).UnixMilli()).SetVal(int64(1))
+
+	// quiz2's host has since opened a question with time left, which stays
+	// open
+	redisMock.ExpectHGetAll("quiz:quiz2:active_question").SetVal(map[string]string{
+		"question_id": "q2", "opened_at": ms(now), "closes_at": ms(later), "closed_at": "",
+	})
+	redisMock.ExpectEvalSha(unscheduleCloseScript.Hash(), []string{closingQuestionsKey},
+		"quiz2", expired.Add(answerGracePeriod).UnixMilli()).SetVal(int64(0))
+
+	assert.NoError(t, s.CloseExpiredQuestions(ctx, now))
 	assert.NoError(t, mock.ExpectationsWereMet())
 	assert.NoError(t, redisMock.ExpectationsWereMet())
 }
 
+func TestRegisterParticipant(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	s := NewQuizService(&database.DB{DB: db}, nil)
+	ctx := context.Background()
+	expect := func(userID string, quizExists, userExists bool) {
+		mock.ExpectQuery(`INSERT INTO quiz_participants`).
+			WithArgs("quiz1", userID).
+			WillReturnRows(sqlmock.NewRows([]string{"quiz_exists", "user_exists"}).AddRow(quizExists, userExists))
+	}
+
+	expect("user1", true, true)
+	assert.NoError(t, s.RegisterParticipant(ctx, "quiz1", "user1"))
+
+	expect("ghost", true, false)
+	assert.ErrorIs(t, s.RegisterParticipant(ctx, "quiz1", "ghost"), apperrors.ErrUserNotFound)
+
+	expect("user1", false, true)
+	assert.ErrorIs(t, s.RegisterParticipant(ctx, "quiz1", "user1"), apperrors.ErrQuizNotFound)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestGetLeaderboard_FromRedis(t *testing.T) {
 	db, _, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
 	redisClient, redisMock := redismock.NewClientMock()
-	s := NewQuizService(&database.DB{db}, redisClient)
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
 	context.Background()
 
 	leaderboard := []models.LeaderboardEntry{{UserID: "user1", Username: "Alice", Score: 1}}
@@ -84,7 +360,7 @@ func TestGetLeaderboard_FromRedis(t *testing.T) {
 	jsonData, _ := json.Marshal(result)
 	redisMock.ExpectGet("quiz:quiz1:leaderboard:1:10").SetVal(string(jsonData))
 
-	got, err := s.GetLeaderboard("quiz1", 1, 10)
+	got, err := s.GetLeaderboard(context.Background(), "quiz1", 1, 10)
 	assert.NoError(t, err)
 	assert.NotNil(t, got)
 	assert.Equal(t, result, *got)
@@ -97,20 +373,22 @@ func TestGetLeaderboard_FromDB(t *testing.T) {
 	defer db.Close()
 
 	redisClient, redisMock := redismock.NewClientMock()
-	s := NewQuizService(&database.DB{db}, redisClient)
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
 	context.Background()
 
 	redisMock.ExpectGet("quiz:quiz1:leaderboard:1:2").RedisNil()
+	// The quiz's scores aren't in Redis
+	redisMock.ExpectZCard("quiz:quiz1:scores").SetVal(0)
 
 	// Mock total count
-	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM user_scores WHERE quiz_id = \$1`).
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM quiz_scores WHERE quiz_id = \$1`).
 		WithArgs("quiz1").
 		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(4))
 
 	// Mock paginated leaderboard
 	rows := sqlmock.NewRows([]string{"id", "username", "score"}).
 		AddRow("user1", "Alice", 1)
-	mock.ExpectQuery(`SELECT u\.id, u\.username, us\.score FROM user_scores us`).
+	mock.ExpectQuery(`SELECT u\.id, COALESCE\(NULLIF\(u\.display_name, ''\), u\.username\), us\.score FROM quiz_scores us`).
 		WithArgs("quiz1", 2, 0).
 		WillReturnRows(rows)
 
@@ -123,10 +401,242 @@ func TestGetLeaderboard_FromDB(t *testing.T) {
 	jsonData, _ := json.Marshal(result)
 	redisMock.ExpectSet("quiz:quiz1:leaderboard:1:2", jsonData, 0).SetVal("OK")
 
-	got, err := s.GetLeaderboard("quiz1", 1, 2)
+	got, err := s.GetLeaderboard(context.Background(), "quiz1", 1, 2)
 	assert.NoError(t, err)
 	assert.NotNil(t, got)
 	assert.Equal(t, result, *got)
 	assert.NoError(t, mock.ExpectationsWereMet())
 	assert.NoError(t, redisMock.ExpectationsWereMet())
 }
+
+func TestGetLeaderboard_FromScores(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+
+	redisMock.ExpectGet("quiz:quiz1:leaderboard:2:2").RedisNil()
+	redisMock.ExpectZCard("quiz:quiz1:scores").SetVal(3)
+	redisMock.ExpectZRevRangeWithScores("quiz:quiz1:scores", 2, 3).SetVal([]redis.Z{{Score: 1, Member: "user3"}})
+	mock.ExpectQuery(`SELECT id, COALESCE\(NULLIF\(display_name, ''\), username\) FROM users WHERE id = ANY\(\$1\)`).
+		WithArgs(pq.StringArray{"user3"}).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow("user3", "Carol"))
+
+	result := PaginatedLeaderboard{
+		Leaderboard: []models.LeaderboardEntry{{UserID: "user3", Username: "Carol", Score: 1}},
+		TotalCount:  3,
+		Page:        2,
+		PageSize:    2,
+	}
+	jsonData, _ := json.Marshal(result)
+	redisMock.ExpectSet("quiz:quiz1:leaderboard:2:2", jsonData, 0).SetVal("OK")
+
+	got, err := s.GetLeaderboard(context.Background(), "quiz1", 2, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, result, *got)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestGetRanks(t *testing.T) {
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(nil, redisClient)
+
+	redisMock.ExpectZScore("quiz:quiz1:scores", "user1").SetVal(5)
+	redisMock.ExpectZScore("quiz:quiz1:scores", "user3").SetVal(5)
+	// Players on the same score share the rank below those ahead of them
+	redisMock.ExpectZCount("quiz:quiz1:scores", "(5", "+inf").SetVal(1500)
+	redisMock.ExpectZCount("quiz:quiz1:scores", "(5", "+inf").SetVal(1500)
+
+	ranks, err := s.GetRanks(context.Background(), "quiz1", []string{"user1", "user3"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"user1": 1501, "user3": 1501}, ranks)
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestProcessAnswer_RecordsResponseTime(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+
+	expectGetQuestion(mock, &models.Question{ID: "q1", QuizID: "quiz1", Type: models.QuestionTypeNumeric,
+		QuestionText: "2 + 2?", CorrectAnswer: "4", Points: 1})
+	expectParticipant(mock, true)
+
+	openedAt := time.Now().Add(-2 * time.Second).UnixMilli()
+	redisMock.ExpectHGetAll("quiz:quiz1:active_question").SetVal(map[string]string{
+		"question_id": "q1",
+		"opened_at":   strconv.FormatInt(openedAt, 10),
+	})
+
+	// A wrong answer is recorded but doesn't touch the score
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO answers`).
+		WithArgs("quiz1", "q1", "user1", pq.StringArray{"5"}, false, 0, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "answered_at"}).AddRow(1, time.Now()))
+	mock.ExpectExec(`INSERT INTO outbox`).
+		WithArgs(models.OutboxEventAnswerRecorded, "quiz1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err = s.ProcessAnswer(context.Background(), "quiz1", "user1", "q1", models.Answer{"5"})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestGetUserResults(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	s := NewQuizService(&database.DB{DB: db}, nil)
+	answeredAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`SELECT score FROM quiz_scores WHERE quiz_id = \$1 AND user_id = \$2`).
+		WithArgs("quiz1", "user1").
+		WillReturnRows(sqlmock.NewRows([]string{"score"}).AddRow(1))
+	mock.ExpectQuery(`SELECT a\.id, a\.quiz_id, a\.question_id, q\.question_text`).
+		WithArgs("quiz1", "user1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "quiz_id", "question_id", "question_text", "user_id", "answer",
+			"is_correct", "points", "response_time_ms", "answered_at"}).
+			AddRow(1, "quiz1", "q1", "What cleans best?", "user1", "{q1-2}", true, 1, 1500, answeredAt).
+			AddRow(2, "quiz1", "q2", "2 + 2?", "user1", "{5}", false, 0, nil, answeredAt))
+
+	got, err := s.GetUserResults(context.Background(), "quiz1", "user1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, got.Score)
+	assert.Len(t, got.Answers, 2)
+	assert.Equal(t, models.Answer{"q1-2"}, got.Answers[0].Answer)
+	assert.True(t, got.Answers[0].Correct)
+	assert.Equal(t, 1500, *got.Answers[0].ResponseTimeMs)
+	assert.False(t, got.Answers[1].Correct)
+	assert.Nil(t, got.Answers[1].ResponseTimeMs)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRegisterUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	s := NewQuizService(&database.DB{DB: db}, nil)
+	ctx := context.Background()
+
+	mock.ExpectQuery(`INSERT INTO users`).
+		WithArgs(sqlmock.AnyArg(), "alice", "Alice", "", false).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	user, err := s.RegisterUser(ctx, NewUser{Username: "alice", DisplayName: " Alice "})
+	assert.NoError(t, err)
+	assert.Len(t, user.ID, 32)
+	assert.Equal(t, "Alice", user.DisplayName)
+
+	mock.ExpectQuery(`INSERT INTO users`).
+		WithArgs(sqlmock.AnyArg(), "alice", "", "", false).
+		WillReturnError(&pq.Error{Code: "23505"})
+	_, err = s.RegisterUser(ctx, NewUser{Username: "alice"})
+	assert.ErrorIs(t, err, apperrors.ErrUsernameTaken)
+
+	_, err = s.RegisterUser(ctx, NewUser{Username: "al"})
+	assert.ErrorIs(t, err, apperrors.ErrInvalidUsername)
+	_, err = s.RegisterUser(ctx, NewUser{Username: "bob#1234"})
+	assert.ErrorIs(t, err, apperrors.ErrInvalidUsername)
+	_, err = s.RegisterUser(ctx, NewUser{Username: "bob", AvatarURL: "javascript:alert(1)"})
+	assert.ErrorIs(t, err, apperrors.ErrInvalidAvatarURL)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestJoinAsGuest(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	s := NewQuizService(&database.DB{DB: db}, nil)
+	ctx := context.Background()
+	expectQuiz := func(quizID string, exists bool) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM quizzes WHERE id = \$1\)`).
+			WithArgs(quizID).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(exists))
+	}
+
+	// A taken username is retried with another suffix
+	expectQuiz("quiz1", true)
+	mock.ExpectQuery(`INSERT INTO users`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "Bob", "", true).
+		WillReturnError(&pq.Error{Code: "23505"})
+	mock.ExpectRollback()
+	expectQuiz("quiz1", true)
+	mock.ExpectQuery(`INSERT INTO users`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "Bob", "", true).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	mock.ExpectExec(`INSERT INTO quiz_participants`).
+		WithArgs("quiz1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	user, err := s.JoinAsGuest(ctx, "quiz1", "Bob")
+	assert.NoError(t, err)
+	assert.True(t, user.Guest)
+	assert.Regexp(t, `^Bob#[0-9a-f]{4}$`, user.Username)
+
+	expectQuiz("quiz2", false)
+	mock.ExpectRollback()
+	_, err = s.JoinAsGuest(ctx, "quiz2", "Bob")
+	assert.ErrorIs(t, err, apperrors.ErrQuizNotFound)
+
+	_, err = s.JoinAsGuest(ctx, "quiz1", "  ")
+	assert.ErrorIs(t, err, apperrors.ErrInvalidNickname)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestJoinTeam(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+	ctx := context.Background()
+
+	expectStatus := func(status models.QuizStatus) {
+		mock.ExpectQuery(`SELECT status FROM quizzes`).
+			WithArgs("quiz1").
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(status))
+	}
+
+	expectStatus(models.QuizStatusLobby)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO teams`).
+		WithArgs(sqlmock.AnyArg(), "quiz1", "Red").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("team1"))
+	mock.ExpectExec(`INSERT INTO team_members`).
+		WithArgs("quiz1", "user1", "team1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	team, err := s.JoinTeam(ctx, "quiz1", "user1", "  Red ")
+	assert.NoError(t, err)
+	assert.Equal(t, &models.Team{ID: "team1", QuizID: "quiz1", Name: "Red"}, team)
+
+	// Teams are locked once a question has been opened, even after the
+	// quiz has finished
+	for _, status := range []models.QuizStatus{models.QuizStatusStarted, models.QuizStatusFinished} {
+		expectStatus(status)
+		_, err = s.JoinTeam(ctx, "quiz1", "user1", "Blue")
+		assert.ErrorIs(t, err, apperrors.ErrQuizStarted)
+	}
+
+	_, err = s.JoinTeam(ctx, "quiz1", "user1", "   ")
+	assert.ErrorIs(t, err, apperrors.ErrInvalidTeamName)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+const (
+	maxQuizTitleLength = 200
+	maxImportQuestions = 500
+	defaultTeamBestN   = 3
+)
+
+// QuizDocument is a quiz with its questions, in the order they are asked,
+// as imported and exported. The IDs of imported quizzes, questions and
+// options are ignored and generated afresh.
+type QuizDocument struct {
+	Quiz      models.Quiz       `json:"quiz"`
+	Questions []models.Question `json:"questions"`
+}
+
+// RowError is a problem found in an imported quiz. Row is the number of the
+// question, or its line in a CSV sheet, and 0 for the quiz itself.
+type RowError struct {
+	Row     int    `json:"row"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// ImportQuiz validates the quiz and creates it with its questions. Every
+// problem found is reported together, as the details of ErrInvalidQuiz.
+func (s *QuizService) ImportQuiz(ctx context.Context, doc *QuizDocument) (*QuizDocument, error) {
+	rows := make([]int, len(doc.Questions))
+	for i := range rows {
+		rows[i] = i + 1
+	}
+	return s.importQuiz(ctx, doc, rows)
+}
+
+// importQuiz imports the quiz, reporting problems with question i at
+// rows[i].
+func (s *QuizService) importQuiz(ctx context.Context, doc *QuizDocument, rows []int) (*QuizDocument, error) {
+	if errs := normaliseQuiz(doc, rows); len(errs) > 0 {
+		return nil, apperrors.ErrInvalidQuiz.WithDetails(errs)
+	}
+
+	quizID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	doc.Quiz.ID = quizID
+	for i := range doc.Questions {
+		q := &doc.Questions[i]
+		if q.ID, err = newID(); err != nil {
+			return nil, err
+		}
+		q.QuizID = quizID
+		for j := range q.Options {
+			q.Options[j].ID = fmt.Sprintf("%s-%d", q.ID, q.Options[j].Position)
+			q.Options[j].QuestionID = q.ID
+		}
+	}
+	if err := s.db.CreateQuiz(ctx, &doc.Quiz, doc.Questions); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// ExportQuiz returns the quiz with its questions, including their answers.
+// Players know the quiz's ID, so quizzes can only be exported once they
+// have finished.
+func (s *QuizService) ExportQuiz(ctx context.Context, quizID string) (*QuizDocument, error) {
+	quiz, err := s.db.GetQuiz(ctx, quizID)
+	if err != nil {
+		return nil, err
+	}
+	status, err := s.db.GetQuizStatus(ctx, quizID)
+	if err != nil {
+		return nil, err
+	}
+	if status != models.QuizStatusFinished {
+		return nil, apperrors.ErrQuizInProgress
+	}
+	questions, err := s.db.GetQuizQuestions(ctx, quizID)
+	if err != nil {
+		return nil, err
+	}
+	if questions == nil {
+		questions = []models.Question{}
+	}
+	return &QuizDocument{Quiz: *quiz, Questions: questions}, nil
+}
+
+// normaliseQuiz fills in defaults, trims text and numbers options by their
+// order, returning every problem found.
+func normaliseQuiz(doc *QuizDocument, rows []int) []RowError {
+	var errs []RowError
+	quiz := &doc.Quiz
+	quiz.Title = strings.TrimSpace(quiz.Title)
+	if quiz.Title == "" || len(quiz.Title) > maxQuizTitleLength {
+		errs = append(errs, RowError{Field: "title", Message: fmt.Sprintf("should be 1 to %d characters", maxQuizTitleLength)})
+	}
+	switch quiz.TeamScoring {
+	case "":
+		quiz.TeamScoring = models.TeamScoringSum
+	case models.TeamScoringSum, models.TeamScoringAverage, models.TeamScoringBestN:
+	default:
+		errs = append(errs, RowError{Field: "team_scoring", Message: "should be one of sum, average or best_n"})
+	}
+	if quiz.TeamBestN == 0 {
+		quiz.TeamBestN = defaultTeamBestN
+	} else if quiz.TeamBestN < 0 {
+		errs = append(errs, RowError{Field: "team_best_n", Message: "should be positive"})
+	}
+	if len(doc.Questions) == 0 || len(doc.Questions) > maxImportQuestions {
+		errs = append(errs, RowError{Field: "questions", Message: fmt.Sprintf("should have 1 to %d questions", maxImportQuestions)})
+	}
+
+	for i := range doc.Questions {
+		for _, err := range normaliseQuestion(&doc.Questions[i]) {
+			err.Row = rows[i]
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// normaliseQuestion checks that the question can be graded, returning its
+// problems without their row.
+func normaliseQuestion(q *models.Question) []RowError {
+	var errs []RowError
+	invalid := func(field, message string) {
+		errs = append(errs, RowError{Field: field, Message: message})
+	}
+
+	q.QuestionText = strings.TrimSpace(q.QuestionText)
+	if q.QuestionText == "" {
+		invalid("question_text", "is required")
+	}
+	if q.Type == "" {
+		q.Type = models.QuestionTypeSingleChoice
+	}
+	if q.Points == 0 {
+		q.Points = 1
+	} else if q.Points < 0 {
+		invalid("points", "should be positive")
+	}
+	if q.TimeLimitSeconds < 0 {
+		invalid("time_limit_seconds", "should not be negative")
+	}
+	if q.Tolerance < 0 {
+		invalid("tolerance", "should not be negative")
+	}
+	for i := range q.Options {
+		q.Options[i].Position = i + 1
+		q.Options[i].Text = strings.TrimSpace(q.Options[i].Text)
+		if q.Options[i].Text == "" {
+			invalid("options", fmt.Sprintf("option %d has no text", i+1))
+		}
+	}
+
+	switch q.Type {
+	case models.QuestionTypeSingleChoice, models.QuestionTypeMultipleSelect, models.QuestionTypeOrdering:
+		if len(q.Options) < 2 {
+			invalid("options", "choice questions need at least 2 options")
+		}
+		if q.CorrectAnswer != "" || len(q.CorrectAnswers) > 0 {
+			invalid("correct_answer", "choice questions are graded from their options")
+		}
+		correct := 0
+		for _, o := range q.Options {
+			if o.IsCorrect {
+				correct++
+			}
+		}
+		switch {
+		case q.Type == models.QuestionTypeSingleChoice && correct != 1:
+			invalid("options", "exactly one option should be correct")
+		case q.Type == models.QuestionTypeMultipleSelect && correct == 0:
+			invalid("options", "at least one option should be correct")
+		case q.Type == models.QuestionTypeOrdering && !isPermutation(q.Options):
+			invalid("options", "correct positions should number the options from 1")
+		}
+	case models.QuestionTypeTrueFalse, models.QuestionTypeNumeric, models.QuestionTypeFreeText:
+		if len(q.Options) > 0 {
+			invalid("options", fmt.Sprintf("%s questions have no options", q.Type))
+		}
+		q.CorrectAnswer = strings.TrimSpace(q.CorrectAnswer)
+		switch q.Type {
+		case models.QuestionTypeTrueFalse:
+			if value, err := strconv.ParseBool(strings.ToLower(q.CorrectAnswer)); err != nil {
+				invalid("correct_answer", "should be true or false")
+			} else {
+				q.CorrectAnswer = strconv.FormatBool(value)
+			}
+		case models.QuestionTypeNumeric:
+			if _, err := strconv.ParseFloat(q.CorrectAnswer, 64); err != nil {
+				invalid("correct_answer", "should be a number")
+			}
+		case models.QuestionTypeFreeText:
+			if q.CorrectAnswer == "" && len(q.CorrectAnswers) == 0 {
+				invalid("correct_answer", "free text questions need at least one accepted answer")
+			}
+		}
+	default:
+		invalid("type", fmt.Sprintf("unknown question type %q", q.Type))
+	}
+	return errs
+}
+
+// isPermutation reports whether the correct positions of an ordering
+// question's options number them from 1 without gaps or repeats.
+func isPermutation(options []models.QuestionOption) bool {
+	seen := make([]bool, len(options)+1)
+	for _, o := range options {
+		if o.CorrectPosition == nil || *o.CorrectPosition < 1 || *o.CorrectPosition > len(options) || seen[*o.CorrectPosition] {
+			return false
+		}
+		seen[*o.CorrectPosition] = true
+	}
+	return true
+}
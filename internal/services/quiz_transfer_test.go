@@ -0,0 +1,150 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/database"
+	"realtime_leaderboard/internal/models"
+)
+
+func TestImportQuiz_ReportsEveryProblem(t *testing.T) {
+	s := NewQuizService(nil, nil)
+
+	_, err := s.ImportQuiz(context.Background(), &QuizDocument{
+		Quiz: models.Quiz{Title: "Cleaning", TeamScoring: "median"},
+		Questions: []models.Question{
+			{QuestionText: "What cleans best?", Options: []models.QuestionOption{{Text: "Water"}, {Text: "Soap"}}},
+			{Type: models.QuestionTypeNumeric, QuestionText: "How many?", CorrectAnswer: "lots"},
+			{Type: models.QuestionTypeTrueFalse, QuestionText: " ", CorrectAnswer: "True", Points: -1},
+		},
+	})
+	assert.ErrorIs(t, err, apperrors.ErrInvalidQuiz)
+	assert.Equal(t, []RowError{
+		{Row: 0, Field: "team_scoring", Message: "should be one of sum, average or best_n"},
+		{Row: 1, Field: "options", Message: "exactly one option should be correct"},
+		{Row: 2, Field: "correct_answer", Message: "should be a number"},
+		{Row: 3, Field: "question_text", Message: "is required"},
+		{Row: 3, Field: "points", Message: "should be positive"},
+	}, apperrors.From(err).Details)
+}
+
+func TestImportQuizCSV(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	s := NewQuizService(&database.DB{DB: db}, nil)
+	sheet := `type,question,options,correct,points,time_limit_seconds
+single_choice,What cleans best?,Water|Soap,2,2,20
+ordering,Order these,"Small|Medium|Big",3|2|1,,
+free_text,"Say ""hi""",,hi|hello,,
+`
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO quizzes`).
+		WithArgs(sqlmock.AnyArg(), "Sheet", models.TeamScoringSum, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	mock.ExpectExec(`INSERT INTO questions`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), models.QuestionTypeSingleChoice, "What cleans best?", "",
+			sqlmock.AnyArg(), 0.0, false, 2, 20, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for i := 0; i < 2; i++ {
+		mock.ExpectExec(`INSERT INTO question_options`).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec(`INSERT INTO questions`).WillReturnResult(sqlmock.NewResult(0, 1))
+	for i := 0; i < 3; i++ {
+		mock.ExpectExec(`INSERT INTO question_options`).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec(`INSERT INTO questions`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), models.QuestionTypeFreeText, `Say "hi"`, "hi",
+			sqlmock.AnyArg(), 0.0, false, 1, 0, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	doc, err := s.ImportQuizCSV(context.Background(), models.Quiz{Title: "Sheet"}, strings.NewReader(sheet))
+	assert.NoError(t, err)
+	assert.Len(t, doc.Quiz.ID, 32)
+	assert.True(t, doc.Questions[0].Options[1].IsCorrect)
+	assert.Equal(t, doc.Questions[0].ID+"-2", doc.Questions[0].Options[1].ID)
+	assert.Equal(t, 3, *doc.Questions[1].Options[0].CorrectPosition)
+	assert.Equal(t, []string{"hello"}, []string(doc.Questions[2].CorrectAnswers))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Problems are reported with their line in the sheet
+	_, err = s.ImportQuizCSV(context.Background(), models.Quiz{Title: "Sheet"}, strings.NewReader(
+		"question,options,correct,points\nFirst,A|B,1,\n\"Multi\nline\",A|B,3,x\n"))
+	assert.ErrorIs(t, err, apperrors.ErrInvalidQuiz)
+	assert.Equal(t, []RowError{
+		{Row: 3, Field: "points", Message: "should be a whole number"},
+		{Row: 3, Field: "correct", Message: `"3" is not an option number`},
+	}, apperrors.From(err).Details)
+}
+
+func TestQuizCSVRoundTrip(t *testing.T) {
+	position := func(n int) *int { return &n }
+	questions := []models.Question{
+		{Type: models.QuestionTypeMultipleSelect, QuestionText: "Pick | any", Points: 2, PartialCredit: true,
+			Options: []models.QuestionOption{{Text: `A|B`, IsCorrect: true}, {Text: `C\D`}, {Text: "E", IsCorrect: true}}},
+		{Type: models.QuestionTypeOrdering, QuestionText: "Sort", Points: 1,
+			Options: []models.QuestionOption{{Text: "2", CorrectPosition: position(2)}, {Text: "1", CorrectPosition: position(1)}}},
+		{Type: models.QuestionTypeNumeric, QuestionText: "Pi?", CorrectAnswer: "3.14", Tolerance: 0.01, Points: 1, TimeLimitSeconds: 10},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteQuizCSV(&buf, questions))
+	read, rows, errs := readQuizCSV(&buf)
+	assert.Empty(t, errs)
+	assert.Equal(t, []int{2, 3, 4}, rows)
+	for i := range read {
+		assert.Empty(t, normaliseQuestion(&read[i]))
+		assert.Empty(t, normaliseQuestion(&questions[i]))
+	}
+	assert.Equal(t, questions, read)
+}
+
+func TestExportQuiz_UnfinishedQuizKeepsAnswers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	s := NewQuizService(&database.DB{DB: db}, nil)
+	ctx := context.Background()
+	expectQuiz := func(status models.QuizStatus) {
+		mock.ExpectQuery(`SELECT id, COALESCE\(title, ''\), team_scoring, team_best_n, created_at FROM quizzes`).
+			WithArgs("quiz1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "title", "team_scoring", "team_best_n", "created_at"}).
+				AddRow("quiz1", "Cleaning", "sum", 3, time.Now()))
+		mock.ExpectQuery(`SELECT status FROM quizzes`).
+			WithArgs("quiz1").
+			WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow(status))
+	}
+
+	// Players may already be waiting in the lobby, or playing
+	for _, status := range []models.QuizStatus{models.QuizStatusLobby, models.QuizStatusStarted} {
+		expectQuiz(status)
+		_, err = s.ExportQuiz(ctx, "quiz1")
+		assert.ErrorIs(t, err, apperrors.ErrQuizInProgress)
+	}
+
+	// Finished quizzes export with their answers
+	expectQuiz(models.QuizStatusFinished)
+	mock.ExpectQuery(`SELECT id, quiz_id, question_type`).
+		WithArgs("quiz1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "quiz_id", "question_type", "question_text", "correct_answer",
+			"correct_answers", "tolerance", "partial_credit", "points", "time_limit_seconds"}).
+			AddRow("q1", "quiz1", "numeric", "How many?", "3", "{}", 0.0, false, 1, 0))
+	mock.ExpectQuery(`SELECT id, question_id, position, option_text, is_correct, correct_position`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "question_id", "position", "option_text", "is_correct", "correct_position"}))
+	doc, err := s.ExportQuiz(ctx, "quiz1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "3", doc.Questions[0].CorrectAnswer)
+	}
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
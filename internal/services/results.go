@@ -0,0 +1,31 @@
+package services
+
+import (
+	"context"
+
+	"realtime_leaderboard/internal/models"
+)
+
+// ResultsWriter writes out a quiz's results as they are read.
+type ResultsWriter interface {
+	// WriteHeader is called before any row, with the quiz's questions in
+	// the order they are asked.
+	WriteHeader(questions []models.Question) error
+	WriteRow(row *models.ResultRow) error
+}
+
+// ExportResults streams the standings of the quiz's participants to w,
+// best first. Nothing is written when the quiz can't be found.
+func (s *QuizService) ExportResults(ctx context.Context, quizID string, w ResultsWriter) error {
+	if _, err := s.db.GetQuiz(ctx, quizID); err != nil {
+		return err
+	}
+	questions, err := s.db.GetQuizQuestions(ctx, quizID)
+	if err != nil {
+		return err
+	}
+	if err := w.WriteHeader(questions); err != nil {
+		return err
+	}
+	return s.db.StreamQuizResults(ctx, quizID, w.WriteRow)
+}
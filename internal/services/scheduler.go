@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+const (
+	// scheduleBatchSize is how many due quizzes are moved on per
+	// transaction.
+	scheduleBatchSize = 100
+	// untimedQuestionDuration is how long a scheduled quiz leaves questions
+	// without a time limit open.
+	untimedQuestionDuration = 30 * time.Second
+	// questionGap is the pause after a question closes, before a scheduled
+	// quiz opens the next one.
+	questionGap = 5 * time.Second
+	// DefaultLobbyLead is how long before the start the lobby opens when
+	// the quiz is scheduled without saying.
+	DefaultLobbyLead = 5 * time.Minute
+)
+
+// QuizTransitionHandler is called whenever the scheduler moves a quiz on,
+// after the quiz's active question has been updated.
+type QuizTransitionHandler func(ctx context.Context, transition *models.QuizTransition)
+
+// Countdown tells lobby clients how long until the quiz starts.
+type Countdown struct {
+	StartsAt    time.Time `json:"starts_at"`
+	RemainingMs int64     `json:"remaining_ms"`
+}
+
+// NewCountdown returns the countdown at now to a quiz starting at startsAt.
+func NewCountdown(startsAt, now time.Time) *Countdown {
+	remaining := startsAt.Sub(now).Milliseconds()
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &Countdown{StartsAt: startsAt, RemainingMs: remaining}
+}
+
+// OnQuizTransition registers a handler for scheduled quizzes opening their
+// lobby, opening and closing questions and finishing.
+func (s *QuizService) OnQuizTransition(handler QuizTransitionHandler) {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	s.transitionHandlers = append(s.transitionHandlers, handler)
+}
+
+// ScheduleQuiz has the quiz start itself at startsAt, opening its lobby
+// lobbyLead beforehand, and then run through its questions in order
+// without a host.
+func (s *QuizService) ScheduleQuiz(ctx context.Context, quizID string, startsAt time.Time, lobbyLead time.Duration) (*models.QuizSchedule, error) {
+	if !startsAt.After(time.Now()) || lobbyLead < 0 {
+		return nil, apperrors.ErrInvalidStartTime
+	}
+	return s.db.ScheduleQuiz(ctx, quizID, startsAt, startsAt.Add(-lobbyLead))
+}
+
+// GetCountdown returns the countdown to the quiz's start while its lobby
+// is open, and nil otherwise.
+func (s *QuizService) GetCountdown(ctx context.Context, quizID string) (*Countdown, error) {
+	schedule, err := s.db.GetQuizSchedule(ctx, quizID)
+	if errors.Is(err, apperrors.ErrQuizNotFound) {
+		return nil, nil
+	}
+	if err != nil || schedule == nil || schedule.Status != models.ScheduleStatusLobby {
+		return nil, err
+	}
+	return NewCountdown(schedule.StartsAt, time.Now()), nil
+}
+
+// AdvanceSchedules moves on every scheduled quiz whose next transition is
+// due. The transitions take effect from the outbox.
+func (s *QuizService) AdvanceSchedules(ctx context.Context) error {
+	for {
+		transitions, err := s.db.AdvanceSchedules(ctx, time.Now(), scheduleBatchSize, untimedQuestionDuration, answerGracePeriod, questionGap)
+		if err != nil {
+			return err
+		}
+		if len(transitions) > 0 {
+			s.wakeOutboxRelay()
+		}
+		if len(transitions) < scheduleBatchSize {
+			return nil
+		}
+	}
+}
+
+// RunScheduler advances scheduled quizzes every interval until ctx is
+// cancelled.
+func (s *QuizService) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.AdvanceSchedules(ctx); err != nil {
+			log.Printf("Error advancing quiz schedules: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyQuizTransition opens the question a running quiz moved on to,
+// closes it once its time is up, as the host would, or clears the active
+// question of a finished quiz, then notifies the transition handlers.
+func (s *QuizService) applyQuizTransition(ctx context.Context, t *models.QuizTransition) error {
+	switch t.Status {
+	case models.ScheduleStatusRunning:
+		if err := s.setActiveQuestion(ctx, t.QuizID, t.QuestionID, t.At, nil); err != nil {
+			return err
+		}
+	case models.ScheduleStatusQuestionClosed:
+		if _, err := s.closeActiveQuestion(ctx, t.QuizID, t.QuestionID, t.At); err != nil {
+			return err
+		}
+	case models.ScheduleStatusFinished:
+		if err := s.redis.Del(ctx, activeQuestionKey(t.QuizID)).Err(); err != nil {
+			return err
+		}
+	}
+
+	s.handlersMu.RLock()
+	handlers := s.transitionHandlers
+	s.handlersMu.RUnlock()
+	for _, handler := range handlers {
+		handler(ctx, t)
+	}
+	return nil
+}
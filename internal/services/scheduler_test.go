@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+func TestScheduleQuiz_InvalidStart(t *testing.T) {
+	s := NewQuizService(nil, nil)
+	ctx := context.Background()
+
+	_, err := s.ScheduleQuiz(ctx, "quiz1", time.Now().Add(-time.Minute), DefaultLobbyLead)
+	assert.ErrorIs(t, err, apperrors.ErrInvalidStartTime)
+	_, err = s.ScheduleQuiz(ctx, "quiz1", time.Now().Add(time.Hour), -time.Minute)
+	assert.ErrorIs(t, err, apperrors.ErrInvalidStartTime)
+}
+
+func TestApplyQuizTransition(t *testing.T) {
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(nil, redisClient)
+	ctx := context.Background()
+
+	var handled []models.ScheduleStatus
+	s.OnQuizTransition(func(ctx context.Context, transition *models.QuizTransition) {
+		handled = append(handled, transition.Status)
+	})
+	outboxEvent := func(transition models.QuizTransition) models.OutboxEvent {
+		payload, err := json.Marshal(transition)
+		assert.NoError(t, err)
+		return models.OutboxEvent{ID: 1, Type: models.OutboxEventQuizTransition, QuizID: transition.QuizID, Payload: payload}
+	}
+	at := time.UnixMilli(time.Now().UnixMilli())
+
+	// The scheduler's question is opened as if by the host
+	redisMock.ExpectHSet("quiz:quiz1:active_question", "question_id", "q1", "opened_at", at.UnixMilli(), "closes_at", "", "closed_at", "").SetVal(2)
+	_, err := s.handleOutboxEvent(ctx, outboxEvent(models.QuizTransition{
+		QuizID: "quiz1", Status: models.ScheduleStatusRunning, QuestionID: "q1", At: at,
+	}))
+	assert.NoError(t, err)
+
+	// and closed, as by the host, once its window ends
+	redisMock.ExpectEvalSha(closeQuestionScript.Hash(), []string{"quiz:quiz1:active_question"}, "q1", at.UnixMilli()).
+		SetVal(int64(1))
+	_, err = s.handleOutboxEvent(ctx, outboxEvent(models.QuizTransition{
+		QuizID: "quiz1", Status: models.ScheduleStatusQuestionClosed, QuestionID: "q1", At: at,
+	}))
+	assert.NoError(t, err)
+
+	redisMock.ExpectDel("quiz:quiz1:active_question").SetVal(1)
+	_, err = s.handleOutboxEvent(ctx, outboxEvent(models.QuizTransition{
+		QuizID: "quiz1", Status: models.ScheduleStatusFinished, At: at,
+	}))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []models.ScheduleStatus{
+		models.ScheduleStatusRunning, models.ScheduleStatusQuestionClosed, models.ScheduleStatusFinished,
+	}, handled)
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
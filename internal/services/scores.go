@@ -0,0 +1,224 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"realtime_leaderboard/internal/models"
+)
+
+const (
+	// scoreFlushSize is how many answers are added to user_scores per
+	// statement, and how many may be waiting before a flush starts early.
+	scoreFlushSize = 500
+	// quizScoresTTL is how long a quiz's scores stay in Redis after the
+	// last points were scored.
+	quizScoresTTL = 24 * time.Hour
+)
+
+func quizScoresKey(quizID string) string {
+	return fmt.Sprintf("quiz:%s:scores", quizID)
+}
+
+// bufferScore counts an answer whose points are waiting to be flushed and
+// wakes the flusher once a full batch is waiting.
+func (s *QuizService) bufferScore() {
+	if s.pendingScores.Add(1) < scoreFlushSize {
+		return
+	}
+	select {
+	case s.scoresReady <- struct{}{}:
+	default:
+	}
+}
+
+// FlushScores adds the points of recorded answers to user_scores until no
+// answers are left waiting.
+func (s *QuizService) FlushScores(ctx context.Context) error {
+	s.pendingScores.Store(0)
+	for {
+		flushed, err := s.db.FlushScores(ctx, scoreFlushSize)
+		if err != nil || flushed < scoreFlushSize {
+			return err
+		}
+	}
+}
+
+// RunScoreFlusher flushes scores every interval, or sooner when a full
+// batch is waiting. Answers left unflushed by a crash, of this or any other
+// server instance, are picked up by the next flush. Once ctx is cancelled
+// it flushes one last time and returns.
+func (s *QuizService) RunScoreFlusher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.FlushScores(ctx); err != nil {
+			log.Printf("Error flushing scores: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			if err := s.FlushScores(context.WithoutCancel(ctx)); err != nil {
+				log.Printf("Error flushing scores: %v", err)
+			}
+			return
+		case <-s.scoresReady:
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyPointsScript adds ARGV[1] points to member ARGV[2] of the quiz's
+// scores in KEYS[2] and of the global buckets in the remaining keys, unless
+// the outbox event's applied key in KEYS[1] shows it already has. Points
+// are only added to the quiz's scores while they are all in Redis, so if
+// they aren't nothing is changed and 0 is returned. ARGV[3] and ARGV[4]
+// are the TTLs of the applied key and the quiz's scores in seconds, and
+// the rest when each bucket expires, or 0 for never.
+var applyPointsScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 1
+end
+if redis.call("EXISTS", KEYS[2]) == 0 then
+	return 0
+end
+redis.call("SET", KEYS[1], 1, "EX", ARGV[3])
+redis.call("ZINCRBY", KEYS[2], ARGV[1], ARGV[2])
+redis.call("EXPIRE", KEYS[2], ARGV[4])
+for i = 3, #KEYS do
+	redis.call("ZINCRBY", KEYS[i], ARGV[1], ARGV[2])
+	local expire_at = tonumber(ARGV[i + 2])
+	if expire_at > 0 then
+		redis.call("EXPIREAT", KEYS[i], expire_at)
+	end
+end
+return 1
+`)
+
+// loadScoresScript writes the quiz's scores, given as score and member
+// pairs after the TTL in ARGV[1], to KEYS[1] unless they are already
+// there.
+var loadScoresScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+for i = 2, #ARGV, 2 do
+	redis.call("ZADD", KEYS[1], ARGV[i], ARGV[i + 1])
+end
+redis.call("EXPIRE", KEYS[1], ARGV[1])
+return 1
+`)
+
+// applyPoints adds the answer's points to the quiz's scores in Redis and
+// to the global leaderboards, once for the outbox event. If the quiz's
+// scores aren't in Redis, they are loaded first.
+func (s *QuizService) applyPoints(ctx context.Context, eventID int64, answer *models.AnswerRecord) error {
+	applied, err := s.runApplyPoints(ctx, eventID, answer)
+	if err != nil || applied {
+		return err
+	}
+	if err := s.loadQuizScores(ctx, answer.QuizID); err != nil {
+		return err
+	}
+	applied, err = s.runApplyPoints(ctx, eventID, answer)
+	if err == nil && !applied {
+		err = fmt.Errorf("scores of quiz %s missing after loading them", answer.QuizID)
+	}
+	return err
+}
+
+func (s *QuizService) runApplyPoints(ctx context.Context, eventID int64, answer *models.AnswerRecord) (bool, error) {
+	buckets, expireAt := globalBuckets(answer.AnsweredAt)
+	keys := append([]string{outboxAppliedKey(eventID), quizScoresKey(answer.QuizID)}, buckets...)
+	args := []interface{}{answer.Points, answer.UserID, int(outboxAppliedTTL.Seconds()), int(quizScoresTTL.Seconds())}
+	for _, at := range expireAt {
+		args = append(args, at)
+	}
+	applied, err := applyPointsScript.Run(ctx, s.redis, keys, args...).Int()
+	return applied == 1, err
+}
+
+// loadQuizScores copies the quiz's scores from the database to Redis,
+// unless another relay got there first. The points of answers whose outbox
+// events haven't been applied yet are left out, as applying them adds
+// them.
+func (s *QuizService) loadQuizScores(ctx context.Context, quizID string) error {
+	scores, pending, err := s.db.GetQuizScores(ctx, quizID)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]int, len(scores))
+	for i, score := range scores {
+		users[score.UserID] = i
+	}
+	if len(pending) > 0 {
+		keys := make([]string, len(pending))
+		for i, e := range pending {
+			keys[i] = outboxAppliedKey(e.ID)
+		}
+		applied, err := s.redis.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for i, e := range pending {
+			if applied[i] != nil {
+				continue
+			}
+			var answer models.AnswerRecord
+			if err := json.Unmarshal(e.Payload, &answer); err != nil {
+				return err
+			}
+			if u, ok := users[answer.UserID]; ok {
+				scores[u].Score -= answer.Points
+			}
+		}
+	}
+
+	args := []interface{}{int(quizScoresTTL.Seconds())}
+	for _, score := range scores {
+		args = append(args, score.Score, score.UserID)
+	}
+	return loadScoresScript.Run(ctx, s.redis, []string{quizScoresKey(quizID)}, args...).Err()
+}
+
+// GetRanks returns the ranks of the users who have scored in the quiz,
+// counting from 1, with users on the same score sharing a rank. They are
+// read from the quiz's scores in Redis, so are only known once the quiz
+// has scored.
+func (s *QuizService) GetRanks(ctx context.Context, quizID string, userIDs []string) (map[string]int, error) {
+	key := quizScoresKey(quizID)
+	scores := make([]*redis.FloatCmd, len(userIDs))
+	_, err := s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, userID := range userIDs {
+			scores[i] = pipe.ZScore(ctx, key, userID)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	// A user's rank is one more than the number of users with a higher
+	// score
+	ahead := make(map[string]*redis.IntCmd, len(userIDs))
+	_, err = s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, userID := range userIDs {
+			if score, err := scores[i].Result(); err == nil {
+				ahead[userID] = pipe.ZCount(ctx, key, "("+strconv.FormatFloat(score, 'f', -1, 64), "+inf")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ranks := make(map[string]int, len(ahead))
+	for userID, count := range ahead {
+		ranks[userID] = int(count.Val()) + 1
+	}
+	return ranks, nil
+}
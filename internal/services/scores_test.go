@@ -0,0 +1,62 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"realtime_leaderboard/internal/database"
+)
+
+// expectFlush mocks one score flush statement that flushes n answers.
+func expectFlush(mock sqlmock.Sqlmock, n int) {
+	mock.ExpectQuery(`WITH flushed AS \(\s+UPDATE answers SET scored = TRUE`).
+		WithArgs(scoreFlushSize).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(n))
+}
+
+func TestFlushScores(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	s := NewQuizService(&database.DB{DB: db}, nil)
+
+	// Flushing continues until a batch comes back short
+	expectFlush(mock, scoreFlushSize)
+	expectFlush(mock, 12)
+
+	assert.NoError(t, s.FlushScores(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBufferScore(t *testing.T) {
+	s := NewQuizService(nil, nil)
+
+	for i := 0; i < scoreFlushSize-1; i++ {
+		s.bufferScore()
+	}
+	assert.Len(t, s.scoresReady, 0)
+
+	// A full batch wakes the flusher
+	s.bufferScore()
+	assert.Len(t, s.scoresReady, 1)
+}
+
+func TestRunScoreFlusher_FlushesOnShutdown(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	s := NewQuizService(&database.DB{DB: db}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The flusher is already stopping, but still flushes what is waiting
+	expectFlush(mock, 1)
+
+	s.RunScoreFlusher(ctx, time.Hour)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+const (
+	// sessionTTL is how long a resume token stays valid after the client
+	// last connected with it.
+	sessionTTL = 2 * time.Hour
+	// eventLogSize is how many of a quiz's most recent events are kept for
+	// reconnecting clients.
+	eventLogSize = 1000
+	eventLogTTL  = 24 * time.Hour
+)
+
+// Quiz states reported to reconnecting clients.
+const (
+	QuizStateLobby          = "lobby"
+	QuizStateQuestionOpen   = "question_open"
+	QuizStateQuestionClosed = "question_closed"
+)
+
+// Session ties a resume token to the quiz and user it was issued for.
+type Session struct {
+	Token  string `json:"resume_token"`
+	QuizID string `json:"quiz_id"`
+	UserID string `json:"user_id"`
+}
+
+// ResumeState is everything a reconnecting client needs to catch up.
+type ResumeState struct {
+	QuizState      string                `json:"quiz_state"`
+	ActiveQuestion *ActiveQuestion       `json:"active_question,omitempty"`
+	Answers        []models.AnswerRecord `json:"answers"`
+	MissedEvents   []json.RawMessage     `json:"missed_events"`
+	// EventsComplete is false when some missed events have already been
+	// dropped from the log, in which case the client should rely on the
+	// state and the fresh leaderboard instead.
+	EventsComplete bool `json:"events_complete"`
+}
+
+func sessionKey(token string) string {
+	return fmt.Sprintf("session:%s", token)
+}
+
+func eventLogKey(quizID string) string {
+	return fmt.Sprintf("quiz:%s:events", quizID)
+}
+
+func eventSeqKey(quizID string) string {
+	return fmt.Sprintf("quiz:%s:events:seq", quizID)
+}
+
+// CreateSession issues a resume token for a user connected to a quiz.
+func (s *QuizService) CreateSession(ctx context.Context, quizID, userID string) (*Session, error) {
+	token, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	key := sessionKey(token)
+	_, err = s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "quiz_id", quizID, "user_id", userID)
+		pipe.Expire(ctx, key, sessionTTL)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Token: token, QuizID: quizID, UserID: userID}, nil
+}
+
+// ResumeSession looks up the session for a resume token and extends its
+// lifetime.
+func (s *QuizService) ResumeSession(ctx context.Context, token string) (*Session, error) {
+	key := sessionKey(token)
+	values, err := s.redis.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if values["quiz_id"] == "" || values["user_id"] == "" {
+		return nil, apperrors.ErrInvalidResumeToken
+	}
+	if err := s.redis.Expire(ctx, key, sessionTTL).Err(); err != nil {
+		return nil, err
+	}
+	return &Session{Token: token, QuizID: values["quiz_id"], UserID: values["user_id"]}, nil
+}
+
+// AppendEvent assigns an event the quiz's next sequence number, encodes it
+// with that number and keeps it in the quiz's event log so that clients
+// that reconnect can replay it.
+func (s *QuizService) AppendEvent(ctx context.Context, quizID string, encode func(seq int64) ([]byte, error)) ([]byte, error) {
+	seq, err := s.redis.Incr(ctx, eventSeqKey(quizID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	data, err := encode(seq)
+	if err != nil {
+		return nil, err
+	}
+
+	key := eventLogKey(quizID)
+	_, err = s.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, &redis.Z{Score: float64(seq), Member: data})
+		pipe.ZRemRangeByRank(ctx, key, 0, -eventLogSize-1)
+		pipe.Expire(ctx, key, eventLogTTL)
+		pipe.Expire(ctx, eventSeqKey(quizID), eventLogTTL)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// LastEventSeq returns the sequence number of the quiz's latest event.
+func (s *QuizService) LastEventSeq(ctx context.Context, quizID string) (int64, error) {
+	seq, err := s.redis.Get(ctx, eventSeqKey(quizID)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// GetEventsSince returns the quiz's events with a sequence number above
+// seq, and whether none of them have been dropped from the log. A seq
+// beyond the latest event belongs to a log that has since expired, so
+// every event is treated as dropped.
+func (s *QuizService) GetEventsSince(ctx context.Context, quizID string, seq int64) ([]json.RawMessage, bool, error) {
+	lastSeq, err := s.LastEventSeq(ctx, quizID)
+	if err != nil {
+		return nil, false, err
+	}
+	if seq > lastSeq {
+		return []json.RawMessage{}, false, nil
+	}
+	if seq == lastSeq {
+		return []json.RawMessage{}, true, nil
+	}
+
+	members, err := s.redis.ZRangeByScoreWithScores(ctx, eventLogKey(quizID), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(seq, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, false, err
+	}
+
+	events := make([]json.RawMessage, len(members))
+	for i, m := range members {
+		events[i] = json.RawMessage(fmt.Sprint(m.Member))
+	}
+	complete := len(members) > 0 && int64(members[0].Score) == seq+1
+	return events, complete, nil
+}
+
+// GetResumeState collects the quiz state, the user's answers and the events
+// missed since lastSeq for a reconnecting client.
+func (s *QuizService) GetResumeState(ctx context.Context, quizID, userID string, lastSeq int64) (*ResumeState, error) {
+	state := &ResumeState{QuizState: QuizStateLobby}
+
+	active, err := s.GetActiveQuestion(ctx, quizID)
+	if err != nil {
+		return nil, err
+	}
+	if active != nil {
+		state.ActiveQuestion = active
+		state.QuizState = QuizStateQuestionOpen
+		if active.RemainingMs != nil && *active.RemainingMs == 0 {
+			state.QuizState = QuizStateQuestionClosed
+		}
+	}
+
+	state.Answers, err = s.db.GetUserQuizAnswers(ctx, quizID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if state.Answers == nil {
+		state.Answers = []models.AnswerRecord{}
+	}
+
+	state.MissedEvents, state.EventsComplete, err = s.GetEventsSince(ctx, quizID, lastSeq)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-redis/redis/v8"
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/database"
+)
+
+func TestResumeSession(t *testing.T) {
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(nil, redisClient)
+	ctx := context.Background()
+
+	redisMock.ExpectHGetAll("session:token1").SetVal(map[string]string{"quiz_id": "quiz1", "user_id": "user1"})
+	redisMock.ExpectExpire("session:token1", sessionTTL).SetVal(true)
+	session, err := s.ResumeSession(ctx, "token1")
+	assert.NoError(t, err)
+	assert.Equal(t, &Session{Token: "token1", QuizID: "quiz1", UserID: "user1"}, session)
+
+	redisMock.ExpectHGetAll("session:expired").SetVal(map[string]string{})
+	_, err = s.ResumeSession(ctx, "expired")
+	assert.ErrorIs(t, err, apperrors.ErrInvalidResumeToken)
+
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestAppendEvent(t *testing.T) {
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(nil, redisClient)
+
+	redisMock.ExpectIncr("quiz:quiz1:events:seq").SetVal(8)
+	redisMock.ExpectTxPipeline()
+	redisMock.ExpectZAdd("quiz:quiz1:events", &redis.Z{Score: 8, Member: []byte(`{"seq":8}`)}).SetVal(1)
+	redisMock.ExpectZRemRangeByRank("quiz:quiz1:events", 0, -eventLogSize-1).SetVal(0)
+	redisMock.ExpectExpire("quiz:quiz1:events", eventLogTTL).SetVal(true)
+	redisMock.ExpectExpire("quiz:quiz1:events:seq", eventLogTTL).SetVal(true)
+	redisMock.ExpectTxPipelineExec()
+
+	data, err := s.AppendEvent(context.Background(), "quiz1", func(seq int64) ([]byte, error) {
+		return json.Marshal(map[string]int64{"seq": seq})
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"seq":8}`, string(data))
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestGetEventsSince(t *testing.T) {
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(nil, redisClient)
+	ctx := context.Background()
+
+	// Every missed event is still in the log
+	redisMock.ExpectGet("quiz:quiz1:events:seq").SetVal("5")
+	redisMock.ExpectZRangeByScoreWithScores("quiz:quiz1:events", &redis.ZRangeBy{Min: "(3", Max: "+inf"}).
+		SetVal([]redis.Z{{Score: 4, Member: `{"seq":4}`}, {Score: 5, Member: `{"seq":5}`}})
+	events, complete, err := s.GetEventsSince(ctx, "quiz1", 3)
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, []json.RawMessage{json.RawMessage(`{"seq":4}`), json.RawMessage(`{"seq":5}`)}, events)
+
+	// Events 2 to 3 have already been trimmed
+	redisMock.ExpectGet("quiz:quiz1:events:seq").SetVal("5")
+	redisMock.ExpectZRangeByScoreWithScores("quiz:quiz1:events", &redis.ZRangeBy{Min: "(1", Max: "+inf"}).
+		SetVal([]redis.Z{{Score: 4, Member: `{"seq":4}`}, {Score: 5, Member: `{"seq":5}`}})
+	_, complete, err = s.GetEventsSince(ctx, "quiz1", 1)
+	assert.NoError(t, err)
+	assert.False(t, complete)
+
+	// Nothing missed
+	redisMock.ExpectGet("quiz:quiz1:events:seq").SetVal("5")
+	events, complete, err = s.GetEventsSince(ctx, "quiz1", 5)
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	assert.Empty(t, events)
+
+	// The log the client last saw has expired and numbering started again
+	redisMock.ExpectGet("quiz:quiz1:events:seq").SetVal("2")
+	events, complete, err = s.GetEventsSince(ctx, "quiz1", 5)
+	assert.NoError(t, err)
+	assert.False(t, complete)
+	assert.Empty(t, events)
+
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
+
+func TestGetResumeState(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	redisClient, redisMock := redismock.NewClientMock()
+	s := NewQuizService(&database.DB{DB: db}, redisClient)
+
+	question := soapQuestion()
+	question.TimeLimitSeconds = 30
+	openedAt := time.Now().Add(-10 * time.Second).UnixMilli()
+	redisMock.ExpectHGetAll("quiz:quiz1:active_question").SetVal(map[string]string{
+		"question_id": "q1",
+		"opened_at":   strconv.FormatInt(openedAt, 10),
+	})
+	expectGetQuestion(mock, question)
+	mock.ExpectQuery(`SELECT a\.id, a\.quiz_id, a\.question_id, q\.question_text`).
+		WithArgs("quiz1", "user1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "quiz_id", "question_id", "question_text", "user_id", "answer",
+			"is_correct", "points", "response_time_ms", "answered_at"}))
+	redisMock.ExpectGet("quiz:quiz1:events:seq").SetVal("2")
+	redisMock.ExpectZRangeByScoreWithScores("quiz:quiz1:events", &redis.ZRangeBy{Min: "(1", Max: "+inf"}).
+		SetVal([]redis.Z{{Score: 2, Member: `{"type":"question_opened","seq":2}`}})
+
+	state, err := s.GetResumeState(context.Background(), "quiz1", "user1", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, QuizStateQuestionOpen, state.QuizState)
+	assert.Equal(t, "q1", state.ActiveQuestion.Question.ID)
+	assert.Len(t, state.ActiveQuestion.Question.Options, 2)
+	assert.InDelta(t, 20000, *state.ActiveQuestion.RemainingMs, 1000)
+	assert.Empty(t, state.Answers)
+	assert.True(t, state.EventsComplete)
+	assert.Len(t, state.MissedEvents, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, redisMock.ExpectationsWereMet())
+}
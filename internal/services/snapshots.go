@@ -0,0 +1,35 @@
+package services
+
+import (
+	"context"
+
+	"realtime_leaderboard/internal/models"
+)
+
+// HistoricalLeaderboard is a page of a quiz's standings as they were when
+// its QuestionNumber'th question closed.
+type HistoricalLeaderboard struct {
+	models.LeaderboardSnapshot
+	PaginatedLeaderboard
+}
+
+// GetLeaderboardSnapshot returns a page of the standings snapshotted when
+// the quiz's questionNumber'th question closed, counting from 1 in the
+// order the questions closed.
+func (s *QuizService) GetLeaderboardSnapshot(ctx context.Context, quizID string, questionNumber, page, pageSize int) (*HistoricalLeaderboard, error) {
+	snapshot, totalCount, err := s.db.GetLeaderboardSnapshot(ctx, quizID, questionNumber)
+	if err != nil {
+		return nil, err
+	}
+	leaderboard, err := s.db.GetSnapshotEntries(ctx, quizID, questionNumber, page, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	if leaderboard == nil {
+		leaderboard = []models.LeaderboardEntry{}
+	}
+	return &HistoricalLeaderboard{
+		LeaderboardSnapshot:  *snapshot,
+		PaginatedLeaderboard: PaginatedLeaderboard{Leaderboard: leaderboard, TotalCount: totalCount, Page: page, PageSize: pageSize},
+	}, nil
+}
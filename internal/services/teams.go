@@ -0,0 +1,62 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+const maxTeamNameLength = 100
+
+type TeamLeaderboard struct {
+	QuizID      string                        `json:"quiz_id"`
+	Leaderboard []models.TeamLeaderboardEntry `json:"leaderboard"`
+}
+
+// JoinTeam puts the user in the named team, creating it on first use.
+// Teams can only be joined or switched in the lobby, before the first
+// question is opened.
+func (s *QuizService) JoinTeam(ctx context.Context, quizID, userID, teamName string) (*models.Team, error) {
+	teamName = strings.TrimSpace(teamName)
+	if teamName == "" || len(teamName) > maxTeamNameLength {
+		return nil, apperrors.ErrInvalidTeamName
+	}
+
+	status, err := s.db.GetQuizStatus(ctx, quizID)
+	if err != nil {
+		return nil, err
+	}
+	if status != models.QuizStatusLobby {
+		return nil, apperrors.ErrQuizStarted
+	}
+
+	teamID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	return s.db.JoinTeam(ctx, quizID, userID, teamID, teamName)
+}
+
+func (s *QuizService) GetTeamLeaderboard(ctx context.Context, quizID string) (*TeamLeaderboard, error) {
+	leaderboard, err := s.db.GetTeamLeaderboard(ctx, quizID)
+	if err != nil {
+		return nil, err
+	}
+	if leaderboard == nil {
+		leaderboard = []models.TeamLeaderboardEntry{}
+	}
+	return &TeamLeaderboard{QuizID: quizID, Leaderboard: leaderboard}, nil
+}
+
+// newID returns a random 32 character hex identifier.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
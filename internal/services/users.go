@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"realtime_leaderboard/internal/apperrors"
+	"realtime_leaderboard/internal/models"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxAvatarURLLength   = 2048
+	// guestNameAttempts is how many random suffixes are tried before giving
+	// up on a guest username that is still free.
+	guestNameAttempts = 3
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+// NewUser is the body of POST /users.
+type NewUser struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+// ProfileUpdate is the body of PATCH /users/{id}. Fields left out are
+// unchanged.
+type ProfileUpdate struct {
+	DisplayName *string `json:"display_name"`
+	AvatarURL   *string `json:"avatar_url"`
+}
+
+func (s *QuizService) RegisterUser(ctx context.Context, req NewUser) (*models.User, error) {
+	if !usernamePattern.MatchString(req.Username) {
+		return nil, apperrors.ErrInvalidUsername
+	}
+	displayName, err := validateDisplayName(req.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateAvatarURL(req.AvatarURL); err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	user := &models.User{ID: id, Username: req.Username, DisplayName: displayName, AvatarURL: req.AvatarURL}
+	if err := s.db.CreateUser(ctx, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *QuizService) GetUser(ctx context.Context, userID string) (*models.User, error) {
+	return s.db.GetUser(ctx, userID)
+}
+
+func (s *QuizService) UpdateProfile(ctx context.Context, userID string, update ProfileUpdate) (*models.User, error) {
+	if update.DisplayName != nil {
+		displayName, err := validateDisplayName(*update.DisplayName)
+		if err != nil {
+			return nil, err
+		}
+		update.DisplayName = &displayName
+	}
+	if update.AvatarURL != nil {
+		if err := validateAvatarURL(*update.AvatarURL); err != nil {
+			return nil, err
+		}
+	}
+	return s.db.UpdateUser(ctx, userID, update.DisplayName, update.AvatarURL)
+}
+
+// JoinAsGuest creates a guest user for a player without an account and
+// registers them for the quiz. The guest's username is their nickname with
+// a random suffix, so it stays readable on leaderboards while remaining
+// unique; registered usernames can't contain the '#' separating the two.
+func (s *QuizService) JoinAsGuest(ctx context.Context, quizID, nickname string) (*models.User, error) {
+	nickname, err := validateDisplayName(nickname)
+	if err != nil || nickname == "" {
+		return nil, apperrors.ErrInvalidNickname
+	}
+
+	for attempt := 1; ; attempt++ {
+		id, err := newID()
+		if err != nil {
+			return nil, err
+		}
+		suffix := make([]byte, 2)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+		user := &models.User{
+			ID:          id,
+			Username:    nickname + "#" + hex.EncodeToString(suffix),
+			DisplayName: nickname,
+			Guest:       true,
+		}
+		quizExists, err := s.db.CreateGuest(ctx, user, quizID)
+		switch {
+		case errors.Is(err, apperrors.ErrUsernameTaken) && attempt < guestNameAttempts:
+			continue
+		case err != nil:
+			return nil, err
+		case !quizExists:
+			return nil, apperrors.ErrQuizNotFound
+		}
+		return user, nil
+	}
+}
+
+// validateDisplayName trims the name, which may be empty, and checks its
+// length and that it has no control characters.
+func validateDisplayName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > maxDisplayNameLength || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", apperrors.ErrInvalidDisplayName
+	}
+	return name, nil
+}
+
+// validateAvatarURL accepts an empty URL, which removes the avatar, or an
+// absolute http or https URL.
+func validateAvatarURL(avatarURL string) error {
+	if avatarURL == "" {
+		return nil
+	}
+	u, err := url.Parse(avatarURL)
+	if err != nil || len(avatarURL) > maxAvatarURLLength || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return apperrors.ErrInvalidAvatarURL
+	}
+	return nil
+}